@@ -6,6 +6,8 @@
 package grpc_prometheus
 
 import (
+	"time"
+
 	prom "github.com/prometheus/client_golang/prometheus"
 )
 
@@ -23,10 +25,9 @@ var (
 )
 
 func init() {
-	prom.MustRegister(DefaultClientMetrics.clientStartedCounter)
-	prom.MustRegister(DefaultClientMetrics.clientHandledCounter)
-	prom.MustRegister(DefaultClientMetrics.clientStreamMsgReceived)
-	prom.MustRegister(DefaultClientMetrics.clientStreamMsgSent)
+	if err := DefaultClientMetrics.RegisterTo(prom.DefaultRegisterer); err != nil {
+		panic(err)
+	}
 }
 
 // EnableClientHandlingTimeHistogram turns on recording of handling time of
@@ -35,7 +36,52 @@ func init() {
 // default Prometheus metrics registry.
 func EnableClientHandlingTimeHistogram(opts ...HistogramOption) {
 	DefaultClientMetrics.EnableClientHandlingTimeHistogram(opts...)
-	prom.Register(DefaultClientMetrics.clientHandledHistogram)
+}
+
+// OverrideClientHandlingTimeHistogram makes the handling time of the methods
+// matching pattern, e.g. "/package.Service/*", be recorded with different
+// histogram options. This function acts on the DefaultClientMetrics variable.
+func OverrideClientHandlingTimeHistogram(pattern string, opts ...HistogramOption) error {
+	return DefaultClientMetrics.OverrideClientHandlingTimeHistogram(pattern, opts...)
+}
+
+// SampleClientHandlingTimeHistogram makes the methods matching pattern only
+// observe the handling time of one in every `every` RPCs, exported scaled
+// accordingly. This function acts on the DefaultClientMetrics variable.
+func SampleClientHandlingTimeHistogram(pattern string, every int) error {
+	return DefaultClientMetrics.SampleClientHandlingTimeHistogram(pattern, every)
+}
+
+// DisableClientHandlingTimeHistogram turns off recording of handling time of
+// RPCs.
+// This function acts on the DefaultClientMetrics variable.
+func DisableClientHandlingTimeHistogram() {
+	DefaultClientMetrics.DisableClientHandlingTimeHistogram()
+}
+
+// EnableClientStreamAgeMetrics enables exporting the ages of active streams.
+// This function acts on the DefaultClientMetrics variable.
+func EnableClientStreamAgeMetrics() {
+	DefaultClientMetrics.EnableClientStreamAgeMetrics()
+}
+
+// DisableClientStreamAgeMetrics disables exporting the ages of active
+// streams. This function acts on the DefaultClientMetrics variable.
+func DisableClientStreamAgeMetrics() {
+	DefaultClientMetrics.DisableClientStreamAgeMetrics()
+}
+
+// EnableClientIdleStreamMetrics enables exporting how many streams are
+// without messages for longer than each threshold. This function acts on the
+// DefaultClientMetrics variable.
+func EnableClientIdleStreamMetrics(thresholds ...time.Duration) {
+	DefaultClientMetrics.EnableClientIdleStreamMetrics(thresholds...)
+}
+
+// AddClientRPCHooks adds hooks called with every RPC completed by the client.
+// This function acts on the DefaultClientMetrics variable.
+func AddClientRPCHooks(hooks ...RPCHook) {
+	DefaultClientMetrics.AddClientRPCHooks(hooks...)
 }
 
 // EnableClientStreamReceiveTimeHistogram turns on recording of
@@ -44,7 +90,20 @@ func EnableClientHandlingTimeHistogram(opts ...HistogramOption) {
 // default Prometheus metrics registry.
 func EnableClientStreamReceiveTimeHistogram(opts ...HistogramOption) {
 	DefaultClientMetrics.EnableClientStreamReceiveTimeHistogram(opts...)
-	prom.Register(DefaultClientMetrics.clientStreamRecvHistogram)
+}
+
+// SampleClientStreamReceiveTimeHistogram makes the methods matching pattern
+// only observe the receive time of one in every `every` stream messages.
+// This function acts on the DefaultClientMetrics variable.
+func SampleClientStreamReceiveTimeHistogram(pattern string, every int) error {
+	return DefaultClientMetrics.SampleClientStreamReceiveTimeHistogram(pattern, every)
+}
+
+// DisableClientStreamReceiveTimeHistogram turns off recording of
+// single message receive time of streaming RPCs.
+// This function acts on the DefaultClientMetrics variable.
+func DisableClientStreamReceiveTimeHistogram() {
+	DefaultClientMetrics.DisableClientStreamReceiveTimeHistogram()
 }
 
 // EnableClientStreamSendTimeHistogram turns on recording of
@@ -53,5 +112,25 @@ func EnableClientStreamReceiveTimeHistogram(opts ...HistogramOption) {
 // default Prometheus metrics registry.
 func EnableClientStreamSendTimeHistogram(opts ...HistogramOption) {
 	DefaultClientMetrics.EnableClientStreamSendTimeHistogram(opts...)
-	prom.Register(DefaultClientMetrics.clientStreamSendHistogram)
+}
+
+// SampleClientStreamSendTimeHistogram makes the methods matching pattern
+// only observe the send time of one in every `every` stream messages. This
+// function acts on the DefaultClientMetrics variable.
+func SampleClientStreamSendTimeHistogram(pattern string, every int) error {
+	return DefaultClientMetrics.SampleClientStreamSendTimeHistogram(pattern, every)
+}
+
+// DisableClientStreamSendTimeHistogram turns off recording of
+// single message send time of streaming RPCs.
+// This function acts on the DefaultClientMetrics variable.
+func DisableClientStreamSendTimeHistogram() {
+	DefaultClientMetrics.DisableClientStreamSendTimeHistogram()
+}
+
+// EnableClientSLIEvents turns on counting completed RPCs as good or bad events
+// of a service level indicator. This function acts on the DefaultClientMetrics
+// variable and the default Prometheus metrics registry.
+func EnableClientSLIEvents(slos ...SLO) {
+	DefaultClientMetrics.EnableClientSLIEvents(slos...)
 }
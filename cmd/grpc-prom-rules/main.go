@@ -0,0 +1,103 @@
+// Command grpc-prom-rules generates Prometheus recording and alerting rules
+// for gRPC services instrumented with go-grpc-prometheus.
+//
+// Services are given either by name or as a FileDescriptorSet produced by
+// `protoc --include_imports --descriptor_set_out`. Only the services of the
+// files given by -proto_file are read from the set, or, without it, those of
+// the files not imported by another, rather than those of all imports:
+//
+//	grpc-prom-rules -service=mwitkow.testproto.TestService -availability=0.999 > rules.yaml
+//	grpc-prom-rules -descriptor_set=service.pb -proto_file=service.proto -format=prometheusrule -name=my-service
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/promrules"
+)
+
+// stringList is a flag that may be repeated or given a comma-separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+func main() {
+	var (
+		services         stringList
+		protoFiles       stringList
+		descriptorSet    = flag.String("descriptor_set", "", "Path to a FileDescriptorSet; rules are generated for the services of its -proto_file files.")
+		availability     = flag.Float64("availability", 0.999, "Availability objective, as the ratio of RPCs not failing with a server-side error code.")
+		latencyQuantile  = flag.Float64("latency_quantile", 0.99, "Recorded handling time quantile.")
+		latencyThreshold = flag.Float64("latency_threshold", 0, "If positive, alert when the latency quantile of a method exceeds this many seconds.")
+		format           = flag.String("format", "rules", "Output format: rules for a Prometheus rule file, prometheusrule for a Prometheus Operator resource.")
+		name             = flag.String("name", "grpc-rules", "Name of the PrometheusRule resource.")
+		namespace        = flag.String("namespace", "", "Namespace of the PrometheusRule resource.")
+		out              = flag.String("out", "", "Output file; defaults to stdout.")
+	)
+	flag.Var(&services, "service", "Fully-qualified gRPC service name. May be repeated or comma-separated.")
+	flag.Var(&protoFiles, "proto_file", "File of the descriptor set whose services rules are generated for, as given to protoc; defaults to the files not imported by another. May be repeated or comma-separated.")
+	flag.Parse()
+
+	if err := run(services, *descriptorSet, protoFiles, *availability, *latencyQuantile, *latencyThreshold, *format, *name, *namespace, *out); err != nil {
+		fmt.Fprintf(os.Stderr, "grpc-prom-rules: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(services []string, descriptorSet string, protoFiles []string, availability, latencyQuantile, latencyThreshold float64, format, name, namespace, out string) error {
+	if descriptorSet != "" {
+		b, err := ioutil.ReadFile(descriptorSet)
+		if err != nil {
+			return err
+		}
+		fromSet, err := promrules.ServicesFromDescriptorSet(b, protoFiles...)
+		if err != nil {
+			return err
+		}
+		services = append(services, fromSet...)
+	}
+	cfg := promrules.Config{
+		Availability:    availability,
+		LatencyQuantile: latencyQuantile,
+	}
+	for _, s := range services {
+		cfg.Services = append(cfg.Services, promrules.Service{Name: s, LatencyThreshold: latencyThreshold})
+	}
+	rules, err := promrules.Generate(cfg)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	switch format {
+	case "rules":
+		b, err = rules.Marshal()
+	case "prometheusrule":
+		b, err = rules.MarshalPrometheusRule(name, namespace)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(out, b, 0644)
+}
@@ -0,0 +1,208 @@
+package grpc_prometheus
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/metadata"
+)
+
+// The metrics are implemented by the grpcprom package, which has no global
+// state. This package adds the default metrics, interceptors and functions
+// acting on them, registered on the default Prometheus registry on import.
+
+// ServerMetrics represents a collection of metrics to be registered on a
+// Prometheus metrics registry for a gRPC server.
+type ServerMetrics = grpcprom.ServerMetrics
+
+// ClientMetrics represents a collection of metrics to be registered on a
+// Prometheus metrics registry for a gRPC client.
+type ClientMetrics = grpcprom.ClientMetrics
+
+// An Option configures a ServerMetrics or ClientMetrics on construction. A
+// CounterOption is an Option applying to all counters.
+type Option = grpcprom.Option
+
+// A CounterOption lets you add options to Counter metrics using With* funcs.
+type CounterOption = grpcprom.CounterOption
+
+// A HistogramOption lets you add options to Histogram metrics using With*
+// funcs.
+type HistogramOption = grpcprom.HistogramOption
+
+// GRPCType is the kind of a gRPC method, as reported in the grpc_type label.
+type GRPCType = grpcprom.GRPCType
+
+const (
+	Unary        = grpcprom.Unary
+	ClientStream = grpcprom.ClientStream
+	ServerStream = grpcprom.ServerStream
+	BidiStream   = grpcprom.BidiStream
+	HTTPGateway  = grpcprom.HTTPGateway
+)
+
+// RPC identifies the gRPC method an event is reported for.
+type RPC = grpcprom.RPC
+
+// Reporter receives the events observed by the server and client
+// interceptors.
+type Reporter = grpcprom.Reporter
+
+// MemoryReporter is a Reporter that keeps all reported events in memory.
+type MemoryReporter = grpcprom.MemoryReporter
+
+// SLO defines which completed RPCs of a set of methods are good and which are
+// bad events of a service level indicator.
+type SLO = grpcprom.SLO
+
+// Snapshot holds the statistics of every method, read from the same metrics
+// as those exported to Prometheus.
+type Snapshot = grpcprom.Snapshot
+
+// MethodSnapshot holds the statistics of a method.
+type MethodSnapshot = grpcprom.MethodSnapshot
+
+// MethodStats are the counts of RPCs of a method and their handling time.
+type MethodStats = grpcprom.MethodStats
+
+// LatencyHistogram is a handling time histogram.
+type LatencyHistogram = grpcprom.LatencyHistogram
+
+// Bucket is a bucket of a LatencyHistogram.
+type Bucket = grpcprom.Bucket
+
+// HealthServer is a health.Server whose serving statuses are exported as
+// metrics.
+type HealthServer = grpcprom.HealthServer
+
+// HealthDegradation configures EnableHealthDegradation.
+type HealthDegradation = grpcprom.HealthDegradation
+
+// ServingStatusSetter sets the serving status of the services of a health
+// server, like health.Server and HealthServer.
+type ServingStatusSetter = grpcprom.ServingStatusSetter
+
+// RPCInfo describes a completed RPC, as passed to an RPCHook.
+type RPCInfo = grpcprom.RPCInfo
+
+// RPCHook is called with every completed RPC.
+type RPCHook = grpcprom.RPCHook
+
+// NewServerMetrics returns a ServerMetrics object. Use a new instance of
+// ServerMetrics when not using the default Prometheus metrics registry, for
+// example when wanting to control which metrics are added to a registry as
+// opposed to automatically adding metrics via init functions.
+func NewServerMetrics(counterOpts ...CounterOption) *ServerMetrics {
+	return grpcprom.NewServerMetrics(counterOpts...)
+}
+
+// NewServerMetricsWithOptions is like NewServerMetrics, but also takes the
+// Options that are not CounterOptions, e.g. WithServerLabel or WithRPCHooks.
+func NewServerMetricsWithOptions(opts ...Option) *ServerMetrics {
+	return grpcprom.NewServerMetricsWithOptions(opts...)
+}
+
+// NewServerMetricsWithReporter returns a ServerMetrics object whose
+// interceptors report to the given Reporter instead of Prometheus metrics.
+func NewServerMetricsWithReporter(r Reporter, opts ...Option) *ServerMetrics {
+	return grpcprom.NewServerMetricsWithReporter(r, opts...)
+}
+
+// NewClientMetrics returns a ClientMetrics object. Use a new instance of
+// ClientMetrics when not using the default Prometheus metrics registry, for
+// example when wanting to control which metrics are added to a registry as
+// opposed to automatically adding metrics via init functions.
+func NewClientMetrics(counterOpts ...CounterOption) *ClientMetrics {
+	return grpcprom.NewClientMetrics(counterOpts...)
+}
+
+// NewClientMetricsWithOptions is like NewClientMetrics, but also takes the
+// Options that are not CounterOptions, e.g. WithClientTargetLabel or
+// WithRPCHooks.
+func NewClientMetricsWithOptions(opts ...Option) *ClientMetrics {
+	return grpcprom.NewClientMetricsWithOptions(opts...)
+}
+
+// NewClientMetricsWithReporter returns a ClientMetrics object whose
+// interceptors report to the given Reporter instead of Prometheus metrics.
+func NewClientMetricsWithReporter(r Reporter, opts ...Option) *ClientMetrics {
+	return grpcprom.NewClientMetricsWithReporter(r, opts...)
+}
+
+// NormalizeTarget returns the endpoint of a dial target resolved to a host
+// and port, without its scheme and authority. Targets of other schemes, such
+// as unix sockets, keep it. It is the default mapping of
+// WithClientTargetLabel.
+func NormalizeTarget(target string) string {
+	return grpcprom.NormalizeTarget(target)
+}
+
+// GatewayAnnotator returns a grpc-gateway metadata annotator telling
+// HTTPGatewayMiddleware the method a request was routed to, as returned by
+// rpcMethod, e.g. runtime.RPCMethod.
+func GatewayAnnotator(rpcMethod func(context.Context) (string, bool)) func(context.Context, *http.Request) metadata.MD {
+	return grpcprom.GatewayAnnotator(rpcMethod)
+}
+
+// SlowRPCLogHook returns an RPCHook logging the RPCs slower than threshold
+// to logger at warning level, or to slog.Default() if logger is nil.
+func SlowRPCLogHook(logger *slog.Logger, threshold time.Duration) RPCHook {
+	return grpcprom.SlowRPCLogHook(logger, threshold)
+}
+
+// AccessLogHook returns an RPCHook logging every RPC to logger at info level,
+// or to slog.Default() if logger is nil.
+func AccessLogHook(logger *slog.Logger) RPCHook {
+	return grpcprom.AccessLogHook(logger)
+}
+
+// NewMemoryReporter returns an empty MemoryReporter.
+func NewMemoryReporter() *MemoryReporter {
+	return grpcprom.NewMemoryReporter()
+}
+
+// WithConstLabels allows you to add ConstLabels to Counter metrics.
+func WithConstLabels(labels prom.Labels) CounterOption {
+	return grpcprom.WithConstLabels(labels)
+}
+
+// WithServerLabel adds the grpc_server label to all server metrics, telling
+// apart the views returned by ForServer.
+func WithServerLabel() Option {
+	return grpcprom.WithServerLabel()
+}
+
+// WithClientBackendLabel adds the grpc_backend label to the metrics of
+// completed client RPCs, set to the address of the server that handled them,
+// for up to maxBackends addresses.
+func WithClientBackendLabel(maxBackends int) Option {
+	return grpcprom.WithClientBackendLabel(maxBackends)
+}
+
+// WithClientTargetLabel adds the grpc_target label to all client metrics, set
+// to the target of the ClientConn of each RPC as mapped by fn, or by
+// NormalizeTarget if fn is nil.
+func WithClientTargetLabel(fn func(target string) string) Option {
+	return grpcprom.WithClientTargetLabel(fn)
+}
+
+// WithRPCHooks adds hooks called with every completed RPC, e.g.
+// SlowRPCLogHook or AccessLogHook.
+func WithRPCHooks(hooks ...RPCHook) Option {
+	return grpcprom.WithRPCHooks(hooks...)
+}
+
+// WithHistogramBuckets allows you to specify custom bucket ranges for histograms if EnableHandlingTimeHistogram is on.
+func WithHistogramBuckets(buckets []float64) HistogramOption {
+	return grpcprom.WithHistogramBuckets(buckets)
+}
+
+// WithHistogramConstLabels allows you to add custom ConstLabels to
+// histograms metrics.
+func WithHistogramConstLabels(labels prom.Labels) HistogramOption {
+	return grpcprom.WithHistogramConstLabels(labels)
+}
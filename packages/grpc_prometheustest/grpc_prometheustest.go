@@ -0,0 +1,315 @@
+// Package grpc_prometheustest provides helpers for testing services
+// instrumented with grpc_prometheus.
+//
+// NewServer starts an instrumented gRPC server on an in-memory listener and
+// connects a client to it. The Expect* functions assert on the metrics of a
+// ServerMetrics or ClientMetrics, and the Eventually* functions retry the
+// same assertions until they hold or RetryTimeout passes. The latter are
+// needed for streaming RPCs, whose server-side metrics are recorded only
+// after the client has already received the final message.
+package grpc_prometheustest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// RetryTimeout bounds how long the Eventually* functions wait for a metric
+// to reach the expected value.
+var RetryTimeout = 2 * time.Second
+
+// retryInterval is the pause between two attempts of the Eventually*
+// functions.
+const retryInterval = 10 * time.Millisecond
+
+const bufSize = 1024 * 1024
+
+// Server is a gRPC server instrumented with a ServerMetrics, listening on an
+// in-memory connection.
+type Server struct {
+	// Server is the instrumented gRPC server.
+	Server *grpc.Server
+	// Conn is a client connection to Server.
+	Conn *grpc.ClientConn
+
+	listener *bufconn.Listener
+}
+
+// NewServer starts a gRPC server using the interceptors of metrics. register
+// is called to register services before the metrics are initialized with
+// InitializeMetrics. Additional dial options, e.g. client interceptors, are
+// applied to Conn. The server is stopped when the test finishes.
+func NewServer(t testing.TB, metrics *grpcprom.ServerMetrics, register func(*grpc.Server), opts ...grpc.DialOption) *Server {
+	t.Helper()
+	s := &Server{
+		Server: grpc.NewServer(
+			grpc.StreamInterceptor(metrics.StreamServerInterceptor()),
+			grpc.UnaryInterceptor(metrics.UnaryServerInterceptor()),
+		),
+		listener: bufconn.Listen(bufSize),
+	}
+	register(s.Server)
+	metrics.InitializeMetrics(s.Server)
+	go s.Server.Serve(s.listener)
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+			return s.listener.Dial()
+		}),
+	}, opts...)
+	conn, err := grpc.Dial("bufconn", dialOpts...)
+	if err != nil {
+		s.Server.Stop()
+		t.Fatalf("failed to dial in-memory server: %v", err)
+	}
+	s.Conn = conn
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close closes the client connection and stops the server.
+func (s *Server) Close() {
+	s.Conn.Close()
+	s.Server.Stop()
+}
+
+// ExpectStarted asserts that want RPCs of method were started. method is
+// either a bare method name, matching any service, or a full
+// "/package.Service/Method" name.
+//
+// The Expect* and Eventually* functions fail if the metric is not collected
+// at all, e.g. before the first RPC of metrics not initialized, or for a
+// histogram not enabled, even if want is zero. Use ExpectAbsent to assert
+// that a method has no series.
+func ExpectStarted(t testing.TB, metrics prometheus.Collector, method string, want int) {
+	t.Helper()
+	if err := checkCounter(metrics, "started_total", method, nil, want); err != nil {
+		t.Error(err)
+	}
+}
+
+// ExpectHandled asserts that want RPCs of method completed with code.
+func ExpectHandled(t testing.TB, metrics prometheus.Collector, method string, code codes.Code, want int) {
+	t.Helper()
+	if err := checkCounter(metrics, "handled_total", method, map[string]string{"grpc_code": code.String()}, want); err != nil {
+		t.Error(err)
+	}
+}
+
+// ExpectMsgSent asserts that want messages of method were sent.
+func ExpectMsgSent(t testing.TB, metrics prometheus.Collector, method string, want int) {
+	t.Helper()
+	if err := checkCounter(metrics, "msg_sent_total", method, nil, want); err != nil {
+		t.Error(err)
+	}
+}
+
+// ExpectMsgReceived asserts that want messages of method were received.
+func ExpectMsgReceived(t testing.TB, metrics prometheus.Collector, method string, want int) {
+	t.Helper()
+	if err := checkCounter(metrics, "msg_received_total", method, nil, want); err != nil {
+		t.Error(err)
+	}
+}
+
+// ExpectHistogramCount asserts that the handling time histogram of method
+// holds want observations.
+func ExpectHistogramCount(t testing.TB, metrics prometheus.Collector, method string, want int) {
+	t.Helper()
+	if err := checkHistogramCount(metrics, method, want); err != nil {
+		t.Error(err)
+	}
+}
+
+// ExpectAbsent asserts that no metric of metrics has a series of method.
+func ExpectAbsent(t testing.TB, metrics prometheus.Collector, method string) {
+	t.Helper()
+	if err := checkAbsent(metrics, method); err != nil {
+		t.Error(err)
+	}
+}
+
+// EventuallyHandled is like ExpectHandled, but retries until the assertion
+// holds or RetryTimeout passes.
+func EventuallyHandled(t testing.TB, metrics prometheus.Collector, method string, code codes.Code, want int) {
+	t.Helper()
+	if err := eventually(func() error {
+		return checkCounter(metrics, "handled_total", method, map[string]string{"grpc_code": code.String()}, want)
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+// EventuallyMsgSent is like ExpectMsgSent, but retries until the assertion
+// holds or RetryTimeout passes.
+func EventuallyMsgSent(t testing.TB, metrics prometheus.Collector, method string, want int) {
+	t.Helper()
+	if err := eventually(func() error {
+		return checkCounter(metrics, "msg_sent_total", method, nil, want)
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+// EventuallyHistogramCount is like ExpectHistogramCount, but retries until
+// the assertion holds or RetryTimeout passes.
+func EventuallyHistogramCount(t testing.TB, metrics prometheus.Collector, method string, want int) {
+	t.Helper()
+	if err := eventually(func() error {
+		return checkHistogramCount(metrics, method, want)
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func eventually(check func() error) error {
+	deadline := time.Now().Add(RetryTimeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+func checkCounter(metrics prometheus.Collector, suffix, method string, labels map[string]string, want int) error {
+	wantLabels, err := methodLabels(method, labels)
+	if err != nil {
+		return err
+	}
+	name, series, err := gather(metrics, suffix)
+	if err != nil {
+		return err
+	}
+	var got float64
+	for _, m := range series {
+		if matches(m, wantLabels) {
+			got += m.GetCounter().GetValue()
+		}
+	}
+	if int(got) != want {
+		return fmt.Errorf("expected %d %s for method %q%s; got %v", want, name, method, formatLabels(labels), got)
+	}
+	return nil
+}
+
+func checkHistogramCount(metrics prometheus.Collector, method string, want int) error {
+	wantLabels, err := methodLabels(method, nil)
+	if err != nil {
+		return err
+	}
+	name, series, err := gather(metrics, "handling_seconds")
+	if err != nil {
+		return err
+	}
+	var got uint64
+	for _, m := range series {
+		if matches(m, wantLabels) {
+			got += m.GetHistogram().GetSampleCount()
+		}
+	}
+	if int(got) != want {
+		return fmt.Errorf("expected %d observations in %s for method %q; got %d", want, name, method, got)
+	}
+	return nil
+}
+
+func checkAbsent(metrics prometheus.Collector, method string) error {
+	wantLabels, err := methodLabels(method, nil)
+	if err != nil {
+		return err
+	}
+	families, err := gatherAll(metrics)
+	if err != nil {
+		return err
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if matches(m, wantLabels) {
+				return fmt.Errorf("expected no series of method %q; got one in %s", method, f.GetName())
+			}
+		}
+	}
+	return nil
+}
+
+// gather collects the metric family named grpc_server_<suffix> or
+// grpc_client_<suffix> from metrics, failing if there is none.
+func gather(metrics prometheus.Collector, suffix string) (string, []*dto.Metric, error) {
+	families, err := gatherAll(metrics)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range families {
+		if f.GetName() == "grpc_server_"+suffix || f.GetName() == "grpc_client_"+suffix {
+			return f.GetName(), f.GetMetric(), nil
+		}
+	}
+	return "", nil, fmt.Errorf("no grpc_server_%s or grpc_client_%s metric collected", suffix, suffix)
+}
+
+// gatherAll collects all metric families of metrics.
+func gatherAll(metrics prometheus.Collector) ([]*dto.MetricFamily, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(metrics); err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather metrics: %v", err)
+	}
+	return families, nil
+}
+
+// methodLabels returns the labels identifying method, given as "Method" or
+// "/package.Service/Method", along with labels.
+func methodLabels(method string, labels map[string]string) (map[string]string, error) {
+	want := map[string]string{"grpc_method": method}
+	if strings.Contains(method, "/") {
+		parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed method %q: want \"Method\" or \"/package.Service/Method\"", method)
+		}
+		want["grpc_service"], want["grpc_method"] = parts[0], parts[1]
+	}
+	for k, v := range labels {
+		want[k] = v
+	}
+	return want, nil
+}
+
+func matches(m *dto.Metric, want map[string]string) bool {
+	matched := 0
+	for _, lp := range m.GetLabel() {
+		if v, ok := want[lp.GetName()]; ok {
+			if lp.GetValue() != v {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(want)
+}
+
+func formatLabels(labels map[string]string) string {
+	var parts []string
+	for k, v := range labels {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " with " + strings.Join(parts, ",")
+}
@@ -0,0 +1,100 @@
+package grpc_prometheustest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const countListResponses = 20
+
+type testService struct{}
+
+func (s *testService) PingEmpty(ctx context.Context, _ *pb_testproto.Empty) (*pb_testproto.PingResponse, error) {
+	return &pb_testproto.PingResponse{}, nil
+}
+
+func (s *testService) Ping(ctx context.Context, ping *pb_testproto.PingRequest) (*pb_testproto.PingResponse, error) {
+	return &pb_testproto.PingResponse{Value: ping.Value}, nil
+}
+
+func (s *testService) PingError(ctx context.Context, ping *pb_testproto.PingRequest) (*pb_testproto.Empty, error) {
+	return nil, status.Errorf(codes.Code(ping.ErrorCodeReturned), "Userspace error.")
+}
+
+func (s *testService) PingList(ping *pb_testproto.PingRequest, stream pb_testproto.TestService_PingListServer) error {
+	for i := 0; i < countListResponses; i++ {
+		stream.Send(&pb_testproto.PingResponse{Value: ping.Value, Counter: int32(i)})
+	}
+	return nil
+}
+
+func TestServerAssertions(t *testing.T) {
+	serverMetrics := grpcprom.NewServerMetrics()
+	serverMetrics.EnableHandlingTimeHistogram()
+	clientMetrics := grpcprom.NewClientMetrics()
+	s := NewServer(t, serverMetrics, func(s *grpc.Server) {
+		pb_testproto.RegisterTestServiceServer(s, &testService{})
+	},
+		grpc.WithUnaryInterceptor(clientMetrics.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(clientMetrics.StreamClientInterceptor()),
+	)
+	client := pb_testproto.NewTestServiceClient(s.Conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ExpectHandled(t, serverMetrics, "Ping", codes.OK, 0)
+	ExpectAbsent(t, clientMetrics, "Ping")
+	_, err := client.Ping(ctx, &pb_testproto.PingRequest{})
+	require.NoError(t, err)
+	require.Error(t, checkAbsent(clientMetrics, "Ping"))
+	_, err = client.PingError(ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.NotFound)})
+	require.Error(t, err)
+
+	ExpectStarted(t, serverMetrics, "Ping", 1)
+	ExpectHandled(t, serverMetrics, "Ping", codes.OK, 1)
+	ExpectHandled(t, serverMetrics, "/mwitkow.testproto.TestService/PingError", codes.NotFound, 1)
+	ExpectHistogramCount(t, serverMetrics, "Ping", 1)
+	ExpectHandled(t, clientMetrics, "PingError", codes.NotFound, 1)
+
+	ss, err := client.PingList(ctx, &pb_testproto.PingRequest{})
+	require.NoError(t, err)
+	for {
+		if _, err := ss.Recv(); err == io.EOF {
+			break
+		}
+	}
+	EventuallyHandled(t, serverMetrics, "PingList", codes.OK, 1)
+	EventuallyMsgSent(t, serverMetrics, "PingList", countListResponses)
+	EventuallyHistogramCount(t, serverMetrics, "PingList", 1)
+	ExpectMsgReceived(t, clientMetrics, "PingList", countListResponses)
+}
+
+func TestFailedAssertionsReportErrors(t *testing.T) {
+	metrics := grpcprom.NewServerMetrics()
+	require.Error(t, checkCounter(metrics, "handled_total", "Ping", map[string]string{"grpc_code": "OK"}, 1))
+	require.EqualError(t, checkCounter(metrics, "handled_total", "Ping", nil, 0),
+		"no grpc_server_handled_total or grpc_client_handled_total metric collected", "missing metrics must not pass for zero")
+	require.Error(t, checkCounter(metrics, "handeld_total", "Ping", nil, 0))
+	require.NoError(t, checkAbsent(metrics, "Ping"))
+	for _, method := range []string{"/Ping", "/svc/", "/svc/Ping/extra"} {
+		require.EqualError(t, checkCounter(metrics, "handled_total", method, nil, 0),
+			`malformed method "`+method+`": want "Method" or "/package.Service/Method"`)
+	}
+
+	RetryTimeout = 50 * time.Millisecond
+	defer func() { RetryTimeout = 2 * time.Second }()
+	begin := time.Now()
+	require.Error(t, eventually(func() error {
+		return checkHistogramCount(metrics, "Ping", 1)
+	}))
+	require.True(t, time.Since(begin) >= RetryTimeout, "must retry until the timeout")
+}
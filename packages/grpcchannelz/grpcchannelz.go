@@ -0,0 +1,521 @@
+// Package grpcchannelz exports the channelz data of grpc-go as Prometheus
+// metrics.
+//
+// grpc-go tracks the calls of every channel, subchannel and server, and the
+// streams, messages and keepalives of every socket in its channelz registry.
+// A Collector reads the registry through the channelz service at scrape
+// time, so the process must serve it:
+//
+//	import "google.golang.org/grpc/channelz/service"
+//
+//	service.RegisterChannelzServiceToServer(server)
+//	...
+//	conn, err := grpcchannelz.Dial(serverAddress, grpc.WithInsecure())
+//	prometheus.MustRegister(grpcchannelz.NewCollector(channelzpb.NewChannelzClient(conn)))
+//
+// Importing the service package turns channelz on. Only channels and servers
+// created afterwards are tracked.
+//
+// The channel of the collector is itself tracked by channelz. Dialed with
+// Dial, it is left out of the metrics, as are the sockets the server accepted
+// from it, so that scrapes don't count themselves. The calls of the scrapes
+// are still counted by the server call counters, which channelz doesn't break
+// down by connection.
+//
+// To keep the number of series bounded, the metrics are labeled by channel
+// target rather than by channel, subchannel or socket ID, and the values of
+// all the channels of a target are summed. Counters of a target therefore
+// decrease when one of its channels is closed, which Prometheus handles as a
+// counter reset.
+package grpcchannelz
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// scheme is the resolver scheme of the channels dialed with Dial, which
+// tells them apart from the channels of the process.
+const scheme = "grpcchannelz"
+
+func init() {
+	resolver.Register(builder{})
+}
+
+// Dial creates a client connection to the channelz service at address, for
+// NewCollector. The channel and its sockets are left out of the metrics,
+// unlike those of a connection created with grpc.Dial.
+func Dial(address string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	return grpc.Dial(scheme+":///"+address, opts...)
+}
+
+// builder resolves the targets of Dial to their endpoint, like the
+// passthrough resolver of gRPC.
+type builder struct{}
+
+func (builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOption) (resolver.Resolver, error) {
+	cc.NewAddress([]resolver.Address{{Addr: target.Endpoint}})
+	return nopResolver{}, nil
+}
+
+func (builder) Scheme() string { return scheme }
+
+type nopResolver struct{}
+
+func (nopResolver) ResolveNow(resolver.ResolveNowOption) {}
+
+func (nopResolver) Close() {}
+
+const (
+	defaultTimeout         = 5 * time.Second
+	defaultConcurrentReads = 16
+)
+
+// Sides of the sockets, the values of the side label.
+const (
+	clientSide = "client"
+	serverSide = "server"
+)
+
+// states are the connectivity states exported for every target, so that
+// states without channels are exported as zero.
+var states = []channelzpb.ChannelConnectivityState_State{
+	channelzpb.ChannelConnectivityState_UNKNOWN,
+	channelzpb.ChannelConnectivityState_IDLE,
+	channelzpb.ChannelConnectivityState_CONNECTING,
+	channelzpb.ChannelConnectivityState_READY,
+	channelzpb.ChannelConnectivityState_TRANSIENT_FAILURE,
+	channelzpb.ChannelConnectivityState_SHUTDOWN,
+}
+
+type options struct {
+	timeout         time.Duration
+	concurrentReads int
+	constLabels     prom.Labels
+}
+
+// An Option lets you configure a Collector using With* funcs.
+type Option func(*options)
+
+// WithTimeout bounds the time taken to read the channelz registry at each
+// scrape. Defaults to five seconds. Every socket is read with its own call,
+// so processes with many connections may need a longer timeout, or more
+// concurrent reads.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithConcurrentReads sets the number of sockets of a channel, subchannel or
+// server read at the same time at each scrape. Defaults to 16.
+func WithConcurrentReads(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.concurrentReads = n
+		}
+	}
+}
+
+// WithConstLabels adds constant labels to every metric.
+func WithConstLabels(labels prom.Labels) Option {
+	return func(o *options) { o.constLabels = labels }
+}
+
+// Collector is a prometheus.Collector exporting the channelz registry read
+// through a channelz service client.
+type Collector struct {
+	client channelzpb.ChannelzClient
+	opts   options
+
+	channels                                                                *prom.Desc
+	channelCallsStarted, channelCallsSucceeded, channelCallsFailed          *prom.Desc
+	subchannels                                                             *prom.Desc
+	subchannelCallsStarted, subchannelCallsSucceeded, subchannelCallsFailed *prom.Desc
+	servers                                                                 *prom.Desc
+	serverCallsStarted, serverCallsSucceeded, serverCallsFailed             *prom.Desc
+	sockets                                                                 *prom.Desc
+	streamsStarted, streamsSucceeded, streamsFailed                         *prom.Desc
+	messagesSent, messagesReceived, keepAlivesSent                          *prom.Desc
+}
+
+// NewCollector returns a Collector reading the channelz registry through
+// client.
+func NewCollector(client channelzpb.ChannelzClient, opts ...Option) *Collector {
+	o := options{timeout: defaultTimeout, concurrentReads: defaultConcurrentReads}
+	for _, f := range opts {
+		f(&o)
+	}
+	desc := func(name, help string, labels ...string) *prom.Desc {
+		return prom.NewDesc("grpc_channelz_"+name, help, labels, o.constLabels)
+	}
+	return &Collector{
+		client: client,
+		opts:   o,
+
+		channels:              desc("channels", "Number of channels to the target in the connectivity state.", "grpc_target", "state"),
+		channelCallsStarted:   desc("channel_calls_started_total", "Total number of calls started on the channels to the target.", "grpc_target"),
+		channelCallsSucceeded: desc("channel_calls_succeeded_total", "Total number of calls completed with OK on the channels to the target.", "grpc_target"),
+		channelCallsFailed:    desc("channel_calls_failed_total", "Total number of calls completed with a code other than OK on the channels to the target.", "grpc_target"),
+
+		subchannels:              desc("subchannels", "Number of subchannels of the channels to the target in the connectivity state.", "grpc_target", "state"),
+		subchannelCallsStarted:   desc("subchannel_calls_started_total", "Total number of calls started on the subchannels of the channels to the target.", "grpc_target"),
+		subchannelCallsSucceeded: desc("subchannel_calls_succeeded_total", "Total number of calls completed with OK on the subchannels of the channels to the target.", "grpc_target"),
+		subchannelCallsFailed:    desc("subchannel_calls_failed_total", "Total number of calls completed with a code other than OK on the subchannels of the channels to the target.", "grpc_target"),
+
+		servers:              desc("servers", "Number of servers."),
+		serverCallsStarted:   desc("server_calls_started_total", "Total number of calls started on the servers."),
+		serverCallsSucceeded: desc("server_calls_succeeded_total", "Total number of calls completed with OK on the servers."),
+		serverCallsFailed:    desc("server_calls_failed_total", "Total number of calls completed with a code other than OK on the servers."),
+
+		sockets:          desc("sockets", "Number of open sockets of the channels to the target, or of the servers.", "side", "grpc_target"),
+		streamsStarted:   desc("socket_streams_started_total", "Total number of streams started on the sockets.", "side", "grpc_target"),
+		streamsSucceeded: desc("socket_streams_succeeded_total", "Total number of streams ended successfully on the sockets.", "side", "grpc_target"),
+		streamsFailed:    desc("socket_streams_failed_total", "Total number of streams ended unsuccessfully on the sockets.", "side", "grpc_target"),
+		messagesSent:     desc("socket_messages_sent_total", "Total number of messages sent on the sockets.", "side", "grpc_target"),
+		messagesReceived: desc("socket_messages_received_total", "Total number of messages received on the sockets.", "side", "grpc_target"),
+		keepAlivesSent:   desc("socket_keepalives_sent_total", "Total number of keepalive pings sent on the sockets.", "side", "grpc_target"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	for _, d := range c.descs() {
+		ch <- d
+	}
+}
+
+func (c *Collector) descs() []*prom.Desc {
+	return []*prom.Desc{
+		c.channels, c.channelCallsStarted, c.channelCallsSucceeded, c.channelCallsFailed,
+		c.subchannels, c.subchannelCallsStarted, c.subchannelCallsSucceeded, c.subchannelCallsFailed,
+		c.servers, c.serverCallsStarted, c.serverCallsSucceeded, c.serverCallsFailed,
+		c.sockets, c.streamsStarted, c.streamsSucceeded, c.streamsFailed,
+		c.messagesSent, c.messagesReceived, c.keepAlivesSent,
+	}
+}
+
+// Collect implements prometheus.Collector. If the registry cannot be read,
+// the error is reported for every metric, failing the scrape, rather than
+// exporting partial sums.
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.timeout)
+	defer cancel()
+	r, err := c.read(ctx)
+	if err != nil {
+		err = fmt.Errorf("grpcchannelz: failed to read channelz registry: %v", err)
+		for _, d := range c.descs() {
+			ch <- prom.NewInvalidMetric(d, err)
+		}
+		return
+	}
+
+	counter := func(d *prom.Desc, v int64, lvs ...string) {
+		ch <- prom.MustNewConstMetric(d, prom.CounterValue, float64(v), lvs...)
+	}
+	gauge := func(d *prom.Desc, v int, lvs ...string) {
+		ch <- prom.MustNewConstMetric(d, prom.GaugeValue, float64(v), lvs...)
+	}
+	for target, t := range r.targets {
+		for _, s := range states {
+			gauge(c.channels, t.channels[s], target, s.String())
+			gauge(c.subchannels, t.subchannels[s], target, s.String())
+		}
+		counter(c.channelCallsStarted, t.channelCalls.started, target)
+		counter(c.channelCallsSucceeded, t.channelCalls.succeeded, target)
+		counter(c.channelCallsFailed, t.channelCalls.failed, target)
+		counter(c.subchannelCallsStarted, t.subchannelCalls.started, target)
+		counter(c.subchannelCallsSucceeded, t.subchannelCalls.succeeded, target)
+		counter(c.subchannelCallsFailed, t.subchannelCalls.failed, target)
+		c.collectSockets(ch, &t.sockets, clientSide, target)
+	}
+	gauge(c.servers, r.servers)
+	counter(c.serverCallsStarted, r.serverCalls.started)
+	counter(c.serverCallsSucceeded, r.serverCalls.succeeded)
+	counter(c.serverCallsFailed, r.serverCalls.failed)
+	c.collectSockets(ch, &r.serverSockets, serverSide, "")
+}
+
+func (c *Collector) collectSockets(ch chan<- prom.Metric, s *socketStats, side, target string) {
+	ch <- prom.MustNewConstMetric(c.sockets, prom.GaugeValue, float64(s.count), side, target)
+	for _, v := range []struct {
+		desc  *prom.Desc
+		value int64
+	}{
+		{c.streamsStarted, s.streamsStarted},
+		{c.streamsSucceeded, s.streamsSucceeded},
+		{c.streamsFailed, s.streamsFailed},
+		{c.messagesSent, s.messagesSent},
+		{c.messagesReceived, s.messagesReceived},
+		{c.keepAlivesSent, s.keepAlivesSent},
+	} {
+		ch <- prom.MustNewConstMetric(v.desc, prom.CounterValue, float64(v.value), side, target)
+	}
+}
+
+// reading is the channelz registry summed by target.
+type reading struct {
+	targets       map[string]*targetStats
+	servers       int
+	serverCalls   callStats
+	serverSockets socketStats
+
+	// own are the local addresses of the sockets of the collector's
+	// channels, the remote addresses of the server sockets to leave out.
+	own map[string]bool
+}
+
+// targetStats are the sums of the channels to a target, their subchannels
+// and the sockets of those.
+type targetStats struct {
+	channels, subchannels         map[channelzpb.ChannelConnectivityState_State]int
+	channelCalls, subchannelCalls callStats
+	sockets                       socketStats
+}
+
+type callStats struct {
+	started, succeeded, failed int64
+}
+
+func (s *callStats) add(started, succeeded, failed int64) {
+	s.started += started
+	s.succeeded += succeeded
+	s.failed += failed
+}
+
+type socketStats struct {
+	count                                           int
+	streamsStarted, streamsSucceeded, streamsFailed int64
+	messagesSent, messagesReceived, keepAlivesSent  int64
+}
+
+func (s *socketStats) add(d *channelzpb.SocketData) {
+	s.count++
+	s.streamsStarted += d.GetStreamsStarted()
+	s.streamsSucceeded += d.GetStreamsSucceeded()
+	s.streamsFailed += d.GetStreamsFailed()
+	s.messagesSent += d.GetMessagesSent()
+	s.messagesReceived += d.GetMessagesReceived()
+	s.keepAlivesSent += d.GetKeepAlivesSent()
+}
+
+// read walks the channelz registry, from the top channels down to their
+// sockets and from the servers down to theirs. Entities closed while walking
+// are skipped.
+func (c *Collector) read(ctx context.Context) (*reading, error) {
+	r := &reading{targets: map[string]*targetStats{}, own: map[string]bool{}}
+	for start := int64(0); ; {
+		resp, err := c.client.GetTopChannels(ctx, &channelzpb.GetTopChannelsRequest{StartChannelId: start})
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range resp.GetChannel() {
+			if err := c.readChannel(ctx, r, channel); err != nil {
+				return nil, err
+			}
+			start = channel.GetRef().GetChannelId() + 1
+		}
+		if resp.GetEnd() || len(resp.GetChannel()) == 0 {
+			break
+		}
+	}
+
+	for start := int64(0); ; {
+		resp, err := c.client.GetServers(ctx, &channelzpb.GetServersRequest{StartServerId: start})
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range resp.GetServer() {
+			d := server.GetData()
+			r.servers++
+			r.serverCalls.add(d.GetCallsStarted(), d.GetCallsSucceeded(), d.GetCallsFailed())
+			if err := c.readServerSockets(ctx, r, server.GetRef().GetServerId()); err != nil {
+				return nil, err
+			}
+			start = server.GetRef().GetServerId() + 1
+		}
+		if resp.GetEnd() || len(resp.GetServer()) == 0 {
+			break
+		}
+	}
+	return r, nil
+}
+
+// readChannel adds a channel and its descendants to the stats of its target.
+// Nested channels, such as those of balancers, count for their own target.
+// The channels dialed with Dial are left out, only the local addresses of
+// their sockets are kept.
+func (c *Collector) readChannel(ctx context.Context, r *reading, channel *channelzpb.Channel) error {
+	d := channel.GetData()
+	var (
+		t   *targetStats
+		add func(*channelzpb.Socket)
+	)
+	if strings.HasPrefix(d.GetTarget(), scheme+":") {
+		t = newTargetStats()
+		add = func(s *channelzpb.Socket) {
+			if a := addressOf(s.GetLocal()); a != "" {
+				r.own[a] = true
+			}
+		}
+	} else {
+		t = r.target(d.GetTarget())
+		add = func(s *channelzpb.Socket) { t.sockets.add(s.GetData()) }
+	}
+	t.channels[d.GetState().GetState()]++
+	t.channelCalls.add(d.GetCallsStarted(), d.GetCallsSucceeded(), d.GetCallsFailed())
+	if err := c.readSockets(ctx, channel.GetSocketRef(), add); err != nil {
+		return err
+	}
+	if err := c.readSubchannels(ctx, t, channel.GetSubchannelRef(), add); err != nil {
+		return err
+	}
+	for _, ref := range channel.GetChannelRef() {
+		resp, err := c.client.GetChannel(ctx, &channelzpb.GetChannelRequest{ChannelId: ref.GetChannelId()})
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return err
+		}
+		if err := c.readChannel(ctx, r, resp.GetChannel()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSubchannels adds subchannels, and theirs, to the stats of the target
+// of their channel, and passes their sockets to add.
+func (c *Collector) readSubchannels(ctx context.Context, t *targetStats, refs []*channelzpb.SubchannelRef, add func(*channelzpb.Socket)) error {
+	for _, ref := range refs {
+		resp, err := c.client.GetSubchannel(ctx, &channelzpb.GetSubchannelRequest{SubchannelId: ref.GetSubchannelId()})
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return err
+		}
+		subchannel := resp.GetSubchannel()
+		d := subchannel.GetData()
+		t.subchannels[d.GetState().GetState()]++
+		t.subchannelCalls.add(d.GetCallsStarted(), d.GetCallsSucceeded(), d.GetCallsFailed())
+		if err := c.readSockets(ctx, subchannel.GetSocketRef(), add); err != nil {
+			return err
+		}
+		if err := c.readSubchannels(ctx, t, subchannel.GetSubchannelRef(), add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSockets passes the sockets of refs to add, one at a time, reading up
+// to WithConcurrentReads of them at the same time. Sockets closed meanwhile
+// are skipped.
+func (c *Collector) readSockets(ctx context.Context, refs []*channelzpb.SocketRef, add func(*channelzpb.Socket)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	sem := make(chan struct{}, c.opts.concurrentReads)
+	for _, ref := range refs {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			resp, err := c.client.GetSocket(ctx, &channelzpb.GetSocketRequest{SocketId: id})
+			<-sem
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case status.Code(err) == codes.NotFound:
+			case err != nil:
+				if first == nil {
+					first = err
+					cancel()
+				}
+			default:
+				add(resp.GetSocket())
+			}
+		}(ref.GetSocketId())
+	}
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// readServerSockets adds the sockets of a server to r, but for those
+// accepted from the collector's channels. A server closed meanwhile is
+// skipped.
+func (c *Collector) readServerSockets(ctx context.Context, r *reading, serverID int64) error {
+	add := func(s *channelzpb.Socket) {
+		if !r.own[addressOf(s.GetRemote())] {
+			r.serverSockets.add(s.GetData())
+		}
+	}
+	for start := int64(0); ; {
+		resp, err := c.client.GetServerSockets(ctx, &channelzpb.GetServerSocketsRequest{ServerId: serverID, StartSocketId: start})
+		if err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+		if err := c.readSockets(ctx, resp.GetSocketRef(), add); err != nil {
+			return err
+		}
+		refs := resp.GetSocketRef()
+		if resp.GetEnd() || len(refs) == 0 {
+			return nil
+		}
+		start = refs[len(refs)-1].GetSocketId() + 1
+	}
+}
+
+func (r *reading) target(target string) *targetStats {
+	t, ok := r.targets[target]
+	if !ok {
+		t = newTargetStats()
+		r.targets[target] = t
+	}
+	return t
+}
+
+func newTargetStats() *targetStats {
+	return &targetStats{
+		channels:    map[channelzpb.ChannelConnectivityState_State]int{},
+		subchannels: map[channelzpb.ChannelConnectivityState_State]int{},
+	}
+}
+
+// addressOf returns a socket address as a string, or "" for the addresses
+// channelz doesn't report, such as those of unnamed unix sockets.
+func addressOf(a *channelzpb.Address) string {
+	switch {
+	case a.GetTcpipAddress() != nil:
+		ip := a.GetTcpipAddress()
+		return net.JoinHostPort(net.IP(ip.GetIpAddress()).String(), strconv.Itoa(int(ip.GetPort())))
+	case a.GetUdsAddress().GetFilename() != "":
+		return "unix:" + a.GetUdsAddress().GetFilename()
+	}
+	return ""
+}
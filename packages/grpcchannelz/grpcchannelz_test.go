@@ -0,0 +1,188 @@
+package grpcchannelz
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newServer starts a server of the channelz service on a loopback listener,
+// so that channelz reports the addresses of its sockets, and returns its
+// address.
+func newServer(t *testing.T) string {
+	server := grpc.NewServer()
+	service.RegisterChannelzServiceToServer(server)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// dial connects to address with dialer, grpc.Dial or Dial.
+func dial(t *testing.T, dialer func(string, ...grpc.DialOption) (*grpc.ClientConn, error), address string) *grpc.ClientConn {
+	conn, err := dialer(address, grpc.WithInsecure(), grpc.WithBlock())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestCollector(t *testing.T) {
+	address := newServer(t)
+	traffic := channelzpb.NewChannelzClient(dial(t, grpc.Dial, address))
+	for i := 0; i < 3; i++ {
+		_, err := traffic.GetServers(context.Background(), &channelzpb.GetServersRequest{})
+		require.NoError(t, err)
+	}
+	_, err := traffic.GetChannel(context.Background(), &channelzpb.GetChannelRequest{ChannelId: -1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(NewCollector(channelzpb.NewChannelzClient(dial(t, Dial, address)), WithConstLabels(prometheus.Labels{"env": "test"}))))
+	metrics := gather(t, reg)
+
+	trafficLabels := map[string]string{"grpc_target": address, "env": "test"}
+	require.EqualValues(t, 4, value(t, metrics, "grpc_channelz_channel_calls_started_total", trafficLabels))
+	require.EqualValues(t, 3, value(t, metrics, "grpc_channelz_channel_calls_succeeded_total", trafficLabels))
+	require.EqualValues(t, 1, value(t, metrics, "grpc_channelz_channel_calls_failed_total", trafficLabels))
+	require.EqualValues(t, 4, value(t, metrics, "grpc_channelz_subchannel_calls_started_total", trafficLabels))
+	require.EqualValues(t, 1, value(t, metrics, "grpc_channelz_channels", map[string]string{"grpc_target": address, "state": "READY"}))
+	require.EqualValues(t, 0, value(t, metrics, "grpc_channelz_channels", map[string]string{"grpc_target": address, "state": "SHUTDOWN"}),
+		"states without channels must be exported as zero")
+	require.EqualValues(t, 1, value(t, metrics, "grpc_channelz_subchannels", map[string]string{"grpc_target": address, "state": "READY"}))
+
+	clientSockets := map[string]string{"side": "client", "grpc_target": address}
+	require.EqualValues(t, 1, value(t, metrics, "grpc_channelz_sockets", clientSockets))
+	require.EqualValues(t, 4, value(t, metrics, "grpc_channelz_socket_streams_started_total", clientSockets))
+	require.EqualValues(t, 4, value(t, metrics, "grpc_channelz_socket_messages_sent_total", clientSockets))
+	require.EqualValues(t, 3, value(t, metrics, "grpc_channelz_socket_messages_received_total", clientSockets))
+
+	require.GreaterOrEqual(t, value(t, metrics, "grpc_channelz_servers", nil), 1.0)
+	require.GreaterOrEqual(t, value(t, metrics, "grpc_channelz_server_calls_started_total", nil), 4.0,
+		"the calls of the scrape itself may be counted too")
+	require.Len(t, metrics["grpc_channelz_channels"], len(states), "the channel of the collector must be left out")
+
+	serverSockets := map[string]string{"side": "server"}
+	require.EqualValues(t, 1, value(t, metrics, "grpc_channelz_sockets", serverSockets),
+		"the socket accepted from the collector must be left out")
+	require.EqualValues(t, 4, value(t, metrics, "grpc_channelz_socket_streams_started_total", serverSockets))
+}
+
+func TestCollectorReportsErrors(t *testing.T) {
+	conn := dial(t, Dial, newServer(t))
+	conn.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(NewCollector(channelzpb.NewChannelzClient(conn), WithTimeout(time.Second))))
+	_, err := reg.Gather()
+	require.Error(t, err, "the scrape must fail if the registry cannot be read")
+}
+
+// fakeClient serves a registry of one server with the given sockets, reading
+// which takes a millisecond, and tracks how many are read at the same time.
+type fakeClient struct {
+	channelzpb.ChannelzClient
+	sockets      int
+	serverClosed bool
+
+	mu                 sync.Mutex
+	inFlight, maxReads int
+}
+
+func (f *fakeClient) GetTopChannels(context.Context, *channelzpb.GetTopChannelsRequest, ...grpc.CallOption) (*channelzpb.GetTopChannelsResponse, error) {
+	return &channelzpb.GetTopChannelsResponse{End: true}, nil
+}
+
+func (f *fakeClient) GetServers(context.Context, *channelzpb.GetServersRequest, ...grpc.CallOption) (*channelzpb.GetServersResponse, error) {
+	return &channelzpb.GetServersResponse{Server: []*channelzpb.Server{{Ref: &channelzpb.ServerRef{ServerId: 1}}}, End: true}, nil
+}
+
+func (f *fakeClient) GetServerSockets(context.Context, *channelzpb.GetServerSocketsRequest, ...grpc.CallOption) (*channelzpb.GetServerSocketsResponse, error) {
+	if f.serverClosed {
+		return nil, status.Error(codes.NotFound, "server closed")
+	}
+	resp := &channelzpb.GetServerSocketsResponse{End: true}
+	for i := 0; i < f.sockets; i++ {
+		resp.SocketRef = append(resp.SocketRef, &channelzpb.SocketRef{SocketId: int64(i + 2)})
+	}
+	return resp, nil
+}
+
+func (f *fakeClient) GetSocket(context.Context, *channelzpb.GetSocketRequest, ...grpc.CallOption) (*channelzpb.GetSocketResponse, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxReads {
+		f.maxReads = f.inFlight
+	}
+	f.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+	return &channelzpb.GetSocketResponse{Socket: &channelzpb.Socket{Data: &channelzpb.SocketData{StreamsStarted: 1}}}, nil
+}
+
+func TestCollectorReadsSocketsConcurrently(t *testing.T) {
+	client := &fakeClient{sockets: 50}
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(NewCollector(client, WithConcurrentReads(4))))
+	metrics := gather(t, reg)
+
+	serverSockets := map[string]string{"side": "server"}
+	require.EqualValues(t, 50, value(t, metrics, "grpc_channelz_sockets", serverSockets))
+	require.EqualValues(t, 50, value(t, metrics, "grpc_channelz_socket_streams_started_total", serverSockets))
+	require.Greater(t, client.maxReads, 1, "sockets must be read concurrently")
+	require.LessOrEqual(t, client.maxReads, 4, "concurrent reads must be bounded")
+}
+
+func TestCollectorSkipsClosedServers(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(NewCollector(&fakeClient{serverClosed: true})))
+	metrics := gather(t, reg)
+	require.EqualValues(t, 0, value(t, metrics, "grpc_channelz_sockets", map[string]string{"side": "server"}))
+}
+
+func gather(t *testing.T, reg prometheus.Gatherer) map[string][]*dto.Metric {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	metrics := map[string][]*dto.Metric{}
+	for _, mf := range mfs {
+		metrics[mf.GetName()] = mf.GetMetric()
+	}
+	return metrics
+}
+
+// value returns the value of the only series of the named metric with the
+// given label values.
+func value(t *testing.T, metrics map[string][]*dto.Metric, name string, labels map[string]string) float64 {
+	var found []float64
+	for _, m := range metrics[name] {
+		matches := 0
+		for _, l := range m.GetLabel() {
+			if v, ok := labels[l.GetName()]; ok && v == l.GetValue() {
+				matches++
+			}
+		}
+		if matches != len(labels) {
+			continue
+		}
+		if m.GetCounter() != nil {
+			found = append(found, m.GetCounter().GetValue())
+		} else {
+			found = append(found, m.GetGauge().GetValue())
+		}
+	}
+	require.Len(t, found, 1, "%s%v must be exported once", name, labels)
+	return found[0]
+}
@@ -0,0 +1,201 @@
+// Package grpcotel records the metrics of the gRPC interceptors into
+// OpenTelemetry instruments.
+//
+// It is a separate module so that only its users depend on OpenTelemetry.
+// The ServerMetrics and ClientMetrics it returns are those of grpcprom, with
+// a Reporter recording into instruments obtained from a MeterProvider instead
+// of Prometheus vectors.
+package grpcotel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/codes"
+)
+
+// instrumentationName is the instrumentation scope used for meters obtained
+// from a MeterProvider.
+const instrumentationName = "github.com/grpc-ecosystem/go-grpc-prometheus"
+
+// allCodes are the codes initialized by InitializeMethod.
+var allCodes = grpcprom.Codes()
+
+// NewServerMetrics returns a grpcprom.ServerMetrics object that records into
+// instruments obtained from the given MeterProvider instead of Prometheus
+// vectors. The instruments carry the same names (without the _total suffix,
+// which Prometheus exporters append for counters) and the same grpc_type,
+// grpc_service, grpc_method and grpc_code attributes as the Prometheus
+// metrics, as well as grpc_server, grpc_target and grpc_backend if enabled by
+// opts. The returned ServerMetrics does not export anything through Describe
+// and Collect.
+func NewServerMetrics(mp metric.MeterProvider, opts ...grpcprom.Option) (*grpcprom.ServerMetrics, error) {
+	r, err := newReporter(mp.Meter(instrumentationName), "grpc_server", [4]string{
+		"Total number of RPCs started on the server.",
+		"Total number of RPCs completed on the server, regardless of success or failure.",
+		"Total number of RPC stream messages received on the server.",
+		"Total number of gRPC stream messages sent by the server.",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return grpcprom.NewServerMetricsWithReporter(r, opts...), nil
+}
+
+// NewClientMetrics returns a grpcprom.ClientMetrics object that records into
+// instruments obtained from the given MeterProvider instead of Prometheus
+// vectors. See NewServerMetrics for the naming of instruments.
+func NewClientMetrics(mp metric.MeterProvider, opts ...grpcprom.Option) (*grpcprom.ClientMetrics, error) {
+	r, err := newReporter(mp.Meter(instrumentationName), "grpc_client", [4]string{
+		"Total number of RPCs started on the client.",
+		"Total number of RPCs completed by the client, regardless of success or failure.",
+		"Total number of RPC stream messages received by the client.",
+		"Total number of gRPC stream messages sent by the client.",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return grpcprom.NewClientMetricsWithReporter(r, opts...), nil
+}
+
+// reporter is the grpcprom.HistogramReporter recording into OpenTelemetry
+// instruments. The histograms are nil until enabled on the owning
+// ServerMetrics or ClientMetrics, and are guarded by mu as they may be enabled
+// and disabled while RPCs are reported.
+type reporter struct {
+	meter       metric.Meter
+	started     metric.Int64Counter
+	handled     metric.Int64Counter
+	msgReceived metric.Int64Counter
+	msgSent     metric.Int64Counter
+
+	mu         sync.RWMutex
+	histograms [3]metric.Float64Histogram // by grpcprom.Histogram
+}
+
+// newReporter creates the counters of a reporter, named after the given
+// prefix and described by help in the order started, handled, received and
+// sent.
+func newReporter(meter metric.Meter, prefix string, help [4]string) (*reporter, error) {
+	r := &reporter{meter: meter}
+	var err error
+	if r.started, err = meter.Int64Counter(prefix+"_started", metric.WithDescription(help[0])); err != nil {
+		return nil, err
+	}
+	if r.handled, err = meter.Int64Counter(prefix+"_handled", metric.WithDescription(help[1])); err != nil {
+		return nil, err
+	}
+	if r.msgReceived, err = meter.Int64Counter(prefix+"_msg_received", metric.WithDescription(help[2])); err != nil {
+		return nil, err
+	}
+	if r.msgSent, err = meter.Int64Counter(prefix+"_msg_sent", metric.WithDescription(help[3])); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reporter) StartedRPC(rpc grpcprom.RPC) {
+	r.started.Add(context.Background(), 1, methodAttrs(rpc))
+}
+
+func (r *reporter) ReceivedMessage(rpc grpcprom.RPC) {
+	r.msgReceived.Add(context.Background(), 1, methodAttrs(rpc))
+}
+
+func (r *reporter) SentMessage(rpc grpcprom.RPC) {
+	r.msgSent.Add(context.Background(), 1, methodAttrs(rpc))
+}
+
+func (r *reporter) Handled(rpc grpcprom.RPC, code codes.Code, duration time.Duration) {
+	r.handled.Add(context.Background(), 1, codeAttrs(rpc, code))
+	if h := r.histogram(grpcprom.HandlingTimeHistogram); h != nil {
+		h.Record(context.Background(), duration.Seconds(), methodAttrs(rpc))
+	}
+}
+
+// InitializeMethod records zero values for all counters of a method, so that
+// they are reported before the first RPC.
+func (r *reporter) InitializeMethod(rpc grpcprom.RPC) {
+	ctx := context.Background()
+	attrs := methodAttrs(rpc)
+	r.started.Add(ctx, 0, attrs)
+	r.msgReceived.Add(ctx, 0, attrs)
+	r.msgSent.Add(ctx, 0, attrs)
+	for _, code := range allCodes {
+		r.handled.Add(ctx, 0, codeAttrs(rpc, code))
+	}
+}
+
+// SetHistogram creates a histogram mirroring the given Prometheus histogram
+// options, or removes it if opts is nil. OpenTelemetry SDKs return the
+// instrument created first for a name, so changed buckets may not take
+// effect. Errors are passed to the global OpenTelemetry error handler, as
+// the returned instrument is usable regardless.
+func (r *reporter) SetHistogram(h grpcprom.Histogram, opts *prom.HistogramOpts) {
+	var hist metric.Float64Histogram
+	if opts != nil {
+		var err error
+		hist, err = r.meter.Float64Histogram(opts.Name,
+			metric.WithDescription(opts.Help),
+			metric.WithUnit("s"),
+			metric.WithExplicitBucketBoundaries(opts.Buckets...))
+		if err != nil {
+			otel.Handle(err)
+		}
+	}
+	r.mu.Lock()
+	r.histograms[h] = hist
+	r.mu.Unlock()
+}
+
+func (r *reporter) MessageObserver(h grpcprom.Histogram, rpc grpcprom.RPC) prom.Observer {
+	hist := r.histogram(h)
+	if hist == nil {
+		return nil
+	}
+	attrs := methodAttrs(rpc)
+	return prom.ObserverFunc(func(seconds float64) {
+		hist.Record(context.Background(), seconds, attrs)
+	})
+}
+
+func (r *reporter) histogram(h grpcprom.Histogram) metric.Float64Histogram {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.histograms[h]
+}
+
+func methodAttrs(rpc grpcprom.RPC) metric.MeasurementOption {
+	return metric.WithAttributes(attrs(rpc)...)
+}
+
+func codeAttrs(rpc grpcprom.RPC, code codes.Code) metric.MeasurementOption {
+	return metric.WithAttributes(append(attrs(rpc), attribute.String("grpc_code", code.String()))...)
+}
+
+// attrs returns the attributes identifying the method of rpc. The
+// grpc_server, grpc_target and grpc_backend attributes are omitted while
+// empty.
+func attrs(rpc grpcprom.RPC) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, 6)
+	if rpc.Server != "" {
+		attrs = append(attrs, attribute.String("grpc_server", rpc.Server))
+	}
+	if rpc.Target != "" {
+		attrs = append(attrs, attribute.String("grpc_target", rpc.Target))
+	}
+	if rpc.Backend != "" {
+		attrs = append(attrs, attribute.String("grpc_backend", rpc.Backend))
+	}
+	return append(attrs,
+		attribute.String("grpc_type", string(rpc.Type)),
+		attribute.String("grpc_service", rpc.Service),
+		attribute.String("grpc_method", rpc.Method),
+	)
+}
@@ -0,0 +1,189 @@
+package grpcotel
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const countListResponses = 20
+
+type testService struct{}
+
+func (testService) PingEmpty(context.Context, *pb_testproto.Empty) (*pb_testproto.PingResponse, error) {
+	return &pb_testproto.PingResponse{}, nil
+}
+
+func (testService) Ping(_ context.Context, ping *pb_testproto.PingRequest) (*pb_testproto.PingResponse, error) {
+	return &pb_testproto.PingResponse{Value: ping.Value}, nil
+}
+
+func (testService) PingError(_ context.Context, ping *pb_testproto.PingRequest) (*pb_testproto.Empty, error) {
+	return nil, status.Errorf(codes.Code(ping.ErrorCodeReturned), "Userspace error.")
+}
+
+func (testService) PingList(ping *pb_testproto.PingRequest, stream pb_testproto.TestService_PingListServer) error {
+	for i := 0; i < countListResponses; i++ {
+		stream.Send(&pb_testproto.PingResponse{Value: ping.Value, Counter: int32(i)})
+	}
+	return nil
+}
+
+func TestMeterProviderMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	serverMetrics, err := NewServerMetrics(mp)
+	require.NoError(t, err)
+	serverMetrics.EnableHandlingTimeHistogram()
+	clientMetrics, err := NewClientMetrics(mp, grpcprom.WithClientBackendLabel(5))
+	require.NoError(t, err)
+	clientMetrics.EnableClientHandlingTimeHistogram()
+	clientMetrics.EnableClientStreamReceiveTimeHistogram()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port for serverListener")
+	server := grpc.NewServer(
+		grpc.StreamInterceptor(serverMetrics.StreamServerInterceptor()),
+		grpc.UnaryInterceptor(serverMetrics.UnaryServerInterceptor()),
+	)
+	pb_testproto.RegisterTestServiceServer(server, testService{})
+	serverMetrics.InitializeMetrics(server)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(clientMetrics.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(clientMetrics.StreamClientInterceptor()),
+	)
+	require.NoError(t, err, "must not error on client Dial")
+	defer conn.Close()
+	client := pb_testproto.NewTestServiceClient(conn)
+
+	_, err = client.PingEmpty(ctx, &pb_testproto.Empty{})
+	require.NoError(t, err)
+	_, err = client.PingError(ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)})
+	require.Error(t, err)
+	ss, err := client.PingList(ctx, &pb_testproto.PingRequest{})
+	require.NoError(t, err)
+	for {
+		_, err := ss.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err, "reading pingList shouldn't fail")
+	}
+
+	rm := collectOtel(t, reader)
+	require.EqualValues(t, 0, otelSum(rm, "grpc_server_started", "unary", "Ping"), "InitializeMetrics must pre-populate methods")
+	require.EqualValues(t, 1, otelSum(rm, "grpc_server_started", "unary", "PingEmpty"))
+	require.EqualValues(t, 1, otelSum(rm, "grpc_server_handled", "unary", "PingEmpty", "OK"))
+	require.EqualValues(t, 1, otelSum(rm, "grpc_server_handled", "unary", "PingError", "FailedPrecondition"))
+	require.EqualValues(t, 1, otelSum(rm, "grpc_server_started", "server_stream", "PingList"))
+	require.EqualValues(t, countListResponses, otelSum(rm, "grpc_server_msg_sent", "server_stream", "PingList"))
+	require.EqualValues(t, 1, otelHistCount(rm, "grpc_server_handling_seconds", "unary", "PingEmpty"))
+
+	require.EqualValues(t, 1, otelSum(rm, "grpc_client_started", "unary", "PingEmpty"))
+	require.EqualValues(t, 1, otelSum(rm, "grpc_client_handled", "unary", "PingError", "FailedPrecondition"))
+	require.EqualValues(t, countListResponses, otelSum(rm, "grpc_client_msg_received", "server_stream", "PingList"))
+	require.EqualValues(t, 1, otelSum(rm, "grpc_client_handled", "server_stream", "PingList", "OK"))
+	require.EqualValues(t, 1, otelHistCount(rm, "grpc_client_handling_seconds", "server_stream", "PingList"))
+	require.EqualValues(t, countListResponses+1, otelHistCount(rm, "grpc_client_msg_recv_handling_seconds", "server_stream", "PingList"), "the end of the stream is a receive too")
+	require.Equal(t, []string{lis.Addr().String()}, otelValues(rm, "grpc_client_handled", "grpc_backend"), "backends must be mapped to an attribute")
+	require.Empty(t, otelValues(rm, "grpc_client_started", "grpc_backend"), "only completed RPCs are labeled by backend")
+}
+
+// otelValues returns the distinct values of the attribute key of the data
+// points of the counter name.
+func otelValues(rm metricdata.ResourceMetrics, name string, key attribute.Key) []string {
+	var values []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				if v, ok := dp.Attributes.Value(key); ok && !slices.Contains(values, v.AsString()) {
+					values = append(values, v.AsString())
+				}
+			}
+		}
+	}
+	return values
+}
+
+func collectOtel(t *testing.T, reader *sdkmetric.ManualReader) metricdata.ResourceMetrics {
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	return rm
+}
+
+// otelMatches reports whether attrs carry the given grpc_type, grpc_method
+// and, optionally, grpc_code values.
+func otelMatches(attrs attribute.Set, rpcType, method string, code ...string) bool {
+	if v, _ := attrs.Value("grpc_type"); v.AsString() != rpcType {
+		return false
+	}
+	if v, _ := attrs.Value("grpc_method"); v.AsString() != method {
+		return false
+	}
+	if len(code) > 0 {
+		if v, _ := attrs.Value("grpc_code"); v.AsString() != code[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// otelSum returns the value of the matching counter data point, or -1 if
+// there is none.
+func otelSum(rm metricdata.ResourceMetrics, name, rpcType, method string, code ...string) int64 {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				if otelMatches(dp.Attributes, rpcType, method, code...) {
+					return dp.Value
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// otelHistCount returns the count of the matching histogram data point, or
+// zero if there is none.
+func otelHistCount(rm metricdata.ResourceMetrics, name, rpcType, method string) uint64 {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+				if otelMatches(dp.Attributes, rpcType, method) {
+					return dp.Count
+				}
+			}
+		}
+	}
+	return 0
+}
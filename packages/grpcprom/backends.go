@@ -0,0 +1,130 @@
+package grpcprom
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/stats"
+)
+
+// otherBackend is the grpc_backend label of the RPCs of backends beyond the
+// cap of WithClientBackendLabel.
+const otherBackend = "other"
+
+// backendLabels assigns the grpc_backend label of client-side RPCs, up to a
+// cap of distinct backends, and evicts the series of a backend once no
+// connection to it remains.
+type backendLabels struct {
+	// max is the cap of distinct backends, zero if disabled.
+	max int
+	// evict deletes the series of the method of an RPC of a backend.
+	evict func(RPC)
+
+	mu sync.Mutex
+	// labeled are the backends labeled so far, with the methods of their
+	// series.
+	labeled map[string]map[RPC]struct{}
+	// conns are the number of open connections to every backend, once seen
+	// by the stats handler.
+	conns map[string]int
+}
+
+func newBackendLabels(max int, evict func(RPC)) *backendLabels {
+	return &backendLabels{
+		max:     max,
+		evict:   evict,
+		labeled: make(map[string]map[RPC]struct{}),
+		conns:   make(map[string]int),
+	}
+}
+
+func (b *backendLabels) enabled() bool {
+	return b.max > 0
+}
+
+// label assigns the grpc_backend label of an RPC handled by addr and passes
+// rpc so labeled to record. The series of a labeled backend is tracked for
+// eviction and recorded into in the same critical section, so that connEnd
+// cannot evict it in between and leave it behind.
+func (b *backendLabels) label(rpc RPC, addr string, record func(RPC)) {
+	if addr == "" {
+		record(rpc)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	methods, ok := b.labeled[addr]
+	if !ok {
+		if len(b.labeled) >= b.max {
+			rpc.Backend = otherBackend
+			record(rpc)
+			return
+		}
+		methods = make(map[RPC]struct{})
+		b.labeled[addr] = methods
+	}
+	rpc.Backend = addr
+	methods[rpc] = struct{}{}
+	record(rpc)
+}
+
+func (b *backendLabels) connBegin(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns[addr]++
+}
+
+// connEnd evicts the series of addr once its last connection ended, e.g.
+// because it was removed from the resolver.
+func (b *backendLabels) connEnd(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conns[addr]--; b.conns[addr] > 0 {
+		return
+	}
+	delete(b.conns, addr)
+	for rpc := range b.labeled[addr] {
+		b.evict(rpc)
+	}
+	delete(b.labeled, addr)
+}
+
+// Reset forgets the backends labeled so far, whose series were deleted.
+func (b *backendLabels) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.labeled = make(map[string]map[RPC]struct{})
+}
+
+// backendStatsHandler is the stats.Handler of ClientMetrics.BackendStatsHandler.
+type backendStatsHandler struct {
+	backends *backendLabels
+}
+
+type backendAddrKey struct{}
+
+func (h backendStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h backendStatsHandler) HandleRPC(context.Context, stats.RPCStats) {}
+
+func (h backendStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	if info.RemoteAddr == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, backendAddrKey{}, info.RemoteAddr.String())
+}
+
+func (h backendStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	addr, ok := ctx.Value(backendAddrKey{}).(string)
+	if !ok {
+		return
+	}
+	switch s.(type) {
+	case *stats.ConnBegin:
+		h.backends.connBegin(addr)
+	case *stats.ConnEnd:
+		h.backends.connEnd(addr)
+	}
+}
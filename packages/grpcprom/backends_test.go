@@ -0,0 +1,141 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+func TestClientMetricsBackendLabel(t *testing.T) {
+	var backends []resolver.Address
+	for i := 0; i < 3; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		server := grpc.NewServer()
+		pb_testproto.RegisterTestServiceServer(server, &testService{t: t})
+		go server.Serve(lis)
+		defer server.Stop()
+		backends = append(backends, resolver.Address{Addr: lis.Addr().String()})
+	}
+
+	m := NewClientMetricsWithOptions(WithClientBackendLabel(2))
+	m.EnableClientHandlingTimeHistogram()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	r, cleanup := manual.GenerateAndRegisterManualResolver()
+	defer cleanup()
+	r.InitialAddrs(backends)
+	conn, err := grpc.Dial(r.Scheme()+":///test", grpc.WithInsecure(), grpc.WithBalancerName(roundrobin.Name),
+		grpc.WithUnaryInterceptor(m.UnaryClientInterceptor()), grpc.WithStatsHandler(m.BackendStatsHandler()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb_testproto.NewTestServiceClient(conn)
+
+	handled := func() map[string]float64 {
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		counts := map[string]float64{}
+		for _, mf := range mfs {
+			if mf.GetName() == "grpc_client_handled_total" {
+				for _, metric := range mf.GetMetric() {
+					counts[labelValueOf(metric, "grpc_backend")] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return counts
+	}
+	// Round robin only spreads RPCs once connected to all backends.
+	require.Eventually(t, func() bool {
+		_, err := client.PingEmpty(context.Background(), &pb_testproto.Empty{})
+		require.NoError(t, err)
+		return len(handled()) == 3
+	}, 5*time.Second, time.Millisecond, "RPCs must be labeled by backend, up to the cap")
+	counts := handled()
+	require.Contains(t, counts, otherBackend, "backends beyond the cap must be labeled other")
+	var labeled []string
+	for backend := range counts {
+		if backend != otherBackend {
+			labeled = append(labeled, backend)
+		}
+	}
+	require.Len(t, labeled, 2)
+	require.Len(t, gatherMetrics(t, reg, "grpc_client_handling_seconds"), 3, "histograms must be labeled by backend too")
+	var total float64
+	for _, count := range counts {
+		total += count
+	}
+	require.EqualValues(t, total, m.Snapshot().Methods[0].Total.HandledCount(), "snapshots must add up the backends")
+
+	var kept []resolver.Address
+	for _, b := range backends {
+		if b.Addr != labeled[0] {
+			kept = append(kept, b)
+		}
+	}
+	r.NewAddress(kept)
+	require.Eventually(t, func() bool {
+		_, ok := handled()[labeled[0]]
+		return !ok
+	}, 5*time.Second, time.Millisecond, "series of backends removed from the resolver must be deleted")
+	require.Len(t, gatherMetrics(t, reg, "grpc_client_handling_seconds"), 2)
+}
+
+func TestClientMetricsWithoutBackendLabel(t *testing.T) {
+	m := NewClientMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return nil
+	}
+	require.NoError(t, m.UnaryClientInterceptor()(context.Background(), "/mwitkow.testproto.TestService/PingEmpty", nil, nil, nil, invoker))
+
+	handled := gatherMetric(t, reg, "grpc_client_handled_total")
+	require.NotNil(t, handled)
+	for _, l := range handled.GetLabel() {
+		require.NotEqual(t, "grpc_backend", l.GetName(), "the grpc_backend label must only be added if enabled")
+	}
+}
+
+func TestBackendLabelsEvictRecordedSeries(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		series = map[RPC]int{}
+	)
+	b := newBackendLabels(10, func(rpc RPC) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(series, rpc)
+	})
+	const addr = "127.0.0.1:1234"
+	rpc := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "PingEmpty"}
+	b.connBegin(addr)
+
+	// The last connection to the backend ends while the RPC is recorded.
+	ended := make(chan struct{})
+	b.label(rpc, addr, func(rpc RPC) {
+		go func() {
+			b.connEnd(addr)
+			close(ended)
+		}()
+		select {
+		case <-ended:
+		case <-time.After(10 * time.Millisecond):
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		series[rpc]++
+	})
+	<-ended
+	require.Empty(t, series, "series recorded while their backend is evicted must not be left behind")
+}
@@ -0,0 +1,183 @@
+package grpcprom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// The benchmarks call the interceptors directly with the handlers of the
+// testproto service, so that they measure the cost of monitoring rather than
+// of the transport. Each one compares the handles resolved per method by the
+// Prometheus reporters with looking up every metric by its label values, and
+// the server ones with sampling the handling time histogram.
+
+func BenchmarkServerUnary(b *testing.B) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/mwitkow.testproto.TestService/Ping"}
+	svc := &testService{}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return svc.Ping(ctx, req.(*pb_testproto.PingRequest))
+	}
+	req := &pb_testproto.PingRequest{Value: pingDefaultValue}
+	benchmarkServer(b, func(m *ServerMetrics) func() {
+		interceptor := m.UnaryServerInterceptor()
+		return func() {
+			interceptor(context.Background(), req, info, handler)
+		}
+	})
+}
+
+func BenchmarkServerStream(b *testing.B) {
+	info := &grpc.StreamServerInfo{FullMethod: "/mwitkow.testproto.TestService/PingList", IsServerStream: true}
+	svc := &testService{}
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		req := &pb_testproto.PingRequest{}
+		if err := stream.RecvMsg(req); err != nil {
+			return err
+		}
+		return svc.PingList(req, &pingListServer{stream})
+	}
+	stream := &benchServerStream{ctx: context.Background()}
+	benchmarkServer(b, func(m *ServerMetrics) func() {
+		interceptor := m.StreamServerInterceptor()
+		return func() {
+			interceptor(svc, stream, info, handler)
+		}
+	})
+}
+
+func BenchmarkClientUnary(b *testing.B) {
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return nil
+	}
+	req, reply := &pb_testproto.PingRequest{Value: pingDefaultValue}, &pb_testproto.PingResponse{}
+	for _, bc := range []struct {
+		name     string
+		reporter func(*ClientMetrics) Reporter
+	}{
+		{"handles", func(m *ClientMetrics) Reporter { return m.reporter }},
+		{"labels", func(m *ClientMetrics) Reporter { return &labelClientReporter{metrics: m} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			m := NewClientMetrics()
+			m.EnableClientHandlingTimeHistogram()
+			m.reporter = bc.reporter(m)
+			interceptor := m.UnaryClientInterceptor()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					interceptor(context.Background(), "/mwitkow.testproto.TestService/Ping", req, reply, nil, invoker)
+				}
+			})
+		})
+	}
+}
+
+// benchmarkServer runs the RPC returned by rpc for server metrics with the
+// handling time histogram enabled and the testproto service initialized.
+func benchmarkServer(b *testing.B, rpc func(*ServerMetrics) func()) {
+	for _, bc := range []struct {
+		name     string
+		reporter func(*ServerMetrics) Reporter
+	}{
+		{"handles", func(m *ServerMetrics) Reporter { return m.reporter }},
+		{"labels", func(m *ServerMetrics) Reporter { return &labelServerReporter{metrics: m} }},
+		{"sampled", func(m *ServerMetrics) Reporter {
+			m.SampleHandlingTimeHistogram("/*/*", 100)
+			return m.reporter
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			m := NewServerMetrics()
+			m.EnableHandlingTimeHistogram()
+			server := grpc.NewServer()
+			pb_testproto.RegisterTestServiceServer(server, &testService{})
+			m.InitializeMetrics(server)
+			m.reporter = bc.reporter(m)
+			call := rpc(m)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					call()
+				}
+			})
+		})
+	}
+}
+
+// labelServerReporter records like promServerReporter, but looks up every
+// metric by its label values on every event.
+type labelServerReporter struct {
+	metrics *ServerMetrics
+}
+
+func (r *labelServerReporter) StartedRPC(rpc RPC) {
+	r.metrics.serverStartedCounter.WithLabelValues(rpc.Server, string(rpc.Type), rpc.Service, rpc.Method).Inc()
+}
+
+func (r *labelServerReporter) ReceivedMessage(rpc RPC) {
+	r.metrics.serverStreamMsgReceived.WithLabelValues(rpc.Server, string(rpc.Type), rpc.Service, rpc.Method).Inc()
+}
+
+func (r *labelServerReporter) SentMessage(rpc RPC) {
+	r.metrics.serverStreamMsgSent.WithLabelValues(rpc.Server, string(rpc.Type), rpc.Service, rpc.Method).Inc()
+}
+
+func (r *labelServerReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.metrics.serverHandledCounter.WithLabelValues(rpc.Server, string(rpc.Type), rpc.Service, rpc.Method, code.String()).Inc()
+	if o := r.metrics.serverHandledHistogram.observer(rpc, rpc.Server, string(rpc.Type), rpc.Service, rpc.Method); o != nil {
+		o.Observe(duration.Seconds())
+	}
+}
+
+// labelClientReporter records like promClientReporter, but looks up every
+// metric by its label values on every event.
+type labelClientReporter struct {
+	metrics *ClientMetrics
+}
+
+func (r *labelClientReporter) StartedRPC(rpc RPC) {
+	r.metrics.clientStartedCounter.WithLabelValues(rpc.Target, string(rpc.Type), rpc.Service, rpc.Method).Inc()
+}
+
+func (r *labelClientReporter) ReceivedMessage(rpc RPC) {
+	r.metrics.clientStreamMsgReceived.WithLabelValues(rpc.Target, string(rpc.Type), rpc.Service, rpc.Method).Inc()
+}
+
+func (r *labelClientReporter) SentMessage(rpc RPC) {
+	r.metrics.clientStreamMsgSent.WithLabelValues(rpc.Target, string(rpc.Type), rpc.Service, rpc.Method).Inc()
+}
+
+func (r *labelClientReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.metrics.clientHandledCounter.WithLabelValues(rpc.Target, string(rpc.Type), rpc.Service, rpc.Method, rpc.Backend, code.String()).Inc()
+	if o := r.metrics.clientHandledHistogram.observer(rpc, rpc.Target, string(rpc.Type), rpc.Service, rpc.Method, rpc.Backend); o != nil {
+		o.Observe(duration.Seconds())
+	}
+}
+
+// benchServerStream is a server stream receiving empty messages and
+// discarding those sent.
+type benchServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *benchServerStream) Context() context.Context    { return s.ctx }
+func (s *benchServerStream) SendMsg(m interface{}) error { return nil }
+func (s *benchServerStream) RecvMsg(m interface{}) error { return nil }
+
+// pingListServer adapts a server stream to the PingList handler of the
+// testproto service.
+type pingListServer struct {
+	grpc.ServerStream
+}
+
+func (s *pingListServer) Send(m *pb_testproto.PingResponse) error {
+	return s.ServerStream.SendMsg(m)
+}
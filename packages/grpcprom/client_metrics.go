@@ -0,0 +1,509 @@
+package grpcprom
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// ClientMetrics represents a collection of metrics to be registered on a
+// Prometheus metrics registry for a gRPC client.
+type ClientMetrics struct {
+	clientStartedCounter    *prom.CounterVec
+	clientHandledCounter    *prom.CounterVec
+	clientStreamMsgReceived *prom.CounterVec
+	clientStreamMsgSent     *prom.CounterVec
+
+	clientHandledHistogram    *histogramVec
+	clientStreamRecvHistogram *histogramVec
+	clientStreamSendHistogram *histogramVec
+
+	clientSLICounter *sliCounter
+
+	clientStreams *streamTracker
+
+	// reporter receives the events observed by the interceptors. It records
+	// into the Prometheus metrics above unless replaced by
+	// NewClientMetricsWithReporter.
+	reporter Reporter
+
+	// handles caches the metrics resolved per method by the Prometheus
+	// reporter.
+	handles *handleCache
+
+	// snapshots are the recent snapshots taken by Snapshot.
+	snapshots *snapshotHistory
+
+	// debug records RPCs for the debug page once served.
+	debug *atomic.Pointer[debugRecorder]
+
+	// hooks are called with every completed RPC.
+	hooks *atomic.Pointer[[]RPCHook]
+
+	// targets assigns the grpc_target label if enabled.
+	targets *targetLabels
+
+	// backends assigns the grpc_backend label if enabled.
+	backends *backendLabels
+
+	// mu guards the registries the metrics were registered to, so that
+	// Unregister can undo it.
+	mu         sync.Mutex
+	registries []prom.Registerer
+}
+
+// NewClientMetrics returns a ClientMetrics object. Use a new instance of
+// ClientMetrics when not using the default Prometheus metrics registry, for
+// example when wanting to control which metrics are added to a registry as
+// opposed to automatically adding metrics via init functions.
+func NewClientMetrics(counterOpts ...CounterOption) *ClientMetrics {
+	return NewClientMetricsWithOptions(asOptions(counterOpts)...)
+}
+
+// NewClientMetricsWithOptions is like NewClientMetrics, but also takes the
+// Options that are not CounterOptions, e.g. WithClientTargetLabel or
+// WithRPCHooks.
+func NewClientMetricsWithOptions(options ...Option) *ClientMetrics {
+	mo := newMetricsOptions(options)
+	opts := mo.counter
+	targets := newTargetLabels(mo.targetLabel)
+	// handledLabels are the labels of the metrics of completed RPCs, which
+	// may carry the grpc_backend label.
+	handledLabels := targets.names("grpc_type", "grpc_service", "grpc_method")
+	if mo.maxBackends > 0 {
+		handledLabels = append(handledLabels, "grpc_backend")
+	}
+	m := &ClientMetrics{
+		clientStartedCounter: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_started_total",
+				Help: "Total number of RPCs started on the client.",
+			}), targets.names("grpc_type", "grpc_service", "grpc_method")),
+
+		clientHandledCounter: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_handled_total",
+				Help: "Total number of RPCs completed by the client, regardless of success or failure.",
+			}), append(handledLabels[:len(handledLabels):len(handledLabels)], "grpc_code")),
+
+		clientStreamMsgReceived: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_msg_received_total",
+				Help: "Total number of RPC stream messages received by the client.",
+			}), targets.names("grpc_type", "grpc_service", "grpc_method")),
+
+		clientStreamMsgSent: prom.NewCounterVec(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_msg_sent_total",
+				Help: "Total number of gRPC stream messages sent by the client.",
+			}), targets.names("grpc_type", "grpc_service", "grpc_method")),
+
+		clientHandledHistogram: newHistogramVec(prom.HistogramOpts{
+			Name:    "grpc_client_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of the gRPC until it is finished by the application.",
+			Buckets: prom.DefBuckets,
+		}, handledLabels...),
+		clientStreamRecvHistogram: newHistogramVec(prom.HistogramOpts{
+			Name:    "grpc_client_msg_recv_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of the gRPC single message receive.",
+			Buckets: prom.DefBuckets,
+		}, targets.names("grpc_type", "grpc_service", "grpc_method")...),
+		clientStreamSendHistogram: newHistogramVec(prom.HistogramOpts{
+			Name:    "grpc_client_msg_send_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of the gRPC single message send.",
+			Buckets: prom.DefBuckets,
+		}, targets.names("grpc_type", "grpc_service", "grpc_method")...),
+
+		clientSLICounter: newSLICounter(
+			opts.apply(prom.CounterOpts{
+				Name: "grpc_client_sli_events_total",
+				Help: "Total number of RPCs completed by the client, classified as good or bad by their service level objective.",
+			}), targets.names("grpc_type", "grpc_service", "grpc_method", "result")...),
+		clientStreams: newStreamTracker(opts.apply(prom.CounterOpts{}), "grpc_client",
+			targets.names("grpc_type", "grpc_service", "grpc_method"),
+			func(rpc RPC) []string { return targets.values(rpc, string(rpc.Type), rpc.Service, rpc.Method) }),
+
+		handles:   newHandleCache(),
+		snapshots: &snapshotHistory{},
+		debug:     &atomic.Pointer[debugRecorder]{},
+		hooks:     &atomic.Pointer[[]RPCHook]{},
+	}
+	m.targets = targets
+	m.backends = newBackendLabels(mo.maxBackends, m.deleteBackend)
+	addHooks(m.hooks, mo.hooks)
+	m.reporter = &promClientReporter{metrics: m}
+	return m
+}
+
+// NewClientMetricsWithReporter returns a ClientMetrics object whose
+// interceptors report to the given Reporter instead of Prometheus metrics.
+// The returned ClientMetrics does not export anything through Describe and
+// Collect. The options configure the RPCs reported, e.g. their labels.
+func NewClientMetricsWithReporter(r Reporter, opts ...Option) *ClientMetrics {
+	m := NewClientMetricsWithOptions(opts...)
+	m.reporter = r
+	return m
+}
+
+// exportsPrometheus reports whether the interceptors record into the
+// Prometheus metrics of m.
+func (m *ClientMetrics) exportsPrometheus() bool {
+	_, ok := m.reporter.(*promClientReporter)
+	return ok
+}
+
+// Describe sends the super-set of all possible descriptors of metrics
+// collected by this Collector to the provided channel and returns once
+// the last descriptor has been sent.
+func (m *ClientMetrics) Describe(ch chan<- *prom.Desc) {
+	if !m.exportsPrometheus() {
+		return
+	}
+	m.clientStartedCounter.Describe(ch)
+	m.clientHandledCounter.Describe(ch)
+	m.clientStreamMsgReceived.Describe(ch)
+	m.clientStreamMsgSent.Describe(ch)
+	m.clientHandledHistogram.Describe(ch)
+	m.clientStreamRecvHistogram.Describe(ch)
+	m.clientStreamSendHistogram.Describe(ch)
+	m.clientSLICounter.Describe(ch)
+	m.clientStreams.Describe(ch)
+}
+
+// Collect is called by the Prometheus registry when collecting
+// metrics. The implementation sends each collected metric via the
+// provided channel and returns once the last metric has been sent.
+func (m *ClientMetrics) Collect(ch chan<- prom.Metric) {
+	if !m.exportsPrometheus() {
+		return
+	}
+	m.clientStartedCounter.Collect(ch)
+	m.clientHandledCounter.Collect(ch)
+	m.clientStreamMsgReceived.Collect(ch)
+	m.clientStreamMsgSent.Collect(ch)
+	m.clientHandledHistogram.Collect(ch)
+	m.clientStreamRecvHistogram.Collect(ch)
+	m.clientStreamSendHistogram.Collect(ch)
+	m.clientSLICounter.Collect(ch)
+	m.clientStreams.Collect(ch)
+}
+
+// Snapshot returns the statistics of every method, read from the same
+// metrics as Collect. See ServerMetrics.Snapshot.
+func (m *ClientMetrics) Snapshot() Snapshot {
+	stats := snapshotVecs{
+		started:  m.clientStartedCounter,
+		handled:  m.clientHandledCounter,
+		received: m.clientStreamMsgReceived,
+		sent:     m.clientStreamMsgSent,
+		handling: m.clientHandledHistogram,
+	}.read()
+	return m.snapshots.snapshot(time.Now(), stats)
+}
+
+// DebugHandler returns an http.Handler serving an HTML page of the
+// statistics of every method. See ServerMetrics.DebugHandler.
+func (m *ClientMetrics) DebugHandler(keep int) http.Handler {
+	return debugHandler("gRPC client", "Target", m.debug, keep, m.Snapshot)
+}
+
+// RegisterTo registers the metrics on reg. Unlike registering them directly,
+// this allows Unregister to remove them again.
+func (m *ClientMetrics) RegisterTo(reg prom.Registerer) error {
+	if err := reg.Register(m); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.registries = append(m.registries, reg)
+	m.mu.Unlock()
+	return nil
+}
+
+// Unregister removes the metrics from all registries they were registered to
+// with RegisterTo. It reports whether they were removed from any.
+func (m *ClientMetrics) Unregister() bool {
+	m.mu.Lock()
+	registries := m.registries
+	m.registries = nil
+	m.mu.Unlock()
+	unregistered := false
+	for _, reg := range registries {
+		if reg.Unregister(m) {
+			unregistered = true
+		}
+	}
+	return unregistered
+}
+
+// Reset deletes all series of the metrics. Enabled histograms and SLI events
+// stay enabled.
+func (m *ClientMetrics) Reset() {
+	m.clientStartedCounter.Reset()
+	m.clientHandledCounter.Reset()
+	m.clientStreamMsgReceived.Reset()
+	m.clientStreamMsgSent.Reset()
+	m.clientHandledHistogram.Reset()
+	m.clientStreamRecvHistogram.Reset()
+	m.clientStreamSendHistogram.Reset()
+	m.clientSLICounter.Reset()
+	m.clientStreams.Reset()
+	m.backends.Reset()
+	m.handles.reset()
+	if d := m.debug.Load(); d != nil {
+		d.Reset()
+	}
+}
+
+// EnableClientHandlingTimeHistogram turns on recording of handling time of RPCs.
+// Histogram metrics can be very expensive for Prometheus to retain and query.
+//
+// It is safe to call while RPCs are in flight, e.g. to change the buckets,
+// which discards the observations made so far. The histogram is described
+// even while disabled, so the ClientMetrics may be registered before enabling
+// it; once registered, only the buckets may be changed.
+func (m *ClientMetrics) EnableClientHandlingTimeHistogram(opts ...HistogramOption) {
+	histOpts := m.clientHandledHistogram.enable(opts...)
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(HandlingTimeHistogram, &histOpts)
+	}
+}
+
+// OverrideClientHandlingTimeHistogram makes the handling time of the methods
+// matching pattern be recorded with opts. See
+// ServerMetrics.OverrideHandlingTimeHistogram.
+func (m *ClientMetrics) OverrideClientHandlingTimeHistogram(pattern string, opts ...HistogramOption) error {
+	return m.clientHandledHistogram.override(pattern, opts...)
+}
+
+// SampleClientHandlingTimeHistogram makes the methods matching pattern only
+// observe the handling time of one in every `every` RPCs. See
+// ServerMetrics.SampleHandlingTimeHistogram.
+func (m *ClientMetrics) SampleClientHandlingTimeHistogram(pattern string, every int) error {
+	return m.clientHandledHistogram.sample(pattern, every)
+}
+
+// DisableClientHandlingTimeHistogram stops recording and exporting the
+// handling time histogram. It is safe to call while RPCs are in flight.
+func (m *ClientMetrics) DisableClientHandlingTimeHistogram() {
+	m.clientHandledHistogram.disable()
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(HandlingTimeHistogram, nil)
+	}
+}
+
+// EnableClientStreamReceiveTimeHistogram turns on recording of single message receive time of streaming RPCs.
+// Histogram metrics can be very expensive for Prometheus to retain and query.
+// Like EnableClientHandlingTimeHistogram, it is safe to call at runtime.
+func (m *ClientMetrics) EnableClientStreamReceiveTimeHistogram(opts ...HistogramOption) {
+	histOpts := m.clientStreamRecvHistogram.enable(opts...)
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(StreamReceiveTimeHistogram, &histOpts)
+	}
+}
+
+// SampleClientStreamReceiveTimeHistogram makes the methods matching pattern
+// only observe the receive time of one in every `every` stream messages. See
+// ServerMetrics.SampleHandlingTimeHistogram.
+func (m *ClientMetrics) SampleClientStreamReceiveTimeHistogram(pattern string, every int) error {
+	return m.clientStreamRecvHistogram.sample(pattern, every)
+}
+
+// DisableClientStreamReceiveTimeHistogram stops recording and exporting the
+// single message receive time histogram.
+func (m *ClientMetrics) DisableClientStreamReceiveTimeHistogram() {
+	m.clientStreamRecvHistogram.disable()
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(StreamReceiveTimeHistogram, nil)
+	}
+}
+
+// EnableClientStreamSendTimeHistogram turns on recording of single message send time of streaming RPCs.
+// Histogram metrics can be very expensive for Prometheus to retain and query.
+// Like EnableClientHandlingTimeHistogram, it is safe to call at runtime.
+func (m *ClientMetrics) EnableClientStreamSendTimeHistogram(opts ...HistogramOption) {
+	histOpts := m.clientStreamSendHistogram.enable(opts...)
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(StreamSendTimeHistogram, &histOpts)
+	}
+}
+
+// SampleClientStreamSendTimeHistogram makes the methods matching pattern only
+// observe the send time of one in every `every` stream messages. See
+// ServerMetrics.SampleHandlingTimeHistogram.
+func (m *ClientMetrics) SampleClientStreamSendTimeHistogram(pattern string, every int) error {
+	return m.clientStreamSendHistogram.sample(pattern, every)
+}
+
+// DisableClientStreamSendTimeHistogram stops recording and exporting the
+// single message send time histogram.
+func (m *ClientMetrics) DisableClientStreamSendTimeHistogram() {
+	m.clientStreamSendHistogram.disable()
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(StreamSendTimeHistogram, nil)
+	}
+}
+
+// EnableClientSLIEvents enables counting completed RPCs as good or bad events
+// of a service level indicator, according to the given objectives. RPCs of
+// methods not matched by any SLO are not counted.
+func (m *ClientMetrics) EnableClientSLIEvents(slos ...SLO) {
+	m.clientSLICounter.enable(slos)
+}
+
+// EnableClientStreamAgeMetrics enables tracking the active streams of every
+// method, exported as grpc_client_oldest_active_stream_age_seconds and
+// grpc_client_active_stream_age_seconds. A stream is active until receiving
+// from it fails or its context is done. See
+// ServerMetrics.EnableStreamAgeMetrics.
+func (m *ClientMetrics) EnableClientStreamAgeMetrics() {
+	m.clientStreams.setAgesEnabled(true)
+}
+
+// DisableClientStreamAgeMetrics stops exporting the ages of active streams.
+func (m *ClientMetrics) DisableClientStreamAgeMetrics() {
+	m.clientStreams.setAgesEnabled(false)
+}
+
+// EnableClientIdleStreamMetrics enables tracking the time since the last
+// message of every stream, exported as grpc_client_idle_streams and
+// grpc_client_idle_streams_ended_total. See
+// ServerMetrics.EnableIdleStreamMetrics.
+func (m *ClientMetrics) EnableClientIdleStreamMetrics(thresholds ...time.Duration) {
+	m.clientStreams.setIdleThresholds(thresholds)
+}
+
+// BackendStatsHandler returns a stats.Handler tracking the connections of a
+// ClientConn, to delete the grpc_backend series of a backend once its last
+// connection ended, freeing its place under the cap of
+// WithClientBackendLabel. Its counters start over if it is connected to
+// again.
+func (m *ClientMetrics) BackendStatsHandler() stats.Handler {
+	return backendStatsHandler{backends: m.backends}
+}
+
+// handledLabelValues returns lvs followed by the grpc_backend label of rpc if
+// enabled, for the metrics of completed RPCs.
+func (m *ClientMetrics) handledLabelValues(lvs []string, rpc RPC) []string {
+	if !m.backends.enabled() {
+		return lvs
+	}
+	return append(lvs[:len(lvs):len(lvs)], rpc.Backend)
+}
+
+// deleteBackend deletes the series of the method of rpc for its backend.
+func (m *ClientMetrics) deleteBackend(rpc RPC) {
+	lvs := m.handledLabelValues(m.targets.values(rpc, string(rpc.Type), rpc.Service, rpc.Method), rpc)
+	for _, code := range allCodes {
+		m.clientHandledCounter.DeleteLabelValues(append(lvs, code.String())...)
+	}
+	m.clientHandledHistogram.deleteLabelValues(rpc, lvs...)
+	m.handles.delete(rpc)
+}
+
+// AddClientRPCHooks adds hooks called with every RPC completed by the client,
+// e.g. SlowRPCLogHook or AccessLogHook, with the timing and code recorded by
+// the metrics. They are only called for RPCs started once added.
+func (m *ClientMetrics) AddClientRPCHooks(hooks ...RPCHook) {
+	addHooks(m.hooks, hooks)
+}
+
+// UnaryClientInterceptor is a gRPC client-side interceptor that provides Prometheus monitoring for Unary RPCs.
+func (m *ClientMetrics) UnaryClientInterceptor() func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		monitor := newClientReporter(ctx, m, Unary, method, cc)
+		monitor.SentMessage()
+		err := invoker(ctx, method, req, reply, cc, monitor.callOptions(opts)...)
+		if err == nil {
+			monitor.ReceivedMessage()
+		}
+		st, _ := status.FromError(err)
+		monitor.Handled(st, err)
+		return err
+	}
+}
+
+// StreamClientInterceptor is a gRPC client-side interceptor that provides Prometheus monitoring for Streaming RPCs.
+func (m *ClientMetrics) StreamClientInterceptor() func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		monitor := newClientReporter(ctx, m, clientStreamType(desc), method, cc)
+		clientStream, err := streamer(ctx, desc, cc, method, monitor.callOptions(opts)...)
+		if err != nil {
+			st, _ := status.FromError(err)
+			monitor.Handled(st, err)
+			return nil, err
+		}
+		stream := &monitoredClientStream{ClientStream: clientStream, monitor: monitor, serverStreams: desc.ServerStreams}
+		if m.exportsPrometheus() && m.clientStreams.tracking() {
+			stream.active = m.clientStreams.track(monitor.rpc)
+			untrack := func() { m.clientStreams.untrack(stream.active) }
+			stop := context.AfterFunc(ctx, untrack)
+			stream.untrack = func() {
+				stop()
+				untrack()
+			}
+		}
+		return stream, nil
+	}
+}
+
+func clientStreamType(desc *grpc.StreamDesc) GRPCType {
+	if desc.ClientStreams && !desc.ServerStreams {
+		return ClientStream
+	} else if !desc.ClientStreams && desc.ServerStreams {
+		return ServerStream
+	}
+	return BidiStream
+}
+
+// monitoredClientStream wraps grpc.ClientStream allowing each Sent/Recv of message to increment counters.
+type monitoredClientStream struct {
+	grpc.ClientStream
+	monitor       *clientReporter
+	serverStreams bool
+
+	// active is the stream as tracked, nil if not tracked, and untrack
+	// removes it from the active streams. Streams end when receiving fails,
+	// when receiving the response of a stream of client messages, or when
+	// their context is done.
+	active  *activeStream
+	untrack func()
+}
+
+func (s *monitoredClientStream) SendMsg(m interface{}) error {
+	timer := s.monitor.SendMessageTimer()
+	err := s.ClientStream.SendMsg(m)
+	timer.ObserveDuration()
+	s.active.touch()
+	if err == nil {
+		s.monitor.SentMessage()
+	}
+	return err
+}
+
+func (s *monitoredClientStream) RecvMsg(m interface{}) error {
+	timer := s.monitor.ReceiveMessageTimer()
+	err := s.ClientStream.RecvMsg(m)
+	timer.ObserveDuration()
+	s.active.touch()
+	if s.untrack != nil && (err != nil || !s.serverStreams) {
+		s.untrack()
+	}
+
+	if err == nil {
+		s.monitor.ReceivedMessage()
+	} else if err == io.EOF {
+		s.monitor.Handled(nil, nil)
+	} else {
+		st, _ := status.FromError(err)
+		s.monitor.Handled(st, err)
+	}
+	return err
+}
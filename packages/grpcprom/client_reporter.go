@@ -0,0 +1,273 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpcprom
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// clientReporter reports the events of a single client-side RPC.
+type clientReporter struct {
+	reporter  Reporter
+	rpc       RPC
+	startTime time.Time
+
+	// debug records the RPC for the debug page if enabled, and backends
+	// labels its completion by backend if enabled, with the reporter of the
+	// ClientMetrics. peer receives the peer of the RPC from a grpc.Peer call
+	// option for either, or the hooks.
+	debug    *debugRecorder
+	backends *backendLabels
+	base     Reporter
+	peer     *peer.Peer
+
+	// ctx is the context of the RPC, passed to the hooks called once it
+	// completed, with its messages counted in msgs if any.
+	ctx   context.Context
+	hooks []RPCHook
+	msgs  msgCounts
+}
+
+func newClientReporter(ctx context.Context, m *ClientMetrics, rpcType GRPCType, fullMethod string, cc *grpc.ClientConn) *clientReporter {
+	r := &clientReporter{
+		reporter: m.reporter,
+		rpc:      RPC{Type: rpcType, Target: m.targets.label(cc)},
+		debug:    m.debug.Load(),
+		base:     m.reporter,
+		ctx:      ctx,
+		hooks:    loadHooks(m.hooks),
+	}
+	if m.backends.enabled() {
+		r.backends = m.backends
+	}
+	r.rpc.Service, r.rpc.Method = splitMethodName(fullMethod)
+	// The metrics of completed RPCs are only resolved once their backend is
+	// known, rather than bound ahead.
+	if b, ok := r.reporter.(rpcBinder); ok && r.backends == nil {
+		r.reporter = b.bind(r.rpc)
+	}
+	if t, ok := r.reporter.(timingReporter); !ok || t.timed() || r.debug != nil || r.hooks != nil {
+		r.startTime = time.Now()
+	}
+	r.reporter.StartedRPC(r.rpc)
+	return r
+}
+
+// timer is a helper interface to time functions.
+type timer interface {
+	ObserveDuration() time.Duration
+}
+
+type noOpTimer struct {
+}
+
+func (noOpTimer) ObserveDuration() time.Duration {
+	return 0
+}
+
+var emptyTimer = noOpTimer{}
+
+func (r *clientReporter) ReceiveMessageTimer() timer {
+	if t, ok := r.reporter.(messageTimers); ok {
+		return t.receiveMessageTimer(r.rpc)
+	}
+	if h, ok := r.reporter.(HistogramReporter); ok {
+		if o := h.MessageObserver(StreamReceiveTimeHistogram, r.rpc); o != nil {
+			return prometheus.NewTimer(o)
+		}
+	}
+
+	return emptyTimer
+}
+
+func (r *clientReporter) ReceivedMessage() {
+	r.reporter.ReceivedMessage(r.rpc)
+	if r.hooks != nil {
+		r.msgs.received.Add(1)
+	}
+}
+
+func (r *clientReporter) SendMessageTimer() timer {
+	if t, ok := r.reporter.(messageTimers); ok {
+		return t.sendMessageTimer(r.rpc)
+	}
+	if h, ok := r.reporter.(HistogramReporter); ok {
+		if o := h.MessageObserver(StreamSendTimeHistogram, r.rpc); o != nil {
+			return prometheus.NewTimer(o)
+		}
+	}
+
+	return emptyTimer
+}
+
+func (r *clientReporter) SentMessage() {
+	r.reporter.SentMessage(r.rpc)
+	if r.hooks != nil {
+		r.msgs.sent.Add(1)
+	}
+}
+
+// callOptions returns opts with those needed to report the RPC.
+func (r *clientReporter) callOptions(opts []grpc.CallOption) []grpc.CallOption {
+	if r.debug == nil && r.backends == nil && r.hooks == nil {
+		return opts
+	}
+	r.peer = &peer.Peer{}
+	return append(opts, grpc.Peer(r.peer))
+}
+
+// Handled reports the RPC as completed with err, whose status is st, nil
+// meaning OK.
+func (r *clientReporter) Handled(st *status.Status, err error) {
+	duration := elapsed(r.startTime)
+	var addr string
+	if r.peer != nil && r.peer.Addr != nil {
+		addr = r.peer.Addr.String()
+	}
+	rpc := r.rpc
+	if r.backends != nil {
+		r.backends.label(rpc, addr, func(labeled RPC) {
+			rpc = labeled
+			r.base.Handled(rpc, st.Code(), duration)
+		})
+	} else {
+		r.reporter.Handled(rpc, st.Code(), duration)
+	}
+	if r.debug != nil {
+		r.debug.record(r.rpc, duration, st, addr)
+	}
+	if r.hooks != nil {
+		r.msgs.call(r.hooks, RPCInfo{RPC: rpc, Code: st.Code(), Err: err, Duration: duration, Peer: addr, Context: r.ctx})
+	}
+}
+
+// promClientReporter is the Reporter recording into the Prometheus metrics of
+// a ClientMetrics.
+type promClientReporter struct {
+	metrics *ClientMetrics
+}
+
+// clientHandles are the metrics of a method resolved by promClientReporter.
+type clientHandles struct {
+	lvs []string
+	// handledLvs are lvs followed by the grpc_backend label if enabled, for
+	// the metrics of completed RPCs.
+	handledLvs []string
+	started    lazyCounter
+	received   lazyCounter
+	sent       lazyCounter
+	handled    codeCounters
+	handling   atomic.Pointer[histogramHandle]
+	recv       atomic.Pointer[histogramHandle]
+	send       atomic.Pointer[histogramHandle]
+}
+
+func (r *promClientReporter) newHandles(rpc RPC) interface{} {
+	lvs := r.metrics.targets.values(rpc, string(rpc.Type), rpc.Service, rpc.Method)
+	return &clientHandles{lvs: lvs, handledLvs: r.metrics.handledLabelValues(lvs, rpc)}
+}
+
+func (r *promClientReporter) handles(rpc RPC) *clientHandles {
+	return r.metrics.handles.load(rpc, r.newHandles).(*clientHandles)
+}
+
+func (r *promClientReporter) bind(rpc RPC) Reporter {
+	b := r.bound(rpc)
+	return &b
+}
+
+// bound returns r bound to the handles of the method of rpc, resolving
+// whether its handling time is observed.
+func (r *promClientReporter) bound(rpc RPC) boundClientReporter {
+	h := r.handles(rpc)
+	return boundClientReporter{
+		promClientReporter: r,
+		h:                  h,
+		handling:           r.metrics.clientHandledHistogram.resolve(&h.handling, rpc, h.handledLvs),
+		slo:                r.metrics.clientSLICounter.objective(rpc.Service, rpc.Method),
+	}
+}
+
+func (r *promClientReporter) StartedRPC(rpc RPC) {
+	boundClientReporter{promClientReporter: r, h: r.handles(rpc)}.StartedRPC(rpc)
+}
+
+func (r *promClientReporter) ReceivedMessage(rpc RPC) {
+	boundClientReporter{promClientReporter: r, h: r.handles(rpc)}.ReceivedMessage(rpc)
+}
+
+func (r *promClientReporter) SentMessage(rpc RPC) {
+	boundClientReporter{promClientReporter: r, h: r.handles(rpc)}.SentMessage(rpc)
+}
+
+func (r *promClientReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.bound(rpc).Handled(rpc, code, duration)
+}
+
+func (r *promClientReporter) receiveMessageTimer(rpc RPC) timer {
+	return boundClientReporter{promClientReporter: r, h: r.handles(rpc)}.receiveMessageTimer(rpc)
+}
+
+func (r *promClientReporter) sendMessageTimer(rpc RPC) timer {
+	return boundClientReporter{promClientReporter: r, h: r.handles(rpc)}.sendMessageTimer(rpc)
+}
+
+// boundClientReporter is a promClientReporter bound to the handles of the
+// method of an RPC.
+type boundClientReporter struct {
+	*promClientReporter
+	h        *clientHandles
+	handling prometheus.Observer // nil if not observed, e.g. when sampled out
+	slo      *SLO
+}
+
+func (r boundClientReporter) StartedRPC(RPC) {
+	r.h.started.get(r.metrics.handles, r.metrics.clientStartedCounter, r.h.lvs).Inc()
+}
+
+func (r boundClientReporter) ReceivedMessage(RPC) {
+	r.h.received.get(r.metrics.handles, r.metrics.clientStreamMsgReceived, r.h.lvs).Inc()
+}
+
+func (r boundClientReporter) SentMessage(RPC) {
+	r.h.sent.get(r.metrics.handles, r.metrics.clientStreamMsgSent, r.h.lvs).Inc()
+}
+
+func (r boundClientReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.h.handled.get(r.metrics.handles, r.metrics.clientHandledCounter, r.h.handledLvs, code).Inc()
+	if r.handling != nil {
+		r.handling.Observe(duration.Seconds())
+	}
+	if r.slo != nil {
+		r.metrics.clientSLICounter.vec.WithLabelValues(append(r.h.lvs[:len(r.h.lvs):len(r.h.lvs)], sliResult(r.slo.good(code, duration)))...).Inc()
+	}
+}
+
+func (r boundClientReporter) timed() bool {
+	return r.handling != nil || r.slo != nil
+}
+
+func (r boundClientReporter) receiveMessageTimer(rpc RPC) timer {
+	if hist := r.metrics.clientStreamRecvHistogram.resolve(&r.h.recv, rpc, r.h.lvs); hist != nil {
+		return prometheus.NewTimer(hist)
+	}
+
+	return emptyTimer
+}
+
+func (r boundClientReporter) sendMessageTimer(rpc RPC) timer {
+	if hist := r.metrics.clientStreamSendHistogram.resolve(&r.h.send, rpc, r.h.lvs); hist != nil {
+		return prometheus.NewTimer(hist)
+	}
+
+	return emptyTimer
+}
@@ -1,7 +1,7 @@
 // Copyright 2016 Michal Witkowski. All Rights Reserved.
 // See LICENSE for licensing terms.
 
-package grpc_prometheus
+package grpcprom
 
 import (
 	"context"
@@ -31,6 +31,7 @@ func TestClientInterceptorSuite(t *testing.T) {
 type ClientInterceptorTestSuite struct {
 	suite.Suite
 
+	metrics        *ClientMetrics
 	serverListener net.Listener
 	server         *grpc.Server
 	clientConn     *grpc.ClientConn
@@ -42,7 +43,8 @@ type ClientInterceptorTestSuite struct {
 func (s *ClientInterceptorTestSuite) SetupSuite() {
 	var err error
 
-	EnableClientHandlingTimeHistogram()
+	s.metrics = NewClientMetrics()
+	s.metrics.EnableClientHandlingTimeHistogram()
 
 	s.serverListener, err = net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(s.T(), err, "must be able to allocate a port for serverListener")
@@ -59,8 +61,8 @@ func (s *ClientInterceptorTestSuite) SetupSuite() {
 		s.serverListener.Addr().String(),
 		grpc.WithInsecure(),
 		grpc.WithBlock(),
-		grpc.WithUnaryInterceptor(UnaryClientInterceptor),
-		grpc.WithStreamInterceptor(StreamClientInterceptor),
+		grpc.WithUnaryInterceptor(s.metrics.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(s.metrics.StreamClientInterceptor()),
 		grpc.WithTimeout(2*time.Second))
 	require.NoError(s.T(), err, "must not error on client Dial")
 	s.testClient = pb_testproto.NewTestServiceClient(s.clientConn)
@@ -71,11 +73,7 @@ func (s *ClientInterceptorTestSuite) SetupTest() {
 	s.ctx, s.cancel = context.WithTimeout(context.TODO(), 2*time.Second)
 
 	// Make sure every test starts with same fresh, intialized metric state.
-	DefaultClientMetrics.clientStartedCounter.Reset()
-	DefaultClientMetrics.clientHandledCounter.Reset()
-	DefaultClientMetrics.clientHandledHistogram.Reset()
-	DefaultClientMetrics.clientStreamMsgReceived.Reset()
-	DefaultClientMetrics.clientStreamMsgSent.Reset()
+	s.metrics.Reset()
 }
 
 func (s *ClientInterceptorTestSuite) TearDownSuite() {
@@ -97,25 +95,25 @@ func (s *ClientInterceptorTestSuite) TearDownTest() {
 func (s *ClientInterceptorTestSuite) TestUnaryIncrementsMetrics() {
 	_, err := s.testClient.PingEmpty(s.ctx, &pb_testproto.Empty{}) // should return with code=OK
 	require.NoError(s.T(), err)
-	requireValue(s.T(), 1, DefaultClientMetrics.clientStartedCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty"))
-	requireValue(s.T(), 1, DefaultClientMetrics.clientHandledCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty", "OK"))
-	requireValueHistCount(s.T(), 1, DefaultClientMetrics.clientHandledHistogram.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty"))
+	requireValue(s.T(), 1, s.metrics.clientStartedCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty"))
+	requireValue(s.T(), 1, s.metrics.clientHandledCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty", "OK"))
+	requireValueHistCount(s.T(), 1, s.metrics.clientHandledHistogram.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty"))
 
 	_, err = s.testClient.PingError(s.ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)}) // should return with code=FailedPrecondition
 	require.Error(s.T(), err)
-	requireValue(s.T(), 1, DefaultClientMetrics.clientStartedCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError"))
-	requireValue(s.T(), 1, DefaultClientMetrics.clientHandledCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError", "FailedPrecondition"))
-	requireValueHistCount(s.T(), 1, DefaultClientMetrics.clientHandledHistogram.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError"))
+	requireValue(s.T(), 1, s.metrics.clientStartedCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError"))
+	requireValue(s.T(), 1, s.metrics.clientHandledCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError", "FailedPrecondition"))
+	requireValueHistCount(s.T(), 1, s.metrics.clientHandledHistogram.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError"))
 }
 
 func (s *ClientInterceptorTestSuite) TestStartedStreamingIncrementsStarted() {
 	_, err := s.testClient.PingList(s.ctx, &pb_testproto.PingRequest{})
 	require.NoError(s.T(), err)
-	requireValue(s.T(), 1, DefaultClientMetrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 1, s.metrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
 
 	_, err = s.testClient.PingList(s.ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)}) // should return with code=FailedPrecondition
 	require.NoError(s.T(), err, "PingList must not fail immediately")
-	requireValue(s.T(), 2, DefaultClientMetrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 2, s.metrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
 }
 
 func (s *ClientInterceptorTestSuite) TestStreamingIncrementsMetrics() {
@@ -132,11 +130,11 @@ func (s *ClientInterceptorTestSuite) TestStreamingIncrementsMetrics() {
 	}
 	require.EqualValues(s.T(), countListResponses, count, "Number of received msg on the wire must match")
 
-	requireValue(s.T(), 1, DefaultClientMetrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValue(s.T(), 1, DefaultClientMetrics.clientHandledCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList", "OK"))
-	requireValue(s.T(), countListResponses, DefaultClientMetrics.clientStreamMsgReceived.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValue(s.T(), 1, DefaultClientMetrics.clientStreamMsgSent.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValueHistCount(s.T(), 1, DefaultClientMetrics.clientHandledHistogram.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 1, s.metrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 1, s.metrics.clientHandledCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList", "OK"))
+	requireValue(s.T(), countListResponses, s.metrics.clientStreamMsgReceived.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 1, s.metrics.clientStreamMsgSent.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValueHistCount(s.T(), 1, s.metrics.clientHandledHistogram.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
 
 	ss, err := s.testClient.PingList(s.ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)}) // should return with code=FailedPrecondition
 	require.NoError(s.T(), err, "PingList must not fail immediately")
@@ -146,7 +144,23 @@ func (s *ClientInterceptorTestSuite) TestStreamingIncrementsMetrics() {
 	st, _ := status.FromError(err)
 	require.Equal(s.T(), codes.FailedPrecondition, st.Code(), "Recv must return FailedPrecondition, otherwise the test is wrong")
 
-	requireValue(s.T(), 2, DefaultClientMetrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValue(s.T(), 1, DefaultClientMetrics.clientHandledCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList", "FailedPrecondition"))
-	requireValueHistCount(s.T(), 2, DefaultClientMetrics.clientHandledHistogram.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 2, s.metrics.clientStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValue(s.T(), 1, s.metrics.clientHandledCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList", "FailedPrecondition"))
+	requireValueHistCount(s.T(), 2, s.metrics.clientHandledHistogram.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+}
+
+func TestClientMetricsLifecycle(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewClientMetrics()
+	require.NoError(t, m.RegisterTo(reg))
+	require.Error(t, NewClientMetrics().RegisterTo(reg), "conflicting metrics must be reported")
+
+	m.reporter.StartedRPC(RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"})
+	m.Reset()
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	require.Empty(t, mfs, "reset must delete all series")
+
+	require.True(t, m.Unregister())
+	require.NoError(t, NewClientMetrics().RegisterTo(reg), "unregistered metrics must free their names")
 }
@@ -0,0 +1,246 @@
+package grpcprom
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// debugRecorder keeps the slowest and the most recent failed RPCs of every
+// method, for the debug page.
+type debugRecorder struct {
+	mu      sync.Mutex
+	keep    int
+	methods map[RPC]*debugMethod
+}
+
+// debugMethod are the RPCs of a method kept by a debugRecorder.
+type debugMethod struct {
+	// slowest are the slowest RPCs, slowest first.
+	slowest []debugRPC
+	// failed are the most recent failed RPCs, oldest first.
+	failed []debugRPC
+}
+
+// debugRPC is a completed RPC as shown on the debug page.
+type debugRPC struct {
+	Time     time.Time
+	Duration time.Duration
+	Code     codes.Code
+	Peer     string
+	Error    string
+}
+
+func newDebugRecorder(keep int) *debugRecorder {
+	return &debugRecorder{keep: keep, methods: make(map[RPC]*debugMethod)}
+}
+
+// record keeps a completed RPC if it is among the slowest of its method or
+// failed.
+func (d *debugRecorder) record(rpc RPC, duration time.Duration, st *status.Status, peer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.methods[rpc]
+	if !ok {
+		m = &debugMethod{}
+		d.methods[rpc] = m
+	}
+	r := debugRPC{Time: time.Now(), Duration: duration, Code: st.Code(), Peer: peer, Error: st.Message()}
+	if i := sort.Search(len(m.slowest), func(i int) bool { return m.slowest[i].Duration < duration }); i < d.keep {
+		m.slowest = append(m.slowest, debugRPC{})
+		copy(m.slowest[i+1:], m.slowest[i:])
+		m.slowest[i] = r
+		if len(m.slowest) > d.keep {
+			m.slowest = m.slowest[:d.keep]
+		}
+	}
+	if r.Code != codes.OK {
+		if len(m.failed) == d.keep {
+			m.failed = append(m.failed[:0], m.failed[1:]...)
+		}
+		m.failed = append(m.failed, r)
+	}
+}
+
+// setKeep changes how many RPCs are kept per method.
+func (d *debugRecorder) setKeep(keep int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keep = keep
+	for _, m := range d.methods {
+		if len(m.slowest) > keep {
+			m.slowest = m.slowest[:keep]
+		}
+		if len(m.failed) > keep {
+			m.failed = append(m.failed[:0], m.failed[len(m.failed)-keep:]...)
+		}
+	}
+}
+
+// Reset forgets all RPCs kept.
+func (d *debugRecorder) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.methods = make(map[RPC]*debugMethod)
+}
+
+// kept returns copies of the RPCs kept for rpc.
+func (d *debugRecorder) kept(rpc RPC) (slowest, failed []debugRPC) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := d.methods[rpc]; ok {
+		slowest = append(slowest, m.slowest...)
+		failed = append(failed, m.failed...)
+		for i, j := 0, len(failed)-1; i < j; i, j = i+1, j-1 {
+			failed[i], failed[j] = failed[j], failed[i]
+		}
+	}
+	return slowest, failed
+}
+
+// debugHandler returns the debug page handler for the metrics of snapshot,
+// enabling rec with keep RPCs per method. instance names the column of the
+// server or target of the methods.
+func debugHandler(title, instance string, rec *atomic.Pointer[debugRecorder], keep int, snapshot func() Snapshot) http.Handler {
+	if keep < 1 {
+		keep = 1
+	}
+	if d := rec.Load(); d != nil {
+		d.setKeep(keep)
+	} else if !rec.CompareAndSwap(nil, newDebugRecorder(keep)) {
+		rec.Load().setKeep(keep)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := debugPage{Title: title, Instance: instance, Snapshot: snapshot()}
+		for _, m := range page.Snapshot.Methods {
+			for code := range m.Total.Handled {
+				page.addCode(code)
+			}
+			if m.Total.Latency != nil && page.Buckets == nil {
+				page.Buckets = m.Total.Latency.Buckets
+			}
+		}
+		sort.Slice(page.Codes, func(i, j int) bool { return page.Codes[i] < page.Codes[j] })
+		for _, m := range page.Snapshot.Methods {
+			slowest, failed := rec.Load().kept(m.RPC)
+			page.Methods = append(page.Methods, debugPageMethod{MethodSnapshot: m, Slowest: slowest, Failed: failed})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := debugTemplate.Execute(w, &page); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// debugPage is the data rendered by debugTemplate.
+type debugPage struct {
+	Title    string
+	Instance string
+	Snapshot Snapshot
+	// Codes are the codes any method was handled with, and Buckets the
+	// handling time buckets of the first method with a histogram.
+	Codes   []codes.Code
+	Buckets []Bucket
+	Methods []debugPageMethod
+}
+
+type debugPageMethod struct {
+	MethodSnapshot
+	Slowest []debugRPC
+	Failed  []debugRPC
+}
+
+func (p *debugPage) addCode(code codes.Code) {
+	for _, c := range p.Codes {
+		if c == code {
+			return
+		}
+	}
+	p.Codes = append(p.Codes, code)
+}
+
+// Instance returns the server or target the RPCs of m are labeled with.
+func (m debugPageMethod) Instance() string {
+	if m.RPC.Server != "" {
+		return m.RPC.Server
+	}
+	return m.RPC.Target
+}
+
+// Handled returns the number of RPCs of m handled with code.
+func (m debugPageMethod) Handled(code codes.Code) uint64 {
+	return m.Total.Handled[code]
+}
+
+// Bucket returns the cumulative count of handling times of m up to bound,
+// or nothing if m has no such bucket.
+func (m debugPageMethod) Bucket(bound float64) interface{} {
+	if m.Total.Latency == nil {
+		return nil
+	}
+	for _, b := range m.Total.Latency.Buckets {
+		if b.UpperBound == bound {
+			return b.CumulativeCount
+		}
+	}
+	return nil
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 6px; text-align: right; }
+th.name, td.name { text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Taken at {{.Snapshot.Time.Format "2006-01-02 15:04:05.000 MST"}}.</p>
+<table>
+<tr>
+<th class="name">Service</th><th class="name">Method</th><th class="name">Type</th><th class="name">{{.Instance}}</th>
+<th>In flight</th><th>Started</th>
+{{range .Codes}}<th>{{.}}</th>{{end}}
+{{range .Buckets}}<th>&le; {{.UpperBound}}s</th>{{end}}
+</tr>
+{{$page := .}}
+{{range .Methods}}{{$m := .}}
+<tr>
+<td class="name">{{.RPC.Service}}</td><td class="name"><a href="#{{.RPC.Service}}/{{.RPC.Method}}/{{.Instance}}">{{.RPC.Method}}</a></td>
+<td class="name">{{.RPC.Type}}</td><td class="name">{{.Instance}}</td>
+<td>{{.InFlight}}</td><td>{{.Total.Started}}</td>
+{{range $page.Codes}}<td>{{$m.Handled .}}</td>{{end}}
+{{range $page.Buckets}}<td>{{$m.Bucket .UpperBound}}</td>{{end}}
+</tr>
+{{end}}
+</table>
+{{range .Methods}}{{if or .Slowest .Failed}}
+<h2 id="{{.RPC.Service}}/{{.RPC.Method}}/{{.Instance}}">/{{.RPC.Service}}/{{.RPC.Method}}{{with .Instance}} ({{.}}){{end}}</h2>
+{{with .Slowest}}
+<h3>Slowest</h3>
+<table>
+<tr><th class="name">Completed</th><th>Duration</th><th class="name">Code</th><th class="name">Peer</th><th class="name">Error</th></tr>
+{{range .}}<tr><td class="name">{{.Time.Format "15:04:05.000"}}</td><td>{{.Duration}}</td><td class="name">{{.Code}}</td><td class="name">{{.Peer}}</td><td class="name">{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Failed}}
+<h3>Recently failed</h3>
+<table>
+<tr><th class="name">Completed</th><th>Duration</th><th class="name">Code</th><th class="name">Peer</th><th class="name">Error</th></tr>
+{{range .}}<tr><td class="name">{{.Time.Format "15:04:05.000"}}</td><td>{{.Duration}}</td><td class="name">{{.Code}}</td><td class="name">{{.Peer}}</td><td class="name">{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,60 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestDebugRecorderKeepsSlowestAndFailed(t *testing.T) {
+	d := newDebugRecorder(2)
+	rpc := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+	for _, ms := range []time.Duration{1, 3, 2} {
+		d.record(rpc, ms*time.Millisecond, nil, "")
+	}
+	for _, msg := range []string{"first", "second", "third"} {
+		d.record(rpc, 0, status.New(codes.Unavailable, msg), "")
+	}
+
+	slowest, failed := d.kept(rpc)
+	require.Len(t, slowest, 2)
+	require.Equal(t, 3*time.Millisecond, slowest[0].Duration)
+	require.Equal(t, 2*time.Millisecond, slowest[1].Duration)
+	require.Len(t, failed, 2)
+	require.Equal(t, "third", failed[0].Error, "the most recent failure must come first")
+	require.Equal(t, "second", failed[1].Error)
+
+	d.setKeep(1)
+	slowest, failed = d.kept(rpc)
+	require.Len(t, slowest, 1)
+	require.Equal(t, "third", failed[0].Error)
+}
+
+func TestServerMetricsDebugHandler(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableHandlingTimeHistogram()
+	handler := m.DebugHandler(10)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/mwitkow.testproto.TestService/PingError"}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}})
+	m.UnaryServerInterceptor()(ctx, nil, info, func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.FailedPrecondition, "no <kittens> left")
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/grpc", nil))
+	body := w.Body.String()
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Contains(t, body, "PingError")
+	require.Contains(t, body, "<th>FailedPrecondition</th>")
+	require.Contains(t, body, "10.0.0.1:1234")
+	require.Contains(t, body, "no &lt;kittens&gt; left", "error messages must be escaped")
+}
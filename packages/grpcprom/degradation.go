@@ -0,0 +1,393 @@
+package grpcprom
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// degradationSlots is the number of slots the window of the error ratio is
+// divided in. The ratio is re-evaluated every slot while a service is
+// degraded.
+const degradationSlots = 10
+
+// HealthDegradation configures EnableHealthDegradation.
+type HealthDegradation struct {
+	// Window is the time over which the error ratio of a service is
+	// computed. Defaults to a minute, and is at least 10ms.
+	Window time.Duration
+	// Threshold is the error ratio, above 0 and at most 1, at or above which
+	// a service is set to NOT_SERVING.
+	Threshold float64
+	// RecoverThreshold is the error ratio, below Threshold, at or below which
+	// a degraded service is set back to its status before being degraded.
+	// Defaults to half of Threshold, so that a ratio hovering around
+	// Threshold does not flap.
+	RecoverThreshold float64
+	// MinRequests is the number of RPCs a service needs to have handled
+	// over the window for its error ratio to be trusted. Below it, a service
+	// is not degraded, and a degraded service is restored, e.g. once load
+	// balancers have drained it. Defaults to 10.
+	MinRequests int
+	// BadCodes are the codes counted as errors. Defaults to
+	// DefaultSLIBadCodes.
+	BadCodes []codes.Code
+}
+
+func (d HealthDegradation) withDefaults() HealthDegradation {
+	if d.Window <= 0 {
+		d.Window = time.Minute
+	}
+	if d.RecoverThreshold == 0 {
+		d.RecoverThreshold = d.Threshold / 2
+	}
+	if d.MinRequests <= 0 {
+		d.MinRequests = 10
+	}
+	if d.BadCodes == nil {
+		d.BadCodes = DefaultSLIBadCodes
+	}
+	return d
+}
+
+// validate reports an error if the thresholds of d, with defaults applied,
+// are out of range.
+func (d HealthDegradation) validate() error {
+	if !(d.Threshold > 0 && d.Threshold <= 1) {
+		return fmt.Errorf("grpcprom: degradation threshold %v out of (0, 1]", d.Threshold)
+	}
+	if !(d.RecoverThreshold >= 0 && d.RecoverThreshold < d.Threshold) {
+		return fmt.Errorf("grpcprom: degradation recover threshold %v out of [0, %v)", d.RecoverThreshold, d.Threshold)
+	}
+	return nil
+}
+
+// ServingStatusSetter sets the serving status of the services of a health
+// server, like health.Server and HealthServer.
+type ServingStatusSetter interface {
+	SetServingStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus)
+}
+
+// servingStatusChecker reads the serving status of a service, like
+// health.Server and HealthServer.
+type servingStatusChecker interface {
+	Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error)
+}
+
+// healthDegrader sets services to NOT_SERVING while their error ratio is too
+// high, and back to their previous status once it dropped.
+type healthDegrader struct {
+	setter ServingStatusSetter
+	config HealthDegradation
+	server string
+	slot   time.Duration
+	// metrics count the transitions made.
+	metrics *healthDegradations
+
+	mu       sync.Mutex
+	services map[string]*serviceErrors
+	// pending are the transitions decided but not applied yet, in order.
+	pending []degradation
+	// timer re-evaluates the degraded services, which may no longer receive
+	// RPCs to be re-evaluated on.
+	timer   *time.Timer
+	stopped bool
+
+	// setMu serializes applying transitions, so that they are applied in the
+	// order they were decided in, without holding mu while calling the
+	// setter. previous are the statuses of the degraded services before
+	// being degraded, guarded by setMu.
+	setMu    sync.Mutex
+	previous map[string]healthpb.HealthCheckResponse_ServingStatus
+}
+
+// degradation is a transition of a service, degrading it or restoring it.
+type degradation struct {
+	service  string
+	degraded bool
+}
+
+// serviceErrors are the RPCs and errors of a service over the window, in a
+// ring of slots.
+type serviceErrors struct {
+	slots    [degradationSlots]errorSlot
+	degraded bool
+}
+
+type errorSlot struct {
+	// index is the number of the slot since the Unix epoch.
+	index      int64
+	total, bad int
+}
+
+func newHealthDegrader(setter ServingStatusSetter, config HealthDegradation, server string, metrics *healthDegradations) (*healthDegrader, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	slot := config.Window / degradationSlots
+	if slot < time.Millisecond {
+		slot = time.Millisecond
+	}
+	return &healthDegrader{
+		setter:   setter,
+		config:   config,
+		server:   server,
+		slot:     slot,
+		metrics:  metrics,
+		services: make(map[string]*serviceErrors),
+		previous: make(map[string]healthpb.HealthCheckResponse_ServingStatus),
+	}, nil
+}
+
+// observe counts an RPC of service handled with code, and degrades or
+// restores the service accordingly.
+func (d *healthDegrader) observe(service string, code codes.Code) {
+	bad := false
+	for _, c := range d.config.BadCodes {
+		if c == code {
+			bad = true
+			break
+		}
+	}
+	now := time.Now()
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	s, ok := d.services[service]
+	if !ok {
+		s = &serviceErrors{}
+		d.services[service] = s
+	}
+	index := now.UnixNano() / int64(d.slot)
+	slot := &s.slots[index%degradationSlots]
+	if slot.index != index {
+		*slot = errorSlot{index: index}
+	}
+	slot.total++
+	if bad {
+		slot.bad++
+	}
+	d.evaluate(service, s, now)
+	d.mu.Unlock()
+	d.apply()
+}
+
+// counts returns the RPCs and errors of s over the window ending now.
+func (d *healthDegrader) counts(s *serviceErrors, now time.Time) (total, bad int) {
+	index := now.UnixNano() / int64(d.slot)
+	for _, slot := range s.slots {
+		if index-slot.index < degradationSlots {
+			total += slot.total
+			bad += slot.bad
+		}
+	}
+	return total, bad
+}
+
+func errorRatio(total, bad int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total)
+}
+
+// evaluate decides whether to degrade or restore service, to be applied by
+// apply. It must be called with d.mu held.
+func (d *healthDegrader) evaluate(service string, s *serviceErrors, now time.Time) {
+	total, bad := d.counts(s, now)
+	trusted := total >= d.config.MinRequests
+	ratio := errorRatio(total, bad)
+	switch {
+	case !s.degraded && trusted && ratio >= d.config.Threshold:
+		s.degraded = true
+		d.pending = append(d.pending, degradation{service: service, degraded: true})
+		if d.timer == nil {
+			d.timer = time.AfterFunc(d.slot, d.reevaluate)
+		}
+	case s.degraded && (!trusted || ratio <= d.config.RecoverThreshold):
+		s.degraded = false
+		d.pending = append(d.pending, degradation{service: service})
+	}
+}
+
+// apply applies the pending transitions, in order. It must be called without
+// d.mu held, as the setter may take time or call back into the metrics.
+func (d *healthDegrader) apply() {
+	d.setMu.Lock()
+	defer d.setMu.Unlock()
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+	for _, p := range pending {
+		if p.degraded {
+			d.previous[p.service] = d.status(p.service)
+			d.set(p.service, healthpb.HealthCheckResponse_NOT_SERVING)
+		} else if previous, ok := d.previous[p.service]; ok {
+			delete(d.previous, p.service)
+			d.set(p.service, previous)
+		}
+	}
+}
+
+// status returns the serving status of service, or SERVING if the setter
+// cannot tell or does not know the service.
+func (d *healthDegrader) status(service string) healthpb.HealthCheckResponse_ServingStatus {
+	if c, ok := d.setter.(servingStatusChecker); ok {
+		resp, err := c.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err == nil {
+			return resp.GetStatus()
+		}
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+func (d *healthDegrader) set(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	d.setter.SetServingStatus(service, status)
+	d.metrics.transitions.WithLabelValues(d.metrics.labels.values(d.server, service, status.String())...).Inc()
+}
+
+// reevaluate re-evaluates the degraded services every slot, until none is.
+func (d *healthDegrader) reevaluate() {
+	now := time.Now()
+	d.mu.Lock()
+	d.timer = nil
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	degraded := false
+	for service, s := range d.services {
+		if s.degraded {
+			d.evaluate(service, s, now)
+			degraded = degraded || s.degraded
+		}
+	}
+	if degraded && d.timer == nil {
+		d.timer = time.AfterFunc(d.slot, d.reevaluate)
+	}
+	d.mu.Unlock()
+	d.apply()
+}
+
+// stop stops degrading services, and restores those that are.
+func (d *healthDegrader) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	for service, s := range d.services {
+		if s.degraded {
+			s.degraded = false
+			d.pending = append(d.pending, degradation{service: service})
+		}
+	}
+	d.mu.Unlock()
+	d.apply()
+}
+
+// healthDegradations are the degraders of a ServerMetrics and its views,
+// exporting the error ratio and state of every service observed and counting
+// the transitions made.
+type healthDegradations struct {
+	ratio       *prom.Desc
+	degraded    *prom.Desc
+	transitions *prom.CounterVec
+	labels      serverLabel
+
+	mu        sync.Mutex
+	degraders map[string]*healthDegrader
+}
+
+func newHealthDegradations(opts prom.CounterOpts, labels serverLabel) *healthDegradations {
+	name := func(name string) string {
+		return prom.BuildFQName(opts.Namespace, opts.Subsystem, name)
+	}
+	return &healthDegradations{
+		ratio: prom.NewDesc(name("grpc_server_health_degradation_error_ratio"),
+			"Ratio of RPCs of the service handled with an error over the degradation window.",
+			labels.names("grpc_service"), opts.ConstLabels),
+		degraded: prom.NewDesc(name("grpc_server_health_degraded"),
+			"Whether the service is set to NOT_SERVING because of its error ratio (1) or not (0).",
+			labels.names("grpc_service"), opts.ConstLabels),
+		transitions: prom.NewCounterVec(prom.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "grpc_server_health_degradation_transitions_total",
+			Help:        "Total number of times the service was set to the serving status because of its error ratio.",
+			ConstLabels: opts.ConstLabels,
+		}, labels.names("grpc_service", "status")),
+		labels:    labels,
+		degraders: make(map[string]*healthDegrader),
+	}
+}
+
+// replace makes d the degrader of server, stopping the previous one. d may
+// be nil.
+func (h *healthDegradations) replace(server string, d *healthDegrader) {
+	h.mu.Lock()
+	previous := h.degraders[server]
+	if d != nil {
+		h.degraders[server] = d
+	} else {
+		delete(h.degraders, server)
+	}
+	h.mu.Unlock()
+	if previous != nil {
+		previous.stop()
+	}
+}
+
+// Reset deletes the counts of transitions.
+func (h *healthDegradations) Reset() {
+	h.transitions.Reset()
+}
+
+// Describe implements prom.Collector.
+func (h *healthDegradations) Describe(ch chan<- *prom.Desc) {
+	ch <- h.ratio
+	ch <- h.degraded
+	h.transitions.Describe(ch)
+}
+
+// Collect implements prom.Collector. The values of every degrader are read
+// under its mutex and sent after releasing it, so that a slow scrape doesn't
+// block the RPCs it observes.
+func (h *healthDegradations) Collect(ch chan<- prom.Metric) {
+	h.mu.Lock()
+	degraders := make([]*healthDegrader, 0, len(h.degraders))
+	for _, d := range h.degraders {
+		degraders = append(degraders, d)
+	}
+	h.mu.Unlock()
+	now := time.Now()
+	var metrics []prom.Metric
+	for _, d := range degraders {
+		d.mu.Lock()
+		for service, s := range d.services {
+			degraded := 0.0
+			if s.degraded {
+				degraded = 1
+			}
+			metrics = append(metrics,
+				prom.MustNewConstMetric(h.ratio, prom.GaugeValue, errorRatio(d.counts(s, now)), h.labels.values(d.server, service)...),
+				prom.MustNewConstMetric(h.degraded, prom.GaugeValue, degraded, h.labels.values(d.server, service)...))
+		}
+		d.mu.Unlock()
+	}
+
+	for _, m := range metrics {
+		ch <- m
+	}
+	h.transitions.Collect(ch)
+}
@@ -0,0 +1,150 @@
+package grpcprom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestServerMetricsHealthDegradation(t *testing.T) {
+	m := NewServerMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+	h := health.NewServer()
+	const service = "mwitkow.testproto.TestService"
+	h.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	require.NoError(t, m.EnableHealthDegradation(h, HealthDegradation{Window: time.Second, Threshold: 0.5, MinRequests: 4}))
+
+	call := func(code codes.Code) {
+		info := &grpc.UnaryServerInfo{FullMethod: "/" + service + "/PingError"}
+		m.UnaryServerInterceptor()(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, status.Error(code, "")
+		})
+	}
+	servingStatus := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		return resp.GetStatus()
+	}
+
+	call(codes.Unavailable)
+	call(codes.Unavailable)
+	call(codes.NotFound)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(), "services must not be degraded below MinRequests")
+	call(codes.Unavailable)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus(), "3 errors out of 4 RPCs exceed the threshold")
+	require.EqualValues(t, 1, gatherMetric(t, reg, "grpc_server_health_degraded").GetGauge().GetValue())
+	require.EqualValues(t, 0.75, gatherMetric(t, reg, "grpc_server_health_degradation_error_ratio").GetGauge().GetValue())
+
+	call(codes.OK)
+	call(codes.OK)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus(),
+		"a ratio between the thresholds must not restore the service")
+
+	require.Eventually(t, func() bool {
+		return servingStatus() == healthpb.HealthCheckResponse_SERVING
+	}, 3*time.Second, 10*time.Millisecond, "drained services must be restored once the window passed")
+	transitions := map[string]float64{}
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "grpc_server_health_degradation_transitions_total" {
+			for _, metric := range mf.GetMetric() {
+				transitions[labelValueOf(metric, "status")] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	require.Equal(t, map[string]float64{"NOT_SERVING": 1, "SERVING": 1}, transitions)
+
+	for i := 0; i < 4; i++ {
+		call(codes.Internal)
+	}
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, servingStatus())
+	m.DisableHealthDegradation()
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, servingStatus(), "disabling must restore degraded services")
+}
+
+func TestServerMetricsHealthDegradationCollectDoesNotBlockRPCs(t *testing.T) {
+	m := NewServerMetrics()
+	const service = "mwitkow.testproto.TestService"
+	require.NoError(t, m.EnableHealthDegradation(health.NewServer(), HealthDegradation{Threshold: 0.5}))
+	t.Cleanup(m.DisableHealthDegradation)
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + service + "/PingError"}
+	call := func() {
+		m.UnaryServerInterceptor()(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, status.Error(codes.Unavailable, "")
+		})
+	}
+	call()
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.serverDegradations.Collect(ch)
+	}()
+	<-ch // The scrape is stalled sending the next metric.
+
+	called := make(chan struct{})
+	go func() {
+		call()
+		close(called)
+	}()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RPCs must not wait for the scrape")
+	}
+	for {
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestServerMetricsHealthDegradationRestoresPreviousStatus(t *testing.T) {
+	m := NewServerMetrics()
+	h := health.NewServer()
+	const service = "mwitkow.testproto.TestService"
+	h.SetServingStatus(service, healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+	require.NoError(t, m.EnableHealthDegradation(h, HealthDegradation{Threshold: 0.5, MinRequests: 1}))
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/" + service + "/PingError"}
+	m.UnaryServerInterceptor()(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Unavailable, "")
+	})
+	resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+
+	m.DisableHealthDegradation()
+	resp, err = h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVICE_UNKNOWN, resp.GetStatus(), "the status before degrading must be restored")
+}
+
+func TestServerMetricsHealthDegradationRejectsThresholds(t *testing.T) {
+	m := NewServerMetrics()
+	for _, d := range []HealthDegradation{
+		{},
+		{Threshold: 1.5},
+		{Threshold: -0.5},
+		{Threshold: 0.5, RecoverThreshold: 0.5},
+		{Threshold: 0.5, RecoverThreshold: -0.1},
+	} {
+		require.Error(t, m.EnableHealthDegradation(health.NewServer(), d), "%+v", d)
+	}
+	require.Nil(t, m.degrader.Load(), "rejected configurations must not be enabled")
+	require.NoError(t, m.EnableHealthDegradation(health.NewServer(), HealthDegradation{Window: time.Nanosecond, Threshold: 1}),
+		"windows too short to be divided must be rounded up")
+}
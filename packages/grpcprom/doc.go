@@ -0,0 +1,9 @@
+// Package grpcprom provides Prometheus monitoring for gRPC servers and
+// clients without any global state: importing it registers nothing, and
+// metrics are only exported once registered explicitly, e.g. with
+// ServerMetrics.RegisterTo.
+//
+// The top-level go-grpc-prometheus package is a thin wrapper around this one,
+// adding default metrics registered on the default Prometheus registry on
+// import.
+package grpcprom
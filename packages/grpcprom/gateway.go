@@ -0,0 +1,146 @@
+package grpcprom
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// gatewayCallKey is the context key of the gatewayCall of an HTTP request.
+type gatewayCallKey struct{}
+
+// gatewayCall is the RPC of an HTTP request served by HTTPGatewayMiddleware,
+// reported once grpc-gateway routed the request to a method.
+type gatewayCall struct {
+	metrics *ServerMetrics
+	start   time.Time
+	monitor *serverReporter
+}
+
+// HTTPGatewayMiddleware returns an http.Handler recording the requests
+// served by next, a grpc-gateway ServeMux, into the grpc_server metrics under
+// grpc_type="http_gateway". Unlike the interceptors, it observes the latency
+// seen by HTTP clients, including JSON transcoding.
+//
+// Requests are labeled with the gRPC method the gateway routed them to, which
+// the ServeMux must tell with GatewayAnnotator; requests not routed to a
+// method are not recorded. The HTTP status of the response is mapped back to
+// grpc_code. They are not observed by EnableHealthDegradation, since the
+// gateway may also call the server through its interceptors.
+func (m *ServerMetrics) HTTPGatewayMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := &gatewayCall{metrics: m, start: time.Now()}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), gatewayCallKey{}, call)))
+		if call.monitor == nil {
+			return
+		}
+		code := codeOfHTTPStatus(rec.status)
+		if code == codes.OK {
+			call.monitor.SentMessage()
+		}
+		// The gateway writes the error of the RPC into the response, so its
+		// hooks get the status mapped from the HTTP status instead.
+		st := status.New(code, http.StatusText(rec.status))
+		call.monitor.Handled(st, st.Err())
+	})
+}
+
+// GatewayAnnotator returns a grpc-gateway metadata annotator telling
+// HTTPGatewayMiddleware the method a request was routed to, as returned by
+// rpcMethod, e.g.:
+//
+//	mux := runtime.NewServeMux(runtime.WithMetadata(grpcprom.GatewayAnnotator(runtime.RPCMethod)))
+//	http.ListenAndServe(addr, metrics.HTTPGatewayMiddleware(mux))
+//
+// It adds no metadata.
+func GatewayAnnotator(rpcMethod func(context.Context) (string, bool)) func(context.Context, *http.Request) metadata.MD {
+	return func(ctx context.Context, _ *http.Request) metadata.MD {
+		call, ok := ctx.Value(gatewayCallKey{}).(*gatewayCall)
+		if !ok || call.monitor != nil {
+			return nil
+		}
+		method, ok := rpcMethod(ctx)
+		if !ok {
+			return nil
+		}
+		// Gateway requests are proxied to the gRPC server, whose interceptors
+		// already degrade the health of its services.
+		call.monitor = newServerReporter(ctx, call.metrics, HTTPGateway, method, nil)
+		if !call.monitor.startTime.IsZero() {
+			call.monitor.startTime = call.start
+		}
+		call.monitor.ReceivedMessage()
+		return nil
+	}
+}
+
+// codeOfHTTPStatus returns the code grpc-gateway responds to with the HTTP
+// status s. Where the gateway maps several codes to s, it returns one of
+// them.
+func codeOfHTTPStatus(s int) codes.Code {
+	if s >= 200 && s < 300 {
+		return codes.OK
+	}
+	switch s {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case 499:
+		return codes.Canceled
+	case http.StatusInternalServerError:
+		return codes.Internal
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Unknown
+}
+
+// statusRecorder records the status of an HTTP response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush flushes streamed responses, e.g. of server streaming methods.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the wrapped ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
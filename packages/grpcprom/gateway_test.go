@@ -0,0 +1,73 @@
+package grpcprom
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// rpcMethodKey is the context key of the method of fakeGateway, like the
+// one of runtime.RPCMethod.
+type rpcMethodKey struct{}
+
+func rpcMethodOf(ctx context.Context) (string, bool) {
+	method, ok := ctx.Value(rpcMethodKey{}).(string)
+	return method, ok
+}
+
+// fakeGateway routes requests like a grpc-gateway ServeMux annotated with
+// GatewayAnnotator, responding with the status given in the path.
+func fakeGateway() http.Handler {
+	annotate := GatewayAnnotator(rpcMethodOf)
+	mux := http.NewServeMux()
+	route := func(pattern, method string, status int) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			annotate(context.WithValue(r.Context(), rpcMethodKey{}, method), r)
+			w.WriteHeader(status)
+		})
+	}
+	route("/v1/ping", "/mwitkow.testproto.TestService/Ping", http.StatusOK)
+	route("/v1/ping/missing", "/mwitkow.testproto.TestService/Ping", http.StatusNotFound)
+	route("/v1/error", "/mwitkow.testproto.TestService/PingError", http.StatusServiceUnavailable)
+	return mux
+}
+
+func TestServerMetricsHTTPGatewayMiddleware(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableHandlingTimeHistogram()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+	handler := m.HTTPGatewayMiddleware(fakeGateway())
+
+	for _, path := range []string{"/v1/ping", "/v1/ping", "/v1/ping/missing", "/v1/error", "/v1/unrouted"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	handled := map[string]float64{}
+	for _, metric := range gatherMetrics(t, reg, "grpc_server_handled_total") {
+		require.Equal(t, "http_gateway", labelValueOf(metric, "grpc_type"))
+		handled[labelValueOf(metric, "grpc_method")+"/"+labelValueOf(metric, "grpc_code")] = metric.GetCounter().GetValue()
+	}
+	require.Equal(t, map[string]float64{
+		"Ping/OK":               2,
+		"Ping/NotFound":         1,
+		"PingError/Unavailable": 1,
+	}, handled, "HTTP statuses must be mapped to codes, and unrouted requests not recorded")
+
+	started := gatherMetrics(t, reg, "grpc_server_started_total")
+	require.Len(t, started, 2)
+	sent := map[string]float64{}
+	for _, metric := range gatherMetrics(t, reg, "grpc_server_msg_sent_total") {
+		sent[labelValueOf(metric, "grpc_method")] = metric.GetCounter().GetValue()
+	}
+	require.Equal(t, map[string]float64{"Ping": 2}, sent, "only successful responses must count as sent")
+	for _, metric := range gatherMetrics(t, reg, "grpc_server_handling_seconds") {
+		if labelValueOf(metric, "grpc_method") == "Ping" {
+			require.EqualValues(t, 3, metric.GetHistogram().GetSampleCount())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package grpcprom
+
+import (
+	"sync"
+	"sync/atomic"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// The Prometheus reporters resolve the metrics of a method once and cache
+// them in a handleCache, so that reporting an event is an atomic add rather
+// than hashing label values and locking a vector.
+
+// handleCache maps RPCs to their resolved metric handles. It is safe for
+// concurrent use. Resetting the metrics deletes the series the handles refer
+// to, so the cache is reset along with them. Handles may still be held by
+// in-flight RPCs, so the counters they resolved are also tied to a generation
+// of the cache, and resolved again once series were deleted.
+type handleCache struct {
+	m   atomic.Pointer[sync.Map]
+	gen atomic.Uint64
+}
+
+func newHandleCache() *handleCache {
+	c := &handleCache{}
+	c.reset()
+	return c
+}
+
+// load returns the handles of rpc, storing the result of create if there are
+// none yet.
+func (c *handleCache) load(rpc RPC, create func(RPC) interface{}) interface{} {
+	m := c.m.Load()
+	if h, ok := m.Load(rpc); ok {
+		return h
+	}
+	h, _ := m.LoadOrStore(rpc, create(rpc))
+	return h
+}
+
+// delete drops the handles of rpc, whose series were deleted.
+func (c *handleCache) delete(rpc RPC) {
+	c.m.Load().Delete(rpc)
+	c.gen.Add(1)
+}
+
+func (c *handleCache) reset() {
+	c.m.Store(&sync.Map{})
+	c.gen.Add(1)
+}
+
+// lazyCounter is a counter of a vector resolved on first use, so that caching
+// a method does not create series that were never incremented.
+type lazyCounter struct {
+	p atomic.Pointer[resolvedCounter]
+}
+
+// resolvedCounter is a counter resolved in a generation of a handleCache.
+type resolvedCounter struct {
+	gen uint64
+	c   prom.Counter
+}
+
+// get returns the counter of lvs in vec, resolved again if series were
+// deleted since it was cached in c.
+func (l *lazyCounter) get(c *handleCache, vec *prom.CounterVec, lvs []string) prom.Counter {
+	gen := c.gen.Load()
+	if r := l.p.Load(); r != nil && r.gen == gen {
+		return r.c
+	}
+	r := &resolvedCounter{gen: gen, c: vec.WithLabelValues(lvs...)}
+	l.p.Store(r)
+	return r.c
+}
+
+// codeCounters are the counters of a vector with a trailing grpc_code label,
+// one per code.
+type codeCounters [17]lazyCounter
+
+func (cc *codeCounters) get(c *handleCache, vec *prom.CounterVec, lvs []string, code codes.Code) prom.Counter {
+	gen := c.gen.Load()
+	cached := int(code) < len(cc)
+	if cached {
+		if r := cc[code].p.Load(); r != nil && r.gen == gen {
+			return r.c
+		}
+	}
+	r := &resolvedCounter{gen: gen, c: vec.WithLabelValues(append(lvs[:len(lvs):len(lvs)], code.String())...)}
+	if cached {
+		cc[code].p.Store(r)
+	}
+	return r.c
+}
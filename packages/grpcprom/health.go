@@ -0,0 +1,180 @@
+package grpcprom
+
+import (
+	"context"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// servingStatuses are the statuses exported for every service, so that the
+// statuses a service is not in are exported as zero.
+var servingStatuses = []healthpb.HealthCheckResponse_ServingStatus{
+	healthpb.HealthCheckResponse_UNKNOWN,
+	healthpb.HealthCheckResponse_SERVING,
+	healthpb.HealthCheckResponse_NOT_SERVING,
+	healthpb.HealthCheckResponse_SERVICE_UNKNOWN,
+}
+
+// HealthServer is a health.Server whose serving statuses are exported by the
+// ServerMetrics that returned it as grpc_server_health_status, with the
+// transitions between them counted in
+// grpc_server_health_status_transitions_total. It is registered and updated
+// in place of the health.Server it wraps.
+type HealthServer struct {
+	*health.Server
+	tracker *healthTracker
+	metrics *ServerMetrics
+
+	// statuses are the last statuses seen of the services, guarded by the
+	// mutex of the tracker.
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+}
+
+// healthTracker collects the statuses of the health servers of a
+// ServerMetrics and its views.
+type healthTracker struct {
+	status      *prom.Desc
+	transitions *prom.CounterVec
+	labels      serverLabel
+
+	mu      sync.Mutex
+	servers []*HealthServer
+}
+
+func newHealthTracker(opts prom.CounterOpts, labels serverLabel) *healthTracker {
+	return &healthTracker{
+		status: prom.NewDesc(prom.BuildFQName(opts.Namespace, opts.Subsystem, "grpc_server_health_status"),
+			"Whether the health-checked service is in the serving status (1) or not (0).",
+			labels.names("grpc_service", "status"), opts.ConstLabels),
+		transitions: prom.NewCounterVec(prom.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        "grpc_server_health_status_transitions_total",
+			Help:        "Total number of times the health-checked service entered the serving status.",
+			ConstLabels: opts.ConstLabels,
+		}, labels.names("grpc_service", "status")),
+		labels: labels,
+	}
+}
+
+// InstrumentHealthServer returns a HealthServer wrapping h, whose statuses
+// are exported by m, labeled by the grpc_server label of m if any. Register
+// and update the returned HealthServer instead of h:
+//
+//	hs := metrics.InstrumentHealthServer(health.NewServer())
+//	healthpb.RegisterHealthServer(server, hs)
+//	hs.SetServingStatus("package.Service", healthpb.HealthCheckResponse_SERVING)
+//
+// Statuses set on h directly are still exported, at the next scrape, for the
+// overall server, the services passed to InitializeMetrics and those set
+// through the HealthServer. If h is nil, a new health.Server is wrapped.
+func (m *ServerMetrics) InstrumentHealthServer(h *health.Server) *HealthServer {
+	if h == nil {
+		h = health.NewServer()
+	}
+	s := &HealthServer{
+		Server:   h,
+		tracker:  m.serverHealth,
+		metrics:  m,
+		statuses: make(map[string]healthpb.HealthCheckResponse_ServingStatus),
+	}
+	m.serverHealth.mu.Lock()
+	defer m.serverHealth.mu.Unlock()
+	s.update("")
+	m.serverHealth.servers = append(m.serverHealth.servers, s)
+	return s
+}
+
+// SetServingStatus sets the serving status of service, counting a transition
+// if it changed.
+func (s *HealthServer) SetServingStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus) {
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	s.Server.SetServingStatus(service, servingStatus)
+	s.update(service)
+}
+
+// Shutdown sets all serving statuses to NOT_SERVING and ignores later
+// changes until Resume, counting the transitions.
+func (s *HealthServer) Shutdown() {
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	s.Server.Shutdown()
+	for service := range s.statuses {
+		s.update(service)
+	}
+}
+
+// Resume sets all serving statuses to SERVING and accepts later changes
+// again, counting the transitions.
+func (s *HealthServer) Resume() {
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	s.Server.Resume()
+	for service := range s.statuses {
+		s.update(service)
+	}
+}
+
+// update reads the status of service from the health server, counting a
+// transition if it changed. Services unknown to the health server are not
+// tracked. It must be called with the mutex of the tracker held.
+func (s *HealthServer) update(service string) {
+	resp, err := s.Server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return
+	}
+	status := resp.GetStatus()
+	if last, ok := s.statuses[service]; ok && last == status {
+		return
+	}
+	s.statuses[service] = status
+	s.tracker.transitions.WithLabelValues(s.tracker.labels.values(s.metrics.server, service, status.String())...).Inc()
+}
+
+// Reset deletes the counts of transitions. The current statuses remain
+// exported.
+func (t *healthTracker) Reset() {
+	t.transitions.Reset()
+}
+
+// Describe implements prom.Collector.
+func (t *healthTracker) Describe(ch chan<- *prom.Desc) {
+	ch <- t.status
+	t.transitions.Describe(ch)
+}
+
+// Collect implements prom.Collector. Statuses set on the wrapped health
+// servers directly are picked up here. The statuses are read under the mutex
+// and sent after releasing it, so that a slow scrape doesn't block
+// SetServingStatus.
+func (t *healthTracker) Collect(ch chan<- prom.Metric) {
+	var metrics []prom.Metric
+	t.mu.Lock()
+	for _, s := range t.servers {
+		s.update("")
+		for _, rpc := range s.metrics.initialized.list() {
+			if rpc.Server == s.metrics.server {
+				s.update(rpc.Service)
+			}
+		}
+		for service, current := range s.statuses {
+			for _, status := range servingStatuses {
+				value := 0.0
+				if status == current {
+					value = 1
+				}
+				metrics = append(metrics, prom.MustNewConstMetric(t.status, prom.GaugeValue, value, t.labels.values(s.metrics.server, service, status.String())...))
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for _, m := range metrics {
+		ch <- m
+	}
+	t.transitions.Collect(ch)
+}
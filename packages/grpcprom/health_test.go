@@ -0,0 +1,121 @@
+package grpcprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestServerMetricsHealthStatus(t *testing.T) {
+	m := NewServerMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	h := health.NewServer()
+	hs := m.InstrumentHealthServer(h)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, hs)
+	m.InitializeMetrics(server)
+
+	hs.SetServingStatus("mwitkow.testproto.TestService", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("mwitkow.testproto.TestService", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("mwitkow.testproto.TestService", healthpb.HealthCheckResponse_SERVING)
+	h.SetServingStatus("grpc.health.v1.Health", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	require.Equal(t, map[string]string{
+		"":                              "SERVING",
+		"mwitkow.testproto.TestService": "SERVING",
+		"grpc.health.v1.Health":         "NOT_SERVING",
+	}, healthStatuses(t, reg), "statuses set directly on initialized services must be exported too")
+	require.Equal(t, map[string]float64{
+		"/SERVING": 1,
+		"mwitkow.testproto.TestService/NOT_SERVING": 1,
+		"mwitkow.testproto.TestService/SERVING":     1,
+		"grpc.health.v1.Health/NOT_SERVING":         1,
+	}, healthTransitions(t, reg), "setting the same status again must not count a transition")
+
+	hs.Shutdown()
+	require.Equal(t, map[string]string{
+		"":                              "NOT_SERVING",
+		"mwitkow.testproto.TestService": "NOT_SERVING",
+		"grpc.health.v1.Health":         "NOT_SERVING",
+	}, healthStatuses(t, reg))
+	require.EqualValues(t, 1, healthTransitions(t, reg)["/NOT_SERVING"])
+
+	m.Reset()
+	require.Empty(t, healthTransitions(t, reg), "Reset must delete the transitions")
+	require.Len(t, healthStatuses(t, reg), 3, "Reset must keep the statuses")
+}
+
+func TestServerMetricsHealthStatusCollectDoesNotBlockUpdates(t *testing.T) {
+	m := NewServerMetrics()
+	hs := m.InstrumentHealthServer(nil)
+	hs.SetServingStatus("mwitkow.testproto.TestService", healthpb.HealthCheckResponse_SERVING)
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.serverHealth.Collect(ch)
+	}()
+	<-ch // The scrape is stalled sending the next metric.
+
+	updated := make(chan struct{})
+	go func() {
+		hs.SetServingStatus("mwitkow.testproto.TestService", healthpb.HealthCheckResponse_NOT_SERVING)
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetServingStatus must not wait for the scrape")
+	}
+	for {
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+	}
+}
+
+// healthStatuses returns the status of every service exported with value 1.
+func healthStatuses(t *testing.T, reg prometheus.Gatherer) map[string]string {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	statuses := map[string]string{}
+	for _, mf := range mfs {
+		if mf.GetName() != "grpc_server_health_status" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			if metric.GetGauge().GetValue() == 1 {
+				service := labelValueOf(metric, "grpc_service")
+				require.NotContains(t, statuses, service, "services must have a single status")
+				statuses[service] = labelValueOf(metric, "status")
+			}
+		}
+	}
+	return statuses
+}
+
+// healthTransitions returns the transitions counted by service and status.
+func healthTransitions(t *testing.T, reg prometheus.Gatherer) map[string]float64 {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	transitions := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "grpc_server_health_status_transitions_total" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			transitions[labelValueOf(metric, "grpc_service")+"/"+labelValueOf(metric, "status")] = metric.GetCounter().GetValue()
+		}
+	}
+	return transitions
+}
@@ -0,0 +1,339 @@
+package grpcprom
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramVec is a prom.HistogramVec that can be enabled, disabled and
+// re-bucketed at runtime, concurrently with observations and collection.
+//
+// It always describes its descriptor, whether enabled or not, so that a
+// registry checks it consistently regardless of when it is enabled. As a
+// consequence, only the buckets may change once it is registered: other
+// options change the descriptor, which the registry rejects on collection.
+//
+// Methods matching the pattern of an override are observed by the vector of
+// the override instead, so that they can use different buckets. Methods
+// matching the pattern of a sampling rule only observe one in every so many
+// observations, which are exported scaled up accordingly.
+type histogramVec struct {
+	labelNames []string
+
+	mu        sync.RWMutex
+	enabled   bool
+	opts      prom.HistogramOpts
+	vec       *prom.HistogramVec
+	overrides []histogramOverride
+	samples   []histogramSample
+
+	// gen is incremented under mu whenever observers previously returned may
+	// no longer be the ones to observe, invalidating histogramHandles.
+	gen atomic.Uint64
+}
+
+// histogramSample is the sampling rule of the methods matching pattern: only
+// one in every `every` observations is made.
+type histogramSample struct {
+	pattern string
+	every   uint64
+}
+
+// histogramHandle is the observer of a method resolved by a histogramVec,
+// valid as long as the generation of the histogramVec is unchanged.
+type histogramHandle struct {
+	gen   uint64
+	obs   prom.Observer // nil while disabled
+	every uint64
+	n     atomic.Uint64
+}
+
+// histogramOverride is the vector observing the methods matching pattern, a
+// path.Match pattern of full method names such as "/package.Service/*".
+type histogramOverride struct {
+	pattern string
+	vec     *prom.HistogramVec
+}
+
+func newHistogramVec(opts prom.HistogramOpts, labelNames ...string) *histogramVec {
+	return &histogramVec{
+		labelNames: labelNames,
+		opts:       opts,
+		vec:        prom.NewHistogramVec(opts, labelNames),
+	}
+}
+
+// enable applies opts and turns on recording. It returns the resulting
+// options. Changing the options replaces the underlying vector, discarding
+// everything observed so far, as observations cannot be redistributed over
+// new buckets.
+func (h *histogramVec) enable(opts ...HistogramOption) prom.HistogramOpts {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	newOpts := h.opts
+	for _, o := range opts {
+		o(&newOpts)
+	}
+	if !reflect.DeepEqual(newOpts, h.opts) {
+		h.opts = newOpts
+		h.vec = prom.NewHistogramVec(newOpts, h.labelNames)
+	}
+	h.enabled = true
+	h.gen.Add(1)
+	return h.opts
+}
+
+// override makes the methods matching pattern be observed with opts, applied
+// on top of the current options. Overriding the same pattern again replaces
+// its options; otherwise the first matching override applies. Adding an
+// override discards the observations of the default vector, as some of its
+// methods may be observed by the override from now on.
+func (h *histogramVec) override(pattern string, opts ...HistogramOption) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	newOpts := h.opts
+	for _, o := range opts {
+		o(&newOpts)
+	}
+	vec := prom.NewHistogramVec(newOpts, h.labelNames)
+	for i := range h.overrides {
+		if h.overrides[i].pattern == pattern {
+			h.overrides[i].vec = vec
+			h.gen.Add(1)
+			return nil
+		}
+	}
+	h.overrides = append(h.overrides, histogramOverride{pattern: pattern, vec: vec})
+	h.vec.Reset()
+	h.gen.Add(1)
+	return nil
+}
+
+// vecFor returns the vector observing the method of rpc. h.mu must be held.
+func (h *histogramVec) vecFor(rpc RPC) *prom.HistogramVec {
+	if len(h.overrides) > 0 {
+		fullMethod := "/" + rpc.Service + "/" + rpc.Method
+		for _, o := range h.overrides {
+			if ok, _ := path.Match(o.pattern, fullMethod); ok {
+				return o.vec
+			}
+		}
+	}
+	return h.vec
+}
+
+// sample makes the methods matching pattern only observe one in every `every`
+// observations. Sampling the same pattern again replaces its rate; otherwise
+// the first matching rule applies. As the exported histograms are scaled by
+// the rate, changing sampling discards the observations made so far.
+func (h *histogramVec) sample(pattern string, every int) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	if every < 1 {
+		return fmt.Errorf("grpcprom: sampling one in %d observations", every)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	replaced := false
+	for i := range h.samples {
+		if h.samples[i].pattern == pattern {
+			h.samples[i].every = uint64(every)
+			replaced = true
+		}
+	}
+	if !replaced {
+		h.samples = append(h.samples, histogramSample{pattern: pattern, every: uint64(every)})
+	}
+	h.vec.Reset()
+	for _, o := range h.overrides {
+		o.vec.Reset()
+	}
+	h.gen.Add(1)
+	return nil
+}
+
+// everyFor returns the sampling rate of a full method name, 1 if it is not
+// sampled. h.mu must be held.
+func (h *histogramVec) everyFor(fullMethod string) uint64 {
+	for _, s := range h.samples {
+		if ok, _ := path.Match(s.pattern, fullMethod); ok {
+			return s.every
+		}
+	}
+	return 1
+}
+
+// disable turns off recording and exporting. Observations made so far are
+// exported again once re-enabled with unchanged options.
+func (h *histogramVec) disable() {
+	h.mu.Lock()
+	h.enabled = false
+	h.gen.Add(1)
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) isEnabled() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.enabled
+}
+
+// observer returns the observer of the given label values of the method of
+// rpc, or nil when the histogram is disabled.
+func (h *histogramVec) observer(rpc RPC, lvs ...string) prom.Observer {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.enabled {
+		return nil
+	}
+	return h.vecFor(rpc).WithLabelValues(lvs...)
+}
+
+// resolve returns the observer of the given label values of the method of
+// rpc, or nil when the histogram is disabled or the next observation of a
+// sampled method is to be skipped. The observer is cached in handle and
+// reused until the histogram changes.
+func (h *histogramVec) resolve(handle *atomic.Pointer[histogramHandle], rpc RPC, lvs []string) prom.Observer {
+	c := handle.Load()
+	if c == nil || c.gen != h.gen.Load() {
+		h.mu.RLock()
+		c = &histogramHandle{gen: h.gen.Load(), every: 1}
+		if h.enabled {
+			c.obs = h.vecFor(rpc).WithLabelValues(lvs...)
+			c.every = h.everyFor("/" + rpc.Service + "/" + rpc.Method)
+		}
+		h.mu.RUnlock()
+		handle.Store(c)
+	}
+	if c.every > 1 && (c.n.Add(1)-1)%c.every != 0 {
+		return nil
+	}
+	return c.obs
+}
+
+// initialize pre-populates the given label values of the method of rpc if
+// enabled.
+func (h *histogramVec) initialize(rpc RPC, lvs ...string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.enabled {
+		h.vecFor(rpc).GetMetricWithLabelValues(lvs...)
+	}
+}
+
+// WithLabelValues returns the observer of the given label values of the
+// current default vector, whether enabled or not.
+func (h *histogramVec) WithLabelValues(lvs ...string) prom.Observer {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.vec.WithLabelValues(lvs...)
+}
+
+// deleteLabelValues deletes the series of the given label values of the
+// method of rpc.
+func (h *histogramVec) deleteLabelValues(rpc RPC, lvs ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.gen.Add(1)
+	h.vecFor(rpc).DeleteLabelValues(lvs...)
+}
+
+// Reset deletes all series of the current vectors.
+func (h *histogramVec) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.gen.Add(1)
+	h.vec.Reset()
+	for _, o := range h.overrides {
+		o.vec.Reset()
+	}
+}
+
+// Describe implements prom.Collector.
+func (h *histogramVec) Describe(ch chan<- *prom.Desc) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	h.vec.Describe(ch)
+	for _, o := range h.overrides {
+		o.vec.Describe(ch)
+	}
+}
+
+// Collect implements prom.Collector.
+func (h *histogramVec) Collect(ch chan<- prom.Metric) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.enabled {
+		h.collect(h.vec, ch)
+		for _, o := range h.overrides {
+			h.collect(o.vec, ch)
+		}
+	}
+}
+
+// collect collects vec, scaling the histograms of sampled methods by their
+// sampling rate. h.mu must be held.
+func (h *histogramVec) collect(vec *prom.HistogramVec, ch chan<- prom.Metric) {
+	if len(h.samples) == 0 {
+		vec.Collect(ch)
+		return
+	}
+	metrics := make(chan prom.Metric)
+	go func() {
+		vec.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		var out dto.Metric
+		if err := m.Write(&out); err == nil {
+			var service, method string
+			for _, l := range out.GetLabel() {
+				switch l.GetName() {
+				case "grpc_service":
+					service = l.GetValue()
+				case "grpc_method":
+					method = l.GetValue()
+				}
+			}
+			if every := h.everyFor("/" + service + "/" + method); every > 1 {
+				m = scaledHistogram{Metric: m, by: every}
+			}
+		}
+		ch <- m
+	}
+}
+
+// scaledHistogram is a histogram of sampled observations, exported scaled by
+// the sampling rate so that its count, sum and buckets estimate those of all
+// observations, and rate() over them remains correct.
+type scaledHistogram struct {
+	prom.Metric
+	by uint64
+}
+
+func (s scaledHistogram) Write(out *dto.Metric) error {
+	if err := s.Metric.Write(out); err != nil {
+		return err
+	}
+	h := out.GetHistogram()
+	if h == nil {
+		return nil
+	}
+	h.SampleCount = proto.Uint64(h.GetSampleCount() * s.by)
+	h.SampleSum = proto.Float64(h.GetSampleSum() * float64(s.by))
+	for _, b := range h.GetBucket() {
+		b.CumulativeCount = proto.Uint64(b.GetCumulativeCount() * s.by)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package grpcprom
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestHistogramEnabledAfterRegistration(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m := NewServerMetrics()
+	reg.MustRegister(m)
+	ping := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+
+	require.Nil(t, gatherHistogram(t, reg, "grpc_server_handling_seconds"), "disabled histogram must not be exported")
+
+	m.EnableHandlingTimeHistogram()
+	m.reporter.Handled(ping, codes.OK, time.Millisecond)
+	h := gatherHistogram(t, reg, "grpc_server_handling_seconds")
+	require.NotNil(t, h)
+	require.EqualValues(t, 1, h.GetSampleCount())
+	require.Len(t, h.GetBucket(), len(prometheus.DefBuckets))
+
+	m.EnableHandlingTimeHistogram(WithHistogramBuckets([]float64{0.1, 1}))
+	require.Nil(t, gatherHistogram(t, reg, "grpc_server_handling_seconds"), "changing buckets must discard observations")
+	m.reporter.Handled(ping, codes.OK, time.Millisecond)
+	h = gatherHistogram(t, reg, "grpc_server_handling_seconds")
+	require.EqualValues(t, 1, h.GetSampleCount())
+	require.Len(t, h.GetBucket(), 2)
+
+	m.DisableHandlingTimeHistogram()
+	m.reporter.Handled(ping, codes.OK, time.Millisecond)
+	require.Nil(t, gatherHistogram(t, reg, "grpc_server_handling_seconds"))
+
+	m.EnableHandlingTimeHistogram(WithHistogramBuckets([]float64{0.1, 1}))
+	require.EqualValues(t, 1, gatherHistogram(t, reg, "grpc_server_handling_seconds").GetSampleCount(),
+		"re-enabling with unchanged buckets must keep observations and not record while disabled")
+}
+
+func TestHistogramReconfigurationWhileReporting(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	server, client := NewServerMetrics(), NewClientMetrics()
+	reg.MustRegister(server, client)
+	rpc := RPC{Type: BidiStream, Service: "mwitkow.testproto.TestService", Method: "PingStream"}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+	run(func() {
+		server.reporter.Handled(rpc, codes.OK, time.Millisecond)
+		client.reporter.Handled(rpc, codes.OK, time.Millisecond)
+		newClientReporter(context.Background(), client, rpc.Type, "/mwitkow.testproto.TestService/PingStream", nil).SendMessageTimer().ObserveDuration()
+		newClientReporter(context.Background(), client, rpc.Type, "/mwitkow.testproto.TestService/PingStream", nil).ReceiveMessageTimer().ObserveDuration()
+	})
+	run(func() {
+		if _, err := reg.Gather(); err != nil {
+			t.Error(err)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		buckets := WithHistogramBuckets([]float64{0.1, float64(i%3 + 1)})
+		server.EnableHandlingTimeHistogram(buckets)
+		client.EnableClientHandlingTimeHistogram(buckets)
+		client.EnableClientStreamReceiveTimeHistogram(buckets)
+		client.EnableClientStreamSendTimeHistogram(buckets)
+		if i%2 == 0 {
+			server.DisableHandlingTimeHistogram()
+			client.DisableClientHandlingTimeHistogram()
+			client.DisableClientStreamReceiveTimeHistogram()
+			client.DisableClientStreamSendTimeHistogram()
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestHistogramMethodOverrides(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableHandlingTimeHistogram()
+	require.NoError(t, m.OverrideHandlingTimeHistogram("/export.Service/*", WithHistogramBuckets([]float64{60, 600})))
+	require.NoError(t, m.OverrideHandlingTimeHistogram("/other.Service/Export", func(o *prometheus.HistogramOpts) {
+		o.Name = "grpc_server_export_handling_seconds"
+	}))
+	require.Error(t, m.OverrideHandlingTimeHistogram("[", WithHistogramBuckets([]float64{1})))
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	m.reporter.Handled(RPC{Type: Unary, Service: "lookup.Service", Method: "Get"}, codes.OK, time.Millisecond)
+	m.reporter.Handled(RPC{Type: ServerStream, Service: "export.Service", Method: "Dump"}, codes.OK, 5*time.Minute)
+	m.reporter.Handled(RPC{Type: ServerStream, Service: "other.Service", Method: "Export"}, codes.OK, time.Minute)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	buckets := map[string]int{}
+	for _, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			if h := metric.GetHistogram(); h != nil {
+				require.EqualValues(t, 1, h.GetSampleCount())
+				buckets[mf.GetName()+"/"+labelValueOf(metric, "grpc_method")] = len(h.GetBucket())
+			}
+		}
+	}
+	require.Equal(t, map[string]int{
+		"grpc_server_handling_seconds/Get":           len(prometheus.DefBuckets),
+		"grpc_server_handling_seconds/Dump":          2,
+		"grpc_server_export_handling_seconds/Export": len(prometheus.DefBuckets),
+	}, buckets)
+}
+
+func TestHistogramSampling(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableHandlingTimeHistogram(WithHistogramBuckets([]float64{0.5, 2}))
+	require.NoError(t, m.SampleHandlingTimeHistogram("/hot.Service/*", 4))
+	require.Error(t, m.SampleHandlingTimeHistogram("/cold.Service/*", 0))
+	require.Error(t, m.SampleHandlingTimeHistogram("[", 2))
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	hot := RPC{Type: Unary, Service: "hot.Service", Method: "Get"}
+	cold := RPC{Type: Unary, Service: "cold.Service", Method: "Get"}
+	for i := 0; i < 8; i++ {
+		m.reporter.Handled(hot, codes.OK, time.Second)
+	}
+	for i := 0; i < 3; i++ {
+		m.reporter.Handled(cold, codes.OK, time.Second)
+	}
+	requireValue(t, 8, m.serverHandledCounter.WithLabelValues("unary", "hot.Service", "Get", "OK"))
+	requireValueHistCount(t, 2, m.serverHandledHistogram.WithLabelValues("unary", "hot.Service", "Get"))
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	counts := map[string][]uint64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "grpc_server_handling_seconds" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			h := metric.GetHistogram()
+			require.Equal(t, float64(h.GetSampleCount()), h.GetSampleSum())
+			counts[labelValueOf(metric, "grpc_service")] = []uint64{h.GetBucket()[0].GetCumulativeCount(), h.GetBucket()[1].GetCumulativeCount(), h.GetSampleCount()}
+		}
+	}
+	require.Equal(t, map[string][]uint64{
+		"hot.Service":  {0, 8, 8},
+		"cold.Service": {0, 3, 3},
+	}, counts, "sampled histograms must be scaled by their rate")
+}
+
+// gatherHistogram returns the histogram of the only series of the named
+// metric family, or nil if it is not exported.
+func gatherHistogram(t *testing.T, reg prometheus.Gatherer, name string) *dto.Histogram {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			require.Len(t, mf.GetMetric(), 1)
+			return mf.GetMetric()[0].GetHistogram()
+		}
+	}
+	return nil
+}
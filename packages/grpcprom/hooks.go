@@ -0,0 +1,130 @@
+package grpcprom
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// RPCInfo describes a completed RPC, as passed to an RPCHook.
+type RPCInfo struct {
+	// RPC is the method of the RPC, with its server, target and backend if
+	// labeled.
+	RPC RPC
+	// Code is the code the RPC completed with, and Err the error it
+	// completed with, as returned by the handler or invoker, nil if OK.
+	Code codes.Code
+	Err  error
+	// Duration is the time elapsed since the RPC started, as observed by
+	// the handling time histograms.
+	Duration time.Duration
+	// MsgSent and MsgReceived are the number of messages sent and received
+	// within the RPC.
+	MsgSent     int64
+	MsgReceived int64
+	// Peer is the address of the peer of the RPC, empty if unknown.
+	Peer string
+	// Context is the context of the RPC.
+	Context context.Context
+}
+
+// RPCHook is called with every completed RPC, from the goroutine completing
+// it. Hooks must be quick, or hand the RPC off, since they delay its
+// completion.
+type RPCHook func(info RPCInfo)
+
+// addHooks appends hooks to those of p.
+func addHooks(p *atomic.Pointer[[]RPCHook], hooks []RPCHook) {
+	for {
+		old := p.Load()
+		var added []RPCHook
+		if old != nil {
+			added = append(added, *old...)
+		}
+		added = append(added, hooks...)
+		if p.CompareAndSwap(old, &added) {
+			return
+		}
+	}
+}
+
+// loadHooks returns the hooks of p, nil if none.
+func loadHooks(p *atomic.Pointer[[]RPCHook]) []RPCHook {
+	if hooks := p.Load(); hooks != nil {
+		return *hooks
+	}
+	return nil
+}
+
+// msgCounts counts the messages of an RPC for its hooks.
+type msgCounts struct {
+	sent, received atomic.Int64
+}
+
+// call calls hooks with info and the messages counted.
+func (c *msgCounts) call(hooks []RPCHook, info RPCInfo) {
+	info.MsgSent, info.MsgReceived = c.sent.Load(), c.received.Load()
+	for _, h := range hooks {
+		h(info)
+	}
+}
+
+// SlowRPCLogHook returns an RPCHook logging the RPCs slower than threshold
+// to logger at warning level, or to slog.Default() if logger is nil.
+func SlowRPCLogHook(logger *slog.Logger, threshold time.Duration) RPCHook {
+	return func(info RPCInfo) {
+		if info.Duration >= threshold {
+			logRPC(logger, slog.LevelWarn, "slow RPC", info)
+		}
+	}
+}
+
+// AccessLogHook returns an RPCHook logging every RPC to logger at info level,
+// or to slog.Default() if logger is nil.
+func AccessLogHook(logger *slog.Logger) RPCHook {
+	return func(info RPCInfo) {
+		logRPC(logger, slog.LevelInfo, "RPC completed", info)
+	}
+}
+
+func logRPC(logger *slog.Logger, level slog.Level, msg string, info RPCInfo) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	ctx := info.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, 12)
+	for _, l := range []struct{ key, value string }{
+		{"grpc_server", info.RPC.Server},
+		{"grpc_target", info.RPC.Target},
+		{"grpc_backend", info.RPC.Backend},
+	} {
+		if l.value != "" {
+			attrs = append(attrs, slog.String(l.key, l.value))
+		}
+	}
+	attrs = append(attrs,
+		slog.String("grpc_type", string(info.RPC.Type)),
+		slog.String("grpc_service", info.RPC.Service),
+		slog.String("grpc_method", info.RPC.Method),
+		slog.String("grpc_code", info.Code.String()),
+		slog.Duration("duration", info.Duration),
+		slog.Int64("msg_sent", info.MsgSent),
+		slog.Int64("msg_received", info.MsgReceived),
+	)
+	if info.Peer != "" {
+		attrs = append(attrs, slog.String("peer", info.Peer))
+	}
+	if info.Err != nil {
+		attrs = append(attrs, slog.String("error", info.Err.Error()))
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,145 @@
+package grpcprom
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcstatus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordedRPCs records the RPCs passed to its hook by method.
+type recordedRPCs struct {
+	mu   sync.Mutex
+	rpcs map[string]RPCInfo
+}
+
+func (r *recordedRPCs) hook(info RPCInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rpcs == nil {
+		r.rpcs = map[string]RPCInfo{}
+	}
+	r.rpcs[info.RPC.Method] = info
+}
+
+func (r *recordedRPCs) get(method string) RPCInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rpcs[method]
+}
+
+func TestRPCHooks(t *testing.T) {
+	var serverRPCs recordedRPCs
+	serverMetrics := NewServerMetricsWithOptions(WithRPCHooks(serverRPCs.hook))
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(serverMetrics.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(serverMetrics.StreamServerInterceptor()),
+	)
+	pb_testproto.RegisterTestServiceServer(server, &testService{t: t})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	var clientRPCs recordedRPCs
+	clientMetrics := NewClientMetricsWithOptions(WithRPCHooks(clientRPCs.hook))
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(clientMetrics.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(clientMetrics.StreamClientInterceptor()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb_testproto.NewTestServiceClient(conn)
+
+	_, err = client.Ping(context.Background(), &pb_testproto.PingRequest{Value: "x"})
+	require.NoError(t, err)
+	_, err = client.PingError(context.Background(), &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.NotFound)})
+	require.Error(t, err)
+	stream, err := client.PingList(context.Background(), &pb_testproto.PingRequest{})
+	require.NoError(t, err)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.Equal(t, io.EOF, err)
+
+	ping := serverRPCs.get("Ping")
+	require.Equal(t, codes.OK, ping.Code)
+	require.NoError(t, ping.Err)
+	require.EqualValues(t, 1, ping.MsgReceived)
+	require.EqualValues(t, 1, ping.MsgSent, "unary responses must be counted before the hooks are called")
+	require.Positive(t, ping.Duration, "RPCs must be timed for hooks even without histograms")
+	require.NotEmpty(t, ping.Peer)
+	require.NotNil(t, ping.Context)
+
+	pingError := serverRPCs.get("PingError")
+	require.Equal(t, codes.NotFound, pingError.Code)
+	require.EqualError(t, pingError.Err, "rpc error: code = NotFound desc = Userspace error.")
+	require.EqualValues(t, 0, pingError.MsgSent)
+	require.Equal(t, codes.NotFound, clientRPCs.get("PingError").Code)
+
+	require.EqualValues(t, countListResponses, serverRPCs.get("PingList").MsgSent)
+	pingList := clientRPCs.get("PingList")
+	require.Equal(t, ServerStream, pingList.RPC.Type)
+	require.EqualValues(t, 1, pingList.MsgSent)
+	require.EqualValues(t, countListResponses, pingList.MsgReceived)
+	require.Equal(t, lis.Addr().String(), pingList.Peer)
+}
+
+func TestRPCHooksGetOriginalError(t *testing.T) {
+	m := NewServerMetrics()
+	var rpcs recordedRPCs
+	m.AddRPCHooks(rpcs.hook)
+	r := newServerReporter(context.Background(), m, Unary, "/mwitkow.testproto.TestService/Ping", nil)
+	notFound := status.Error(codes.NotFound, "no such ping")
+	err := fmt.Errorf("ping: %w", notFound)
+	st, _ := grpcstatus.FromError(err)
+	r.Handled(st, err)
+
+	ping := rpcs.get("Ping")
+	require.Equal(t, codes.NotFound, ping.Code)
+	require.Same(t, err, ping.Err, "hooks must get the error returned, not its status")
+	require.ErrorIs(t, ping.Err, notFound)
+}
+
+func TestLogHooks(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	info := RPCInfo{
+		RPC:      RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping", Server: "public"},
+		Code:     codes.OK,
+		Duration: 300 * time.Millisecond,
+		MsgSent:  1, MsgReceived: 1,
+		Peer:    "127.0.0.1:1234",
+		Context: context.Background(),
+	}
+
+	SlowRPCLogHook(logger, time.Second)(info)
+	require.Empty(t, buf.String(), "RPCs faster than the threshold must not be logged")
+	SlowRPCLogHook(logger, 250*time.Millisecond)(info)
+	require.Equal(t, `level=WARN msg="slow RPC" grpc_server=public grpc_type=unary grpc_service=mwitkow.testproto.TestService grpc_method=Ping grpc_code=OK duration=300ms msg_sent=1 msg_received=1 peer=127.0.0.1:1234`+"\n", buf.String())
+
+	buf.Reset()
+	info.Code, info.Err = codes.Internal, io.ErrUnexpectedEOF
+	AccessLogHook(logger)(info)
+	require.Contains(t, buf.String(), `level=INFO msg="RPC completed"`)
+	require.Contains(t, buf.String(), `grpc_code=Internal`)
+	require.Contains(t, buf.String(), `error="unexpected EOF"`)
+}
@@ -0,0 +1,152 @@
+package grpcprom
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// An Option configures a ServerMetrics or ClientMetrics on construction, with
+// NewServerMetricsWithOptions or NewClientMetricsWithOptions. A CounterOption
+// is an Option applying to all counters.
+type Option interface {
+	applyOption(*metricsOptions)
+}
+
+// metricsOptions are the options a ServerMetrics or ClientMetrics is
+// constructed with.
+type metricsOptions struct {
+	counter counterOptions
+	// serverLabel is whether server metrics carry the grpc_server label.
+	serverLabel serverLabel
+	// targetLabel maps the targets of ClientConns to the grpc_target label
+	// of client metrics, nil if they do not carry the label.
+	targetLabel func(target string) string
+	// maxBackends is the cap of distinct grpc_backend labels of client
+	// metrics, zero if they do not carry the label.
+	maxBackends int
+	// hooks are called with every completed RPC.
+	hooks []RPCHook
+}
+
+func newMetricsOptions(opts []Option) metricsOptions {
+	var mo metricsOptions
+	for _, o := range opts {
+		o.applyOption(&mo)
+	}
+	return mo
+}
+
+// asOptions returns counterOpts as Options.
+func asOptions(counterOpts []CounterOption) []Option {
+	opts := make([]Option, len(counterOpts))
+	for i, o := range counterOpts {
+		opts[i] = o
+	}
+	return opts
+}
+
+type optionFunc func(*metricsOptions)
+
+func (f optionFunc) applyOption(mo *metricsOptions) { f(mo) }
+
+// A CounterOption lets you add options to Counter metrics using With* funcs.
+type CounterOption func(*prom.CounterOpts)
+
+func (o CounterOption) applyOption(mo *metricsOptions) {
+	mo.counter = append(mo.counter, o)
+}
+
+type counterOptions []CounterOption
+
+func (co counterOptions) apply(o prom.CounterOpts) prom.CounterOpts {
+	for _, f := range co {
+		f(&o)
+	}
+	return o
+}
+
+// WithConstLabels allows you to add ConstLabels to Counter metrics.
+func WithConstLabels(labels prom.Labels) CounterOption {
+	return func(o *prom.CounterOpts) {
+		o.ConstLabels = labels
+	}
+}
+
+// WithServerLabel adds the grpc_server label to all server metrics, telling
+// apart the views returned by ForServer. It is empty for RPCs reported
+// through the ServerMetrics itself. It has no effect on ClientMetrics.
+func WithServerLabel() Option {
+	return optionFunc(func(mo *metricsOptions) { mo.serverLabel = true })
+}
+
+// WithClientTargetLabel adds the grpc_target label to all client metrics, set
+// to the target of the ClientConn of each RPC as mapped by fn, e.g. to tell
+// apart upstreams exposing the same service. A nil fn defaults to
+// NormalizeTarget. fn is called once per target, whose label is cached, and
+// should map them to few distinct labels. It has no effect on ServerMetrics.
+func WithClientTargetLabel(fn func(target string) string) Option {
+	return optionFunc(func(mo *metricsOptions) {
+		if fn == nil {
+			fn = NormalizeTarget
+		}
+		mo.targetLabel = fn
+	})
+}
+
+// WithClientBackendLabel adds the grpc_backend label to
+// grpc_client_handled_total and grpc_client_handling_seconds, set to the
+// address of the server that handled each RPC, e.g. to tell a bad backend of
+// a load-balanced ClientConn apart. At most maxBackends distinct addresses
+// are labeled, and the RPCs of the others are labeled "other"; a maxBackends
+// of zero or less does not add the label. It has no effect on ServerMetrics.
+//
+// To delete the series of backends no longer in use, e.g. once removed from
+// the resolver, also dial with grpc.WithStatsHandler(m.BackendStatsHandler()).
+func WithClientBackendLabel(maxBackends int) Option {
+	return optionFunc(func(mo *metricsOptions) {
+		if maxBackends > 0 {
+			mo.maxBackends = maxBackends
+		}
+	})
+}
+
+// WithRPCHooks adds hooks called with every completed RPC, e.g.
+// SlowRPCLogHook or AccessLogHook, with the timing and code recorded by the
+// metrics.
+func WithRPCHooks(hooks ...RPCHook) Option {
+	return optionFunc(func(mo *metricsOptions) { mo.hooks = append(mo.hooks, hooks...) })
+}
+
+// serverLabel prefixes the label names and values of server metrics with the
+// grpc_server label, if true.
+type serverLabel bool
+
+func (l serverLabel) names(names ...string) []string {
+	if !l {
+		return names
+	}
+	return append([]string{"grpc_server"}, names...)
+}
+
+func (l serverLabel) values(server string, values ...string) []string {
+	if !l {
+		return values
+	}
+	return append([]string{server}, values...)
+}
+
+// A HistogramOption lets you add options to Histogram metrics using With*
+// funcs.
+type HistogramOption func(*prom.HistogramOpts)
+
+// WithHistogramBuckets allows you to specify custom bucket ranges for histograms if EnableHandlingTimeHistogram is on.
+func WithHistogramBuckets(buckets []float64) HistogramOption {
+	return func(o *prom.HistogramOpts) { o.Buckets = buckets }
+}
+
+// WithHistogramConstLabels allows you to add custom ConstLabels to
+// histograms metrics.
+func WithHistogramConstLabels(labels prom.Labels) HistogramOption {
+	return func(o *prom.HistogramOpts) {
+		o.ConstLabels = labels
+	}
+}
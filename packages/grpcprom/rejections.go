@@ -0,0 +1,134 @@
+package grpcprom
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+)
+
+// tapRejection is the reason of the RPCs rejected by the tap handle wrapped
+// by ServerMetrics.TapHandle.
+const tapRejection = "tap"
+
+// unknownMethod labels the rejected RPCs of methods not initialized by
+// InitializeMetrics, since their name is chosen by clients.
+const unknownMethod = "unknown"
+
+// rejectionKey is the context key of the taggedRPC of an RPC, set by the
+// stats handler of ServerMetrics.RejectionStatsHandler.
+type rejectionKey struct{}
+
+// taggedRPC is an RPC tagged by the stats handler of
+// ServerMetrics.RejectionStatsHandler, and whether it reached the
+// interceptors.
+type taggedRPC struct {
+	fullMethod string
+	reached    atomic.Bool
+}
+
+// markReached marks the RPC of ctx as having reached the interceptors.
+func markReached(ctx context.Context) {
+	if t, ok := ctx.Value(rejectionKey{}).(*taggedRPC); ok {
+		t.reached.Store(true)
+	}
+}
+
+// TapHandle returns a tap.ServerInHandle calling h and counting the RPCs it
+// refuses in grpc_server_rejected_total with reason "tap", e.g.:
+//
+//	grpc.NewServer(grpc.InTapHandle(metrics.TapHandle(rateLimit)))
+//
+// Since the tap handle runs before the method is looked up, methods not
+// initialized by InitializeMetrics are labeled "unknown", so that clients
+// cannot create series at will.
+func (m *ServerMetrics) TapHandle(h tap.ServerInHandle) tap.ServerInHandle {
+	return func(ctx context.Context, info *tap.Info) (context.Context, error) {
+		ctx, err := h(ctx, info)
+		if err != nil {
+			m.reject(info.FullMethodName, tapRejection)
+		}
+		return ctx, err
+	}
+}
+
+// RejectionStatsHandler returns a stats.Handler counting the RPCs that fail
+// before reaching the interceptors of m in grpc_server_rejected_total, e.g.
+// those refused by interceptors chained before them, such as authentication,
+// or whose request exceeds the maximum message size. Their reason is their
+// code in snake case, e.g. "unauthenticated" or "resource_exhausted".
+//
+// It forwards all events to next, if not nil, since a grpc.Server takes a
+// single stats.Handler. The interceptors of m must be installed, or every
+// failed RPC is counted.
+func (m *ServerMetrics) RejectionStatsHandler(next stats.Handler) stats.Handler {
+	return &rejectionStatsHandler{metrics: m, next: next}
+}
+
+// reject counts an RPC of fullMethod rejected for reason.
+func (m *ServerMetrics) reject(fullMethod, reason string) {
+	service, method := splitMethodName(fullMethod)
+	if !m.initialized.admits(service, method) {
+		service, method = unknownMethod, unknownMethod
+	}
+	m.serverRejectedCounter.WithLabelValues(m.serverLabel.values(m.server, service, method, reason)...).Inc()
+}
+
+// rejectionStatsHandler is the stats.Handler of
+// ServerMetrics.RejectionStatsHandler.
+type rejectionStatsHandler struct {
+	metrics *ServerMetrics
+	next    stats.Handler
+}
+
+func (h *rejectionStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	ctx = context.WithValue(ctx, rejectionKey{}, &taggedRPC{fullMethod: info.FullMethodName})
+	if h.next != nil {
+		return h.next.TagRPC(ctx, info)
+	}
+	return ctx
+}
+
+func (h *rejectionStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if end, ok := s.(*stats.End); ok && end.Error != nil && !end.IsClient() {
+		if t, ok := ctx.Value(rejectionKey{}).(*taggedRPC); ok && !t.reached.Load() {
+			h.metrics.reject(t.fullMethod, rejectionReason(status.Code(end.Error)))
+		}
+	}
+	if h.next != nil {
+		h.next.HandleRPC(ctx, s)
+	}
+}
+
+func (h *rejectionStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	if h.next != nil {
+		return h.next.TagConn(ctx, info)
+	}
+	return ctx
+}
+
+func (h *rejectionStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	if h.next != nil {
+		h.next.HandleConn(ctx, s)
+	}
+}
+
+// rejectionReason returns code in snake case, e.g. "resource_exhausted".
+func rejectionReason(code codes.Code) string {
+	var b strings.Builder
+	for i, r := range code.String() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
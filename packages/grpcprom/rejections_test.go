@@ -0,0 +1,87 @@
+package grpcprom
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+)
+
+func TestServerMetricsRejected(t *testing.T) {
+	m := NewServerMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	refuseList := func(ctx context.Context, info *tap.Info) (context.Context, error) {
+		if strings.HasSuffix(info.FullMethodName, "/PingList") {
+			return ctx, errors.New("rate limited")
+		}
+		return ctx, nil
+	}
+	auth := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/mwitkow.testproto.TestService/PingEmpty" {
+			return nil, status.Error(codes.Unauthenticated, "no credentials")
+		}
+		return m.UnaryServerInterceptor()(ctx, req, info, handler)
+	}
+	server := grpc.NewServer(
+		grpc.InTapHandle(m.TapHandle(refuseList)),
+		grpc.StatsHandler(m.RejectionStatsHandler(nil)),
+		grpc.UnaryInterceptor(auth),
+		grpc.MaxRecvMsgSize(64),
+	)
+	pb_testproto.RegisterTestServiceServer(server, &testService{t: t})
+	m.InitializeMetrics(server)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb_testproto.NewTestServiceClient(conn)
+	ctx := context.Background()
+
+	_, err = client.PingEmpty(ctx, &pb_testproto.Empty{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.Ping(ctx, &pb_testproto.PingRequest{Value: strings.Repeat("x", 100)})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = client.Ping(ctx, &pb_testproto.PingRequest{Value: "ok"})
+	require.NoError(t, err)
+	_, err = client.PingError(ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.Internal)})
+	require.Equal(t, codes.Internal, status.Code(err))
+	stream, err := client.PingList(ctx, &pb_testproto.PingRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	rejected := map[string]float64{}
+	for _, metric := range gatherMetrics(t, reg, "grpc_server_rejected_total") {
+		rejected[labelValueOf(metric, "grpc_method")+"/"+labelValueOf(metric, "reason")] = metric.GetCounter().GetValue()
+	}
+	require.Equal(t, map[string]float64{
+		"PingEmpty/unauthenticated": 1,
+		"Ping/resource_exhausted":   1,
+		"PingList/tap":              1,
+	}, rejected, "RPCs failing after reaching the interceptors must not count as rejected")
+
+	m.reject("/evil.Service/Random", tapRejection)
+	requireValue(t, 1, m.serverRejectedCounter.WithLabelValues(unknownMethod, unknownMethod, tapRejection))
+}
+
+func TestServerMetricsRejectedWithoutInitializedMethods(t *testing.T) {
+	m := NewServerMetrics()
+	m.reject("/evil.Service/Random", tapRejection)
+	m.reject("/mwitkow.testproto.TestService/Ping", tapRejection)
+	requireValue(t, 2, m.serverRejectedCounter.WithLabelValues(unknownMethod, unknownMethod, tapRejection))
+}
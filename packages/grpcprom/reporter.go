@@ -0,0 +1,193 @@
+package grpcprom
+
+import (
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// RPC identifies the gRPC method an event is reported for.
+type RPC struct {
+	Type    GRPCType
+	Service string
+	Method  string
+	// Server is the name of the server handling the RPC, as given to
+	// ServerMetrics.ForServer. It is empty for client-side RPCs and servers
+	// without a name.
+	Server string
+	// Target is the grpc_target label of a client-side RPC, mapped from the
+	// target of its ClientConn if enabled by WithClientTargetLabel. It is
+	// empty otherwise.
+	Target string
+	// Backend is the address of the server that handled a client-side RPC,
+	// or "other" beyond the cap of WithClientBackendLabel. It is only set
+	// when reporting the completion of RPCs if enabled.
+	Backend string
+}
+
+// Reporter receives the events observed by the server and client
+// interceptors. The Prometheus metrics of ServerMetrics and ClientMetrics are
+// one implementation; others can be plugged in with NewServerMetricsWithReporter
+// and NewClientMetricsWithReporter. Implementations must be safe for
+// concurrent use.
+type Reporter interface {
+	// StartedRPC is called when an RPC is started.
+	StartedRPC(rpc RPC)
+	// ReceivedMessage is called for every message received within an RPC.
+	ReceivedMessage(rpc RPC)
+	// SentMessage is called for every message sent within an RPC.
+	SentMessage(rpc RPC)
+	// Handled is called once an RPC is completed, with its status code and
+	// the time elapsed since StartedRPC.
+	Handled(rpc RPC, code codes.Code, duration time.Duration)
+}
+
+// MethodInitializer is implemented by Reporters that can pre-populate their
+// metrics for a method before any RPC is reported. ServerMetrics calls it
+// from InitializeMetrics.
+type MethodInitializer interface {
+	InitializeMethod(rpc RPC)
+}
+
+// Histogram identifies one of the histograms of ServerMetrics and
+// ClientMetrics to a HistogramReporter.
+type Histogram int
+
+const (
+	// HandlingTimeHistogram is the handling time histogram of ServerMetrics
+	// and ClientMetrics.
+	HandlingTimeHistogram Histogram = iota
+	// StreamReceiveTimeHistogram is the single message receive time
+	// histogram of ClientMetrics.
+	StreamReceiveTimeHistogram
+	// StreamSendTimeHistogram is the single message send time histogram of
+	// ClientMetrics.
+	StreamSendTimeHistogram
+)
+
+// HistogramReporter is implemented by Reporters that record the histograms of
+// ServerMetrics and ClientMetrics themselves, such as the OpenTelemetry
+// backend of packages/grpcotel. Overrides and sampling do not apply to them.
+type HistogramReporter interface {
+	Reporter
+	// SetHistogram is called with the options h is enabled or re-bucketed
+	// with, and with nil once h is disabled.
+	SetHistogram(h Histogram, opts *prom.HistogramOpts)
+	// MessageObserver returns the Observer of the seconds taken to send or
+	// receive a single stream message of rpc, or nil while h is disabled.
+	MessageObserver(h Histogram, rpc RPC) prom.Observer
+}
+
+// messageTimers is implemented by reporters that record the latency of
+// individual stream messages.
+type messageTimers interface {
+	sendMessageTimer(rpc RPC) timer
+	receiveMessageTimer(rpc RPC) timer
+}
+
+// rpcBinder is implemented by reporters that can resolve the state of a
+// method once per RPC. The interceptors report all events of the RPC to the
+// returned Reporter instead.
+type rpcBinder interface {
+	bind(rpc RPC) Reporter
+}
+
+// timingReporter is implemented by reporters that can tell whether they use
+// the duration of the RPC they are bound to, so that the interceptors need
+// not read the clock for RPCs whose duration is not recorded.
+type timingReporter interface {
+	timed() bool
+}
+
+// MemoryReporter is a Reporter that keeps all reported events in memory. It
+// is mostly useful in tests.
+type MemoryReporter struct {
+	mu        sync.Mutex
+	started   map[RPC]int
+	received  map[RPC]int
+	sent      map[RPC]int
+	handled   map[RPC]map[codes.Code]int
+	durations map[RPC][]time.Duration
+}
+
+// NewMemoryReporter returns an empty MemoryReporter.
+func NewMemoryReporter() *MemoryReporter {
+	return &MemoryReporter{
+		started:   make(map[RPC]int),
+		received:  make(map[RPC]int),
+		sent:      make(map[RPC]int),
+		handled:   make(map[RPC]map[codes.Code]int),
+		durations: make(map[RPC][]time.Duration),
+	}
+}
+
+// StartedRPC implements Reporter.
+func (r *MemoryReporter) StartedRPC(rpc RPC) {
+	r.mu.Lock()
+	r.started[rpc]++
+	r.mu.Unlock()
+}
+
+// ReceivedMessage implements Reporter.
+func (r *MemoryReporter) ReceivedMessage(rpc RPC) {
+	r.mu.Lock()
+	r.received[rpc]++
+	r.mu.Unlock()
+}
+
+// SentMessage implements Reporter.
+func (r *MemoryReporter) SentMessage(rpc RPC) {
+	r.mu.Lock()
+	r.sent[rpc]++
+	r.mu.Unlock()
+}
+
+// Handled implements Reporter.
+func (r *MemoryReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.handled[rpc] == nil {
+		r.handled[rpc] = make(map[codes.Code]int)
+	}
+	r.handled[rpc][code]++
+	r.durations[rpc] = append(r.durations[rpc], duration)
+}
+
+// StartedCount returns the number of RPCs started for the given method.
+func (r *MemoryReporter) StartedCount(rpc RPC) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.started[rpc]
+}
+
+// ReceivedCount returns the number of messages received for the given method.
+func (r *MemoryReporter) ReceivedCount(rpc RPC) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received[rpc]
+}
+
+// SentCount returns the number of messages sent for the given method.
+func (r *MemoryReporter) SentCount(rpc RPC) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sent[rpc]
+}
+
+// HandledCount returns the number of RPCs completed with the given code for
+// the given method.
+func (r *MemoryReporter) HandledCount(rpc RPC, code codes.Code) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.handled[rpc][code]
+}
+
+// Durations returns the handling durations of all completed RPCs for the
+// given method, in the order they were reported.
+func (r *MemoryReporter) Durations(rpc RPC) []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Duration(nil), r.durations[rpc]...)
+}
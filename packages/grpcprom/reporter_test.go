@@ -0,0 +1,77 @@
+package grpcprom
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	// all reporters must satisfy the Reporter interface
+	_ Reporter = &promServerReporter{}
+	_ Reporter = &promClientReporter{}
+	_ Reporter = NewMemoryReporter()
+)
+
+func TestMemoryReporter(t *testing.T) {
+	serverReporter := NewMemoryReporter()
+	clientReporter := NewMemoryReporter()
+	serverMetrics := NewServerMetricsWithReporter(serverReporter)
+	clientMetrics := NewClientMetricsWithReporter(clientReporter)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a port for serverListener")
+	server := grpc.NewServer(
+		grpc.StreamInterceptor(serverMetrics.StreamServerInterceptor()),
+		grpc.UnaryInterceptor(serverMetrics.UnaryServerInterceptor()),
+	)
+	pb_testproto.RegisterTestServiceServer(server, &testService{t: t})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(clientMetrics.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(clientMetrics.StreamClientInterceptor()),
+	)
+	require.NoError(t, err, "must not error on client Dial")
+	defer conn.Close()
+	client := pb_testproto.NewTestServiceClient(conn)
+
+	_, err = client.PingError(ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)})
+	require.Error(t, err)
+	ss, err := client.PingList(ctx, &pb_testproto.PingRequest{})
+	require.NoError(t, err)
+	for {
+		_, err := ss.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err, "reading pingList shouldn't fail")
+	}
+
+	pingError := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "PingError"}
+	pingList := RPC{Type: ServerStream, Service: "mwitkow.testproto.TestService", Method: "PingList"}
+
+	require.Equal(t, 1, serverReporter.StartedCount(pingError))
+	require.Equal(t, 1, serverReporter.HandledCount(pingError, codes.FailedPrecondition))
+	require.Equal(t, 0, serverReporter.SentCount(pingError))
+	require.Len(t, serverReporter.Durations(pingError), 1)
+	require.Equal(t, 1, serverReporter.HandledCount(pingList, codes.OK))
+	require.Equal(t, countListResponses, serverReporter.SentCount(pingList))
+
+	require.Equal(t, 1, clientReporter.HandledCount(pingError, codes.FailedPrecondition))
+	require.Equal(t, 1, clientReporter.SentCount(pingList))
+	require.Equal(t, countListResponses, clientReporter.ReceivedCount(pingList))
+	require.Equal(t, 1, clientReporter.HandledCount(pingList, codes.OK))
+}
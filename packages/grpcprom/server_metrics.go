@@ -0,0 +1,566 @@
+package grpcprom
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcstatus"
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc"
+)
+
+// ServerMetrics represents a collection of metrics to be registered on a
+// Prometheus metrics registry for a gRPC server.
+type ServerMetrics struct {
+	serverStartedCounter    *prom.CounterVec
+	serverHandledCounter    *prom.CounterVec
+	serverStreamMsgReceived *prom.CounterVec
+	serverStreamMsgSent     *prom.CounterVec
+	serverHandledHistogram  *histogramVec
+	serverSLICounter        *sliCounter
+	serverStreams           *streamTracker
+	serverHealth            *healthTracker
+	serverDegradations      *healthDegradations
+	serverRejectedCounter   *prom.CounterVec
+
+	// server is the value of the grpc_server label, set by ForServer.
+	server string
+	// serverLabel is whether the metrics carry the grpc_server label, as
+	// set by WithServerLabel.
+	serverLabel serverLabel
+
+	// reporter receives the events observed by the interceptors. It records
+	// into the Prometheus metrics above unless replaced by
+	// NewServerMetricsWithReporter.
+	reporter Reporter
+
+	// initialized are the methods initialized by InitializeMetrics, shared
+	// with all views returned by ForServer, so that Reset can redo it.
+	initialized *methodSet
+
+	// handles caches the metrics resolved per method by the Prometheus
+	// reporter, shared with all views returned by ForServer.
+	handles *handleCache
+
+	// snapshots are the recent snapshots taken by Snapshot, shared with all
+	// views returned by ForServer.
+	snapshots *snapshotHistory
+
+	// debug records RPCs for the debug page once served, shared with all
+	// views returned by ForServer.
+	debug *atomic.Pointer[debugRecorder]
+
+	// hooks are called with every completed RPC, shared with all views
+	// returned by ForServer.
+	hooks *atomic.Pointer[[]RPCHook]
+
+	// degrader degrades the health of services of this server, or this view,
+	// while their error ratio is too high, once enabled.
+	degrader *atomic.Pointer[healthDegrader]
+
+	// mu guards the registries the metrics were registered to, so that
+	// Unregister can undo it.
+	mu         sync.Mutex
+	registries []prom.Registerer
+}
+
+// methodSet is a set of methods, safe for concurrent use.
+type methodSet struct {
+	mu      sync.Mutex
+	methods map[RPC]struct{}
+	// names are the service and method names of methods, of any server.
+	names map[methodName]struct{}
+}
+
+// methodName is the service and method name of a method in a methodSet.
+type methodName struct {
+	service, method string
+}
+
+func (s *methodSet) add(rpc RPC) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.methods == nil {
+		s.methods = make(map[RPC]struct{})
+		s.names = make(map[methodName]struct{})
+	}
+	s.methods[rpc] = struct{}{}
+	s.names[methodName{rpc.Service, rpc.Method}] = struct{}{}
+}
+
+// admits reports whether s contains a method of service named method.
+func (s *methodSet) admits(service, method string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.names[methodName{service, method}]
+	return ok
+}
+
+func (s *methodSet) list() []RPC {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	methods := make([]RPC, 0, len(s.methods))
+	for rpc := range s.methods {
+		methods = append(methods, rpc)
+	}
+	return methods
+}
+
+// NewServerMetrics returns a ServerMetrics object. Use a new instance of
+// ServerMetrics when not using the default Prometheus metrics registry, for
+// example when wanting to control which metrics are added to a registry as
+// opposed to automatically adding metrics via init functions.
+func NewServerMetrics(counterOpts ...CounterOption) *ServerMetrics {
+	return NewServerMetricsWithOptions(asOptions(counterOpts)...)
+}
+
+// NewServerMetricsWithOptions is like NewServerMetrics, but also takes the
+// Options that are not CounterOptions, e.g. WithServerLabel or WithRPCHooks.
+func NewServerMetricsWithOptions(opts ...Option) *ServerMetrics {
+	mo := newMetricsOptions(opts)
+	counterOpts, labels := mo.counter, mo.serverLabel
+	m := &ServerMetrics{
+		serverStartedCounter: prom.NewCounterVec(
+			counterOpts.apply(prom.CounterOpts{
+				Name: "grpc_server_started_total",
+				Help: "Total number of RPCs started on the server.",
+			}), labels.names("grpc_type", "grpc_service", "grpc_method")),
+		serverHandledCounter: prom.NewCounterVec(
+			counterOpts.apply(prom.CounterOpts{
+				Name: "grpc_server_handled_total",
+				Help: "Total number of RPCs completed on the server, regardless of success or failure.",
+			}), labels.names("grpc_type", "grpc_service", "grpc_method", "grpc_code")),
+		serverStreamMsgReceived: prom.NewCounterVec(
+			counterOpts.apply(prom.CounterOpts{
+				Name: "grpc_server_msg_received_total",
+				Help: "Total number of RPC stream messages received on the server.",
+			}), labels.names("grpc_type", "grpc_service", "grpc_method")),
+		serverStreamMsgSent: prom.NewCounterVec(
+			counterOpts.apply(prom.CounterOpts{
+				Name: "grpc_server_msg_sent_total",
+				Help: "Total number of gRPC stream messages sent by the server.",
+			}), labels.names("grpc_type", "grpc_service", "grpc_method")),
+		serverHandledHistogram: newHistogramVec(prom.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server.",
+			Buckets: prom.DefBuckets,
+		}, labels.names("grpc_type", "grpc_service", "grpc_method")...),
+		serverSLICounter: newSLICounter(
+			counterOpts.apply(prom.CounterOpts{
+				Name: "grpc_server_sli_events_total",
+				Help: "Total number of RPCs completed on the server, classified as good or bad by their service level objective.",
+			}), labels.names("grpc_type", "grpc_service", "grpc_method", "result")...),
+		serverStreams: newStreamTracker(counterOpts.apply(prom.CounterOpts{}), "grpc_server",
+			labels.names("grpc_type", "grpc_service", "grpc_method"),
+			func(rpc RPC) []string { return labels.values(rpc.Server, string(rpc.Type), rpc.Service, rpc.Method) }),
+		serverHealth:       newHealthTracker(counterOpts.apply(prom.CounterOpts{}), labels),
+		serverDegradations: newHealthDegradations(counterOpts.apply(prom.CounterOpts{}), labels),
+		serverRejectedCounter: prom.NewCounterVec(
+			counterOpts.apply(prom.CounterOpts{
+				Name: "grpc_server_rejected_total",
+				Help: "Total number of RPCs rejected on the server before reaching the handler.",
+			}), labels.names("grpc_service", "grpc_method", "reason")),
+		serverLabel: labels,
+		initialized: &methodSet{},
+		handles:     newHandleCache(),
+		snapshots:   &snapshotHistory{},
+		debug:       &atomic.Pointer[debugRecorder]{},
+		hooks:       &atomic.Pointer[[]RPCHook]{},
+		degrader:    &atomic.Pointer[healthDegrader]{},
+	}
+	addHooks(m.hooks, mo.hooks)
+	m.reporter = &promServerReporter{metrics: m}
+	return m
+}
+
+// ForServer returns a view of m for one of several gRPC servers in a process,
+// distinguished by the grpc_server label. The view shares the metrics of m,
+// including enabled histograms and SLI events, and only m itself needs to be
+// registered. Call InitializeMetrics on every view with its server.
+//
+// Unless m reports to another Reporter, it must have been created with
+// WithServerLabel, as the grpc_server label is only added then; ForServer
+// panics otherwise.
+func (m *ServerMetrics) ForServer(name string) *ServerMetrics {
+	if m.exportsPrometheus() && !bool(m.serverLabel) {
+		panic("grpcprom: ForServer called on ServerMetrics created without WithServerLabel")
+	}
+	v := &ServerMetrics{
+		serverStartedCounter:    m.serverStartedCounter,
+		serverHandledCounter:    m.serverHandledCounter,
+		serverStreamMsgReceived: m.serverStreamMsgReceived,
+		serverStreamMsgSent:     m.serverStreamMsgSent,
+		serverHandledHistogram:  m.serverHandledHistogram,
+		serverSLICounter:        m.serverSLICounter,
+		serverStreams:           m.serverStreams,
+		serverHealth:            m.serverHealth,
+		serverDegradations:      m.serverDegradations,
+		serverRejectedCounter:   m.serverRejectedCounter,
+		server:                  name,
+		serverLabel:             m.serverLabel,
+		reporter:                m.reporter,
+		initialized:             m.initialized,
+		handles:                 m.handles,
+		snapshots:               m.snapshots,
+		debug:                   m.debug,
+		hooks:                   m.hooks,
+		degrader:                &atomic.Pointer[healthDegrader]{},
+	}
+	if _, ok := m.reporter.(*promServerReporter); ok {
+		v.reporter = &promServerReporter{metrics: v}
+	}
+	return v
+}
+
+// NewServerMetricsWithReporter returns a ServerMetrics object whose
+// interceptors report to the given Reporter instead of Prometheus metrics.
+// The returned ServerMetrics does not export anything through Describe and
+// Collect. The options configure the RPCs reported, e.g. their labels.
+func NewServerMetricsWithReporter(r Reporter, opts ...Option) *ServerMetrics {
+	m := NewServerMetricsWithOptions(opts...)
+	m.reporter = r
+	return m
+}
+
+// exportsPrometheus reports whether the interceptors record into the
+// Prometheus metrics of m.
+func (m *ServerMetrics) exportsPrometheus() bool {
+	_, ok := m.reporter.(*promServerReporter)
+	return ok
+}
+
+// EnableHandlingTimeHistogram enables histograms being registered when
+// registering the ServerMetrics on a Prometheus registry. Histograms can be
+// expensive on Prometheus servers. It takes options to configure histogram
+// options such as the defined buckets.
+//
+// It is safe to call while serving, e.g. to change the buckets, which
+// discards the observations made so far. The histogram is described even
+// while disabled, so the ServerMetrics may be registered before enabling it;
+// once registered, only the buckets may be changed.
+func (m *ServerMetrics) EnableHandlingTimeHistogram(opts ...HistogramOption) {
+	histOpts := m.serverHandledHistogram.enable(opts...)
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(HandlingTimeHistogram, &histOpts)
+	}
+}
+
+// OverrideHandlingTimeHistogram makes the handling time of the methods
+// matching pattern be recorded with opts, applied on top of the options the
+// histogram is enabled with, e.g. to use buckets fitting long-running streams.
+// pattern is a path.Match pattern of full method names, e.g.
+// "/package.Service/*" or "/package.Service/Method". The first matching
+// override applies; overriding a pattern again replaces its options.
+//
+// Overrides only apply while the histogram is enabled with
+// EnableHandlingTimeHistogram, and not to HistogramReporters. Adding
+// one discards the observations made so far. It should be called before
+// registering the ServerMetrics unless opts only change the buckets.
+func (m *ServerMetrics) OverrideHandlingTimeHistogram(pattern string, opts ...HistogramOption) error {
+	return m.serverHandledHistogram.override(pattern, opts...)
+}
+
+// SampleHandlingTimeHistogram makes the methods matching pattern only
+// observe the handling time of one in every `every` RPCs, for methods so hot
+// that reading the clock and observing every RPC is measurable. pattern is
+// matched like in OverrideHandlingTimeHistogram, and the first matching rule
+// applies; sampling a pattern again replaces its rate, and a rate of 1
+// observes every RPC. Counters remain exact.
+//
+// The sampled histograms are exported scaled by the rate, so that their
+// count, sum and buckets estimate those of all RPCs and rate() queries over
+// them remain correct. Changing sampling discards the observations made so
+// far. It does not apply to HistogramReporters.
+func (m *ServerMetrics) SampleHandlingTimeHistogram(pattern string, every int) error {
+	return m.serverHandledHistogram.sample(pattern, every)
+}
+
+// DisableHandlingTimeHistogram stops recording and exporting the handling
+// time histogram. It is safe to call while serving.
+func (m *ServerMetrics) DisableHandlingTimeHistogram() {
+	m.serverHandledHistogram.disable()
+	if r, ok := m.reporter.(HistogramReporter); ok {
+		r.SetHistogram(HandlingTimeHistogram, nil)
+	}
+}
+
+// EnableSLIEvents enables counting completed RPCs as good or bad events of a
+// service level indicator, according to the given objectives. RPCs of
+// methods not matched by any SLO are not counted.
+func (m *ServerMetrics) EnableSLIEvents(slos ...SLO) {
+	m.serverSLICounter.enable(slos)
+}
+
+// Describe sends the super-set of all possible descriptors of metrics
+// collected by this Collector to the provided channel and returns once
+// the last descriptor has been sent.
+func (m *ServerMetrics) Describe(ch chan<- *prom.Desc) {
+	if !m.exportsPrometheus() {
+		return
+	}
+	m.serverStartedCounter.Describe(ch)
+	m.serverHandledCounter.Describe(ch)
+	m.serverStreamMsgReceived.Describe(ch)
+	m.serverStreamMsgSent.Describe(ch)
+	m.serverHandledHistogram.Describe(ch)
+	m.serverSLICounter.Describe(ch)
+	m.serverStreams.Describe(ch)
+	m.serverHealth.Describe(ch)
+	m.serverDegradations.Describe(ch)
+	m.serverRejectedCounter.Describe(ch)
+}
+
+// Collect is called by the Prometheus registry when collecting
+// metrics. The implementation sends each collected metric via the
+// provided channel and returns once the last metric has been sent.
+func (m *ServerMetrics) Collect(ch chan<- prom.Metric) {
+	if !m.exportsPrometheus() {
+		return
+	}
+	m.serverStartedCounter.Collect(ch)
+	m.serverHandledCounter.Collect(ch)
+	m.serverStreamMsgReceived.Collect(ch)
+	m.serverStreamMsgSent.Collect(ch)
+	m.serverHandledHistogram.Collect(ch)
+	m.serverSLICounter.Collect(ch)
+	m.serverStreams.Collect(ch)
+	m.serverHealth.Collect(ch)
+	m.serverDegradations.Collect(ch)
+	m.serverRejectedCounter.Collect(ch)
+}
+
+// Snapshot returns the statistics of every method, read from the same
+// metrics as Collect, for use by the server itself, e.g. on status pages or
+// for admission control. Besides the totals, it holds the statistics over
+// about the last minute, computed from earlier snapshots; call it regularly
+// for those to be available. It includes the methods of all views returned
+// by ForServer. Metrics with a non-Prometheus reporter have no statistics.
+func (m *ServerMetrics) Snapshot() Snapshot {
+	stats := snapshotVecs{
+		started:  m.serverStartedCounter,
+		handled:  m.serverHandledCounter,
+		received: m.serverStreamMsgReceived,
+		sent:     m.serverStreamMsgSent,
+		handling: m.serverHandledHistogram,
+	}.read()
+	return m.snapshots.snapshot(time.Now(), stats)
+}
+
+// DebugHandler returns an http.Handler serving an HTML page of the
+// statistics of every method, like /debug/requests of x/net/trace: counts by
+// code, handling time buckets and RPCs in flight, followed by the keep
+// slowest and the keep most recently failed RPCs of each method, with their
+// duration, code, peer and error message.
+//
+// RPCs are only kept from the first call on; later calls change keep.
+func (m *ServerMetrics) DebugHandler(keep int) http.Handler {
+	return debugHandler("gRPC server", "Server", m.debug, keep, m.Snapshot)
+}
+
+// RegisterTo registers the metrics on reg. Unlike registering them directly,
+// this allows Unregister to remove them again.
+func (m *ServerMetrics) RegisterTo(reg prom.Registerer) error {
+	if err := reg.Register(m); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.registries = append(m.registries, reg)
+	m.mu.Unlock()
+	return nil
+}
+
+// Unregister removes the metrics from all registries they were registered to
+// with RegisterTo. It reports whether they were removed from any.
+func (m *ServerMetrics) Unregister() bool {
+	m.mu.Lock()
+	registries := m.registries
+	m.registries = nil
+	m.mu.Unlock()
+	unregistered := false
+	for _, reg := range registries {
+		if reg.Unregister(m) {
+			unregistered = true
+		}
+	}
+	return unregistered
+}
+
+// Reset deletes all series of the metrics and then initializes the methods of
+// all servers passed to InitializeMetrics again, so that they are exported
+// with zero values. Enabled histograms and SLI events stay enabled.
+func (m *ServerMetrics) Reset() {
+	m.serverStartedCounter.Reset()
+	m.serverHandledCounter.Reset()
+	m.serverStreamMsgReceived.Reset()
+	m.serverStreamMsgSent.Reset()
+	m.serverHandledHistogram.Reset()
+	m.serverSLICounter.Reset()
+	m.serverStreams.Reset()
+	m.serverHealth.Reset()
+	m.serverDegradations.Reset()
+	m.serverRejectedCounter.Reset()
+	m.handles.reset()
+	if d := m.debug.Load(); d != nil {
+		d.Reset()
+	}
+
+	if r, ok := m.reporter.(MethodInitializer); ok {
+		for _, rpc := range m.initialized.list() {
+			r.InitializeMethod(rpc)
+		}
+	}
+}
+
+// EnableStreamAgeMetrics enables tracking the active streams of every method,
+// exporting the age of the oldest one as
+// grpc_server_oldest_active_stream_age_seconds and a histogram of all of
+// their ages as grpc_server_active_stream_age_seconds, computed when scraped.
+// Only streams started once enabled are tracked. It is safe to call while
+// serving.
+func (m *ServerMetrics) EnableStreamAgeMetrics() {
+	m.serverStreams.setAgesEnabled(true)
+}
+
+// DisableStreamAgeMetrics stops exporting the ages of active streams.
+func (m *ServerMetrics) DisableStreamAgeMetrics() {
+	m.serverStreams.setAgesEnabled(false)
+}
+
+// EnableIdleStreamMetrics enables tracking the time since the last message
+// of every stream, exporting how many active streams are idle for longer than
+// each threshold as grpc_server_idle_streams, and counting streams that ended
+// after having been in grpc_server_idle_streams_ended_total, labeled by the
+// threshold in seconds. Calling it again replaces the thresholds, and calling
+// it without any disables it. It is safe to call while serving.
+func (m *ServerMetrics) EnableIdleStreamMetrics(thresholds ...time.Duration) {
+	m.serverStreams.setIdleThresholds(thresholds)
+}
+
+// EnableHealthDegradation makes the interceptors set services to NOT_SERVING
+// on h while their ratio of RPCs handled with an error is too high, and back
+// to their previous status once it dropped, as configured by d, so that load
+// balancers checking health drain instances failing their RPCs. h is
+// typically the health.Server of the gRPC server, or the HealthServer
+// wrapping it; other setters are restored to SERVING. It returns an error if
+// the thresholds of d are out of range.
+//
+// The error ratio and whether each service is degraded are exported as
+// grpc_server_health_degradation_error_ratio and grpc_server_health_degraded,
+// and the changes made counted in
+// grpc_server_health_degradation_transitions_total. Calling it again replaces
+// the configuration. On a view returned by ForServer, it only applies to the
+// RPCs of that server.
+func (m *ServerMetrics) EnableHealthDegradation(h ServingStatusSetter, d HealthDegradation) error {
+	degrader, err := newHealthDegrader(h, d, m.server, m.serverDegradations)
+	if err != nil {
+		return err
+	}
+	m.degrader.Store(degrader)
+	m.serverDegradations.replace(m.server, degrader)
+	return nil
+}
+
+// DisableHealthDegradation stops degrading the health of services, and sets
+// the services degraded so far back to SERVING.
+func (m *ServerMetrics) DisableHealthDegradation() {
+	m.degrader.Store(nil)
+	m.serverDegradations.replace(m.server, nil)
+}
+
+// AddRPCHooks adds hooks called with every RPC completed on the server, e.g.
+// SlowRPCLogHook or AccessLogHook, with the timing and code recorded by the
+// metrics. The hooks are shared with all views returned by ForServer, and
+// only called for RPCs started once added.
+func (m *ServerMetrics) AddRPCHooks(hooks ...RPCHook) {
+	addHooks(m.hooks, hooks)
+}
+
+// UnaryServerInterceptor is a gRPC server-side interceptor that provides Prometheus monitoring for Unary RPCs.
+func (m *ServerMetrics) UnaryServerInterceptor() func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		monitor := newServerReporter(ctx, m, Unary, info.FullMethod, m.degrader.Load())
+		monitor.ReceivedMessage()
+		resp, err := handler(ctx, req)
+		if err == nil {
+			monitor.SentMessage()
+		}
+		st, _ := grpcstatus.FromError(err)
+		monitor.Handled(st, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is a gRPC server-side interceptor that provides Prometheus monitoring for Streaming RPCs.
+func (m *ServerMetrics) StreamServerInterceptor() func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		monitor := newServerReporter(ss.Context(), m, streamRPCType(info), info.FullMethod, m.degrader.Load())
+		var active *activeStream
+		if m.exportsPrometheus() && m.serverStreams.tracking() {
+			active = m.serverStreams.track(monitor.rpc)
+			defer m.serverStreams.untrack(active)
+		}
+		err := handler(srv, &monitoredServerStream{ss, monitor, active})
+		st, _ := grpcstatus.FromError(err)
+		monitor.Handled(st, err)
+		return err
+	}
+}
+
+// InitializeMetrics initializes all metrics, with their appropriate null
+// value, for all gRPC methods registered on a gRPC server. This is useful, to
+// ensure that all metrics exist when collecting and querying.
+func (m *ServerMetrics) InitializeMetrics(server *grpc.Server) {
+	serviceInfo := server.GetServiceInfo()
+	for serviceName, info := range serviceInfo {
+		for _, mInfo := range info.Methods {
+			preRegisterMethod(m, serviceName, &mInfo)
+		}
+	}
+}
+
+func streamRPCType(info *grpc.StreamServerInfo) GRPCType {
+	if info.IsClientStream && !info.IsServerStream {
+		return ClientStream
+	} else if !info.IsClientStream && info.IsServerStream {
+		return ServerStream
+	}
+	return BidiStream
+}
+
+// monitoredStream wraps grpc.ServerStream allowing each Sent/Recv of message to increment counters.
+type monitoredServerStream struct {
+	grpc.ServerStream
+	monitor *serverReporter
+	active  *activeStream
+}
+
+func (s *monitoredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	s.active.touch()
+	if err == nil {
+		s.monitor.SentMessage()
+	}
+	return err
+}
+
+func (s *monitoredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	s.active.touch()
+	if err == nil {
+		s.monitor.ReceivedMessage()
+	}
+	return err
+}
+
+// preRegisterMethod is invoked on Register of a Server, allowing all gRPC services labels to be pre-populated.
+func preRegisterMethod(metrics *ServerMetrics, serviceName string, mInfo *grpc.MethodInfo) {
+	rpc := RPC{Type: typeFromMethodInfo(mInfo), Service: serviceName, Method: mInfo.Name, Server: metrics.server}
+	metrics.initialized.add(rpc)
+	if r, ok := metrics.reporter.(MethodInitializer); ok {
+		r.InitializeMethod(rpc)
+	}
+}
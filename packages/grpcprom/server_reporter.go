@@ -0,0 +1,195 @@
+// Copyright 2016 Michal Witkowski. All Rights Reserved.
+// See LICENSE for licensing terms.
+
+package grpcprom
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serverReporter reports the events of a single server-side RPC.
+type serverReporter struct {
+	reporter  Reporter
+	rpc       RPC
+	startTime time.Time
+
+	// ctx is the context of the RPC, to tell its peer to debug, which records
+	// the RPC for the debug page if enabled.
+	ctx   context.Context
+	debug *debugRecorder
+	// degrader degrades the health of the service on errors, if enabled.
+	degrader *healthDegrader
+	// hooks are called once the RPC completed, with its messages counted in
+	// msgs if any.
+	hooks []RPCHook
+	msgs  msgCounts
+}
+
+// newServerReporter returns the reporter of an RPC of m, observed by degrader
+// if not nil.
+func newServerReporter(ctx context.Context, m *ServerMetrics, rpcType GRPCType, fullMethod string, degrader *healthDegrader) *serverReporter {
+	markReached(ctx)
+	r := &serverReporter{
+		reporter: m.reporter,
+		rpc:      RPC{Type: rpcType, Server: m.server},
+		ctx:      ctx,
+		debug:    m.debug.Load(),
+		degrader: degrader,
+		hooks:    loadHooks(m.hooks),
+	}
+	r.rpc.Service, r.rpc.Method = splitMethodName(fullMethod)
+	if b, ok := r.reporter.(rpcBinder); ok {
+		r.reporter = b.bind(r.rpc)
+	}
+	if t, ok := r.reporter.(timingReporter); !ok || t.timed() || r.debug != nil || r.hooks != nil {
+		r.startTime = time.Now()
+	}
+	r.reporter.StartedRPC(r.rpc)
+	return r
+}
+
+func (r *serverReporter) ReceivedMessage() {
+	r.reporter.ReceivedMessage(r.rpc)
+	if r.hooks != nil {
+		r.msgs.received.Add(1)
+	}
+}
+
+func (r *serverReporter) SentMessage() {
+	r.reporter.SentMessage(r.rpc)
+	if r.hooks != nil {
+		r.msgs.sent.Add(1)
+	}
+}
+
+// Handled reports the RPC as completed with err, whose status is st, nil
+// meaning OK.
+func (r *serverReporter) Handled(st *status.Status, err error) {
+	duration := elapsed(r.startTime)
+	r.reporter.Handled(r.rpc, st.Code(), duration)
+	if r.debug != nil {
+		r.debug.record(r.rpc, duration, st, peerAddr(r.ctx))
+	}
+	if r.degrader != nil {
+		r.degrader.observe(r.rpc.Service, st.Code())
+	}
+	if r.hooks != nil {
+		r.msgs.call(r.hooks, RPCInfo{RPC: r.rpc, Code: st.Code(), Err: err, Duration: duration, Peer: peerAddr(r.ctx), Context: r.ctx})
+	}
+}
+
+// promServerReporter is the Reporter recording into the Prometheus metrics of
+// a ServerMetrics.
+type promServerReporter struct {
+	metrics *ServerMetrics
+}
+
+// serverHandles are the metrics of a method resolved by promServerReporter.
+type serverHandles struct {
+	lvs      []string
+	started  lazyCounter
+	received lazyCounter
+	sent     lazyCounter
+	handled  codeCounters
+	handling atomic.Pointer[histogramHandle]
+}
+
+func (r *promServerReporter) newHandles(rpc RPC) interface{} {
+	return &serverHandles{lvs: r.metrics.serverLabel.values(rpc.Server, string(rpc.Type), rpc.Service, rpc.Method)}
+}
+
+func (r *promServerReporter) handles(rpc RPC) *serverHandles {
+	return r.metrics.handles.load(rpc, r.newHandles).(*serverHandles)
+}
+
+func (r *promServerReporter) bind(rpc RPC) Reporter {
+	b := r.bound(rpc)
+	return &b
+}
+
+// bound returns r bound to the handles of the method of rpc, resolving
+// whether its handling time is observed.
+func (r *promServerReporter) bound(rpc RPC) boundServerReporter {
+	h := r.handles(rpc)
+	return boundServerReporter{
+		promServerReporter: r,
+		h:                  h,
+		handling:           r.metrics.serverHandledHistogram.resolve(&h.handling, rpc, h.lvs),
+		slo:                r.metrics.serverSLICounter.objective(rpc.Service, rpc.Method),
+	}
+}
+
+func (r *promServerReporter) StartedRPC(rpc RPC) {
+	boundServerReporter{promServerReporter: r, h: r.handles(rpc)}.StartedRPC(rpc)
+}
+
+func (r *promServerReporter) ReceivedMessage(rpc RPC) {
+	boundServerReporter{promServerReporter: r, h: r.handles(rpc)}.ReceivedMessage(rpc)
+}
+
+func (r *promServerReporter) SentMessage(rpc RPC) {
+	boundServerReporter{promServerReporter: r, h: r.handles(rpc)}.SentMessage(rpc)
+}
+
+func (r *promServerReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.bound(rpc).Handled(rpc, code, duration)
+}
+
+// boundServerReporter is a promServerReporter bound to the handles of the
+// method of an RPC.
+type boundServerReporter struct {
+	*promServerReporter
+	h        *serverHandles
+	handling prom.Observer // nil if not observed, e.g. when sampled out
+	slo      *SLO
+}
+
+func (r boundServerReporter) StartedRPC(RPC) {
+	r.h.started.get(r.metrics.handles, r.metrics.serverStartedCounter, r.h.lvs).Inc()
+}
+
+func (r boundServerReporter) ReceivedMessage(RPC) {
+	r.h.received.get(r.metrics.handles, r.metrics.serverStreamMsgReceived, r.h.lvs).Inc()
+}
+
+func (r boundServerReporter) SentMessage(RPC) {
+	r.h.sent.get(r.metrics.handles, r.metrics.serverStreamMsgSent, r.h.lvs).Inc()
+}
+
+func (r boundServerReporter) Handled(rpc RPC, code codes.Code, duration time.Duration) {
+	r.h.handled.get(r.metrics.handles, r.metrics.serverHandledCounter, r.h.lvs, code).Inc()
+	if r.handling != nil {
+		r.handling.Observe(duration.Seconds())
+	}
+	if r.slo != nil {
+		r.metrics.serverSLICounter.vec.WithLabelValues(append(r.h.lvs[:len(r.h.lvs):len(r.h.lvs)], sliResult(r.slo.good(code, duration)))...).Inc()
+	}
+}
+
+func (r boundServerReporter) timed() bool {
+	return r.handling != nil || r.slo != nil
+}
+
+// InitializeMethod pre-populates the labels of a method and binds its
+// handles. These are just references (no increments), as just referencing
+// will create the labels but not set values.
+func (r *promServerReporter) InitializeMethod(rpc RPC) {
+	h := r.handles(rpc)
+	h.started.get(r.metrics.handles, r.metrics.serverStartedCounter, h.lvs)
+	h.received.get(r.metrics.handles, r.metrics.serverStreamMsgReceived, h.lvs)
+	h.sent.get(r.metrics.handles, r.metrics.serverStreamMsgSent, h.lvs)
+	r.metrics.serverHandledHistogram.resolve(&h.handling, rpc, h.lvs)
+	for _, code := range allCodes {
+		h.handled.get(r.metrics.handles, r.metrics.serverHandledCounter, h.lvs, code)
+	}
+	if r.metrics.serverSLICounter.objective(rpc.Service, rpc.Method) != nil {
+		r.metrics.serverSLICounter.vec.GetMetricWithLabelValues(append(h.lvs[:len(h.lvs):len(h.lvs)], sliResult(true))...)
+		r.metrics.serverSLICounter.vec.GetMetricWithLabelValues(append(h.lvs[:len(h.lvs):len(h.lvs)], sliResult(false))...)
+	}
+}
@@ -0,0 +1,140 @@
+package grpcprom
+
+import (
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultSLIBadCodes are the codes counted as bad SLI events when an SLO
+// does not list its own. They signal a server-side problem, as opposed to
+// e.g. NotFound or InvalidArgument, which are caused by the caller.
+var DefaultSLIBadCodes = []codes.Code{
+	codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss,
+}
+
+// SLO defines which completed RPCs of a set of methods are good and which are
+// bad events of a service level indicator.
+type SLO struct {
+	// Service is the fully-qualified service the SLO applies to. Empty
+	// matches all services.
+	Service string
+	// Method is the method the SLO applies to. Empty matches all methods.
+	Method string
+	// LatencyThreshold makes RPCs taking longer bad events. Zero disables
+	// the latency criterion.
+	LatencyThreshold time.Duration
+	// BadCodes are the codes that make an RPC a bad event. Defaults to
+	// DefaultSLIBadCodes.
+	BadCodes []codes.Code
+}
+
+// good reports whether an RPC completed with code after duration is a good
+// event.
+func (s *SLO) good(code codes.Code, duration time.Duration) bool {
+	if s.LatencyThreshold > 0 && duration > s.LatencyThreshold {
+		return false
+	}
+	badCodes := s.BadCodes
+	if badCodes == nil {
+		badCodes = DefaultSLIBadCodes
+	}
+	for _, c := range badCodes {
+		if c == code {
+			return false
+		}
+	}
+	return true
+}
+
+type sloKey struct {
+	service, method string
+}
+
+// sloSet looks up the SLO of a method. The most specific SLO wins: one naming
+// service and method, then one naming only the service, then only the method,
+// then one naming neither.
+type sloSet map[sloKey]*SLO
+
+func newSLOSet(slos []SLO) sloSet {
+	set := make(sloSet, len(slos))
+	for i := range slos {
+		s := slos[i]
+		set[sloKey{s.Service, s.Method}] = &s
+	}
+	return set
+}
+
+func (set sloSet) lookup(service, method string) *SLO {
+	if s, ok := set[sloKey{service, method}]; ok {
+		return s
+	}
+	if s, ok := set[sloKey{service, ""}]; ok {
+		return s
+	}
+	if s, ok := set[sloKey{"", method}]; ok {
+		return s
+	}
+	return set[sloKey{}]
+}
+
+func sliResult(good bool) string {
+	if good {
+		return "good"
+	}
+	return "bad"
+}
+
+// sliCounter counts SLI events by the objectives it is enabled with. It can be
+// enabled concurrently with counting and collection, and is always described
+// so that it can be enabled after registration.
+type sliCounter struct {
+	vec *prom.CounterVec
+
+	mu   sync.RWMutex
+	slos sloSet // nil while disabled
+}
+
+func newSLICounter(opts prom.CounterOpts, labelNames ...string) *sliCounter {
+	return &sliCounter{vec: prom.NewCounterVec(opts, labelNames)}
+}
+
+func (c *sliCounter) enable(slos []SLO) {
+	set := newSLOSet(slos)
+	c.mu.Lock()
+	c.slos = set
+	c.mu.Unlock()
+}
+
+// objective returns the SLO of a method, or nil if the method has none or
+// counting is disabled.
+func (c *sliCounter) objective(service, method string) *SLO {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.slos == nil {
+		return nil
+	}
+	return c.slos.lookup(service, method)
+}
+
+// Reset deletes all series.
+func (c *sliCounter) Reset() {
+	c.vec.Reset()
+}
+
+// Describe implements prom.Collector.
+func (c *sliCounter) Describe(ch chan<- *prom.Desc) {
+	c.vec.Describe(ch)
+}
+
+// Collect implements prom.Collector.
+func (c *sliCounter) Collect(ch chan<- prom.Metric) {
+	c.mu.RLock()
+	enabled := c.slos != nil
+	c.mu.RUnlock()
+	if enabled {
+		c.vec.Collect(ch)
+	}
+}
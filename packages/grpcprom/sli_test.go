@@ -0,0 +1,90 @@
+package grpcprom
+
+import (
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSLOGood(t *testing.T) {
+	slo := &SLO{LatencyThreshold: 100 * time.Millisecond}
+	require.True(t, slo.good(codes.OK, 10*time.Millisecond))
+	require.True(t, slo.good(codes.NotFound, 10*time.Millisecond), "caller errors must not be bad by default")
+	require.False(t, slo.good(codes.Unavailable, 10*time.Millisecond))
+	require.False(t, slo.good(codes.OK, 101*time.Millisecond))
+
+	slo = &SLO{BadCodes: []codes.Code{codes.NotFound}}
+	require.False(t, slo.good(codes.NotFound, time.Hour))
+	require.True(t, slo.good(codes.Internal, time.Hour), "explicit bad codes must replace the defaults")
+}
+
+func TestSLOSetLookup(t *testing.T) {
+	set := newSLOSet([]SLO{
+		{LatencyThreshold: 1},
+		{Method: "Ping", LatencyThreshold: 2},
+		{Service: "svc", LatencyThreshold: 3},
+		{Service: "svc", Method: "Ping", LatencyThreshold: 4},
+	})
+	require.EqualValues(t, 4, set.lookup("svc", "Ping").LatencyThreshold)
+	require.EqualValues(t, 3, set.lookup("svc", "PingList").LatencyThreshold)
+	require.EqualValues(t, 2, set.lookup("other", "Ping").LatencyThreshold)
+	require.EqualValues(t, 1, set.lookup("other", "PingList").LatencyThreshold)
+	require.Nil(t, newSLOSet([]SLO{{Service: "svc"}}).lookup("other", "Ping"))
+}
+
+func TestServerSLIEvents(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableSLIEvents(SLO{Service: "mwitkow.testproto.TestService", LatencyThreshold: 50 * time.Millisecond})
+
+	server := grpc.NewServer()
+	pb_testproto.RegisterTestServiceServer(server, &testService{t: t})
+	m.InitializeMetrics(server)
+	require.Equal(t, float64(0), testutil.ToFloat64(m.serverSLICounter.vec.WithLabelValues("unary", "mwitkow.testproto.TestService", "Ping", "bad")))
+
+	ping := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+	m.reporter.Handled(ping, codes.OK, time.Millisecond)
+	m.reporter.Handled(ping, codes.NotFound, time.Millisecond)
+	m.reporter.Handled(ping, codes.OK, time.Second)
+	m.reporter.Handled(ping, codes.Internal, time.Millisecond)
+	m.reporter.Handled(RPC{Type: Unary, Service: "other.Service", Method: "Ping"}, codes.Internal, time.Millisecond)
+
+	require.Equal(t, float64(2), testutil.ToFloat64(m.serverSLICounter.vec.WithLabelValues("unary", "mwitkow.testproto.TestService", "Ping", "good")))
+	require.Equal(t, float64(2), testutil.ToFloat64(m.serverSLICounter.vec.WithLabelValues("unary", "mwitkow.testproto.TestService", "Ping", "bad")))
+	ch := make(chan prometheus.Metric, 100)
+	m.serverSLICounter.Collect(ch)
+	require.Len(t, ch, 8, "methods without SLO must not be counted")
+}
+
+func TestClientSLIEvents(t *testing.T) {
+	m := NewClientMetrics()
+	m.EnableClientSLIEvents(SLO{BadCodes: []codes.Code{codes.Unavailable}})
+
+	ping := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+	m.reporter.Handled(ping, codes.Internal, time.Millisecond)
+	m.reporter.Handled(ping, codes.Unavailable, time.Millisecond)
+
+	require.Equal(t, float64(1), testutil.ToFloat64(m.clientSLICounter.vec.WithLabelValues("unary", "mwitkow.testproto.TestService", "Ping", "good")))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.clientSLICounter.vec.WithLabelValues("unary", "mwitkow.testproto.TestService", "Ping", "bad")))
+}
+
+func TestSLIEventsEnabledConcurrently(t *testing.T) {
+	m := NewServerMetrics()
+	ping := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			m.reporter.Handled(ping, codes.OK, time.Millisecond)
+			ch := make(chan prometheus.Metric, 100)
+			m.Collect(ch)
+		}
+	}()
+	m.EnableSLIEvents(SLO{Service: "mwitkow.testproto.TestService"})
+	<-done
+}
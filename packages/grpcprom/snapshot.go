@@ -0,0 +1,341 @@
+package grpcprom
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+)
+
+// snapshotWindow is the window of the recent statistics of snapshots. The
+// history of snapshots is sampled at a tenth of it.
+const snapshotWindow = time.Minute
+
+// Snapshot holds the statistics of every method, read from the same metrics
+// as those exported to Prometheus.
+type Snapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+	// Window is the time covered by the Recent statistics of the methods, up
+	// to about a minute. It is zero for the first snapshot.
+	Window time.Duration
+	// Methods are the statistics of the methods, ordered by service, method,
+	// type and server.
+	Methods []MethodSnapshot
+}
+
+// MethodSnapshot holds the statistics of a method.
+type MethodSnapshot struct {
+	RPC RPC
+	// InFlight is the number of RPCs started but not handled yet.
+	InFlight int64
+	// Total are the statistics since the metrics were created or reset.
+	Total MethodStats
+	// Recent are the statistics over the window of the snapshot.
+	Recent MethodStats
+}
+
+// MethodStats are the counts of RPCs of a method and their handling time.
+type MethodStats struct {
+	Started     uint64
+	Handled     map[codes.Code]uint64
+	MsgReceived uint64
+	MsgSent     uint64
+	// Latency is the handling time histogram, nil while it is disabled.
+	Latency *LatencyHistogram
+}
+
+// HandledCount returns the number of RPCs handled, regardless of their code.
+func (s MethodStats) HandledCount() uint64 {
+	var n uint64
+	for _, count := range s.Handled {
+		n += count
+	}
+	return n
+}
+
+// ErrorCount returns the number of RPCs handled with a code other than OK.
+func (s MethodStats) ErrorCount() uint64 {
+	return s.HandledCount() - s.Handled[codes.OK]
+}
+
+// Rate returns the number of RPCs handled per second over window.
+func (s MethodStats) Rate(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	return float64(s.HandledCount()) / window.Seconds()
+}
+
+// ErrorRatio returns the fraction of RPCs handled with a code other than OK,
+// or zero if none were handled.
+func (s MethodStats) ErrorRatio() float64 {
+	handled := s.HandledCount()
+	if handled == 0 {
+		return 0
+	}
+	return float64(s.ErrorCount()) / float64(handled)
+}
+
+// LatencyHistogram is a handling time histogram.
+type LatencyHistogram struct {
+	Count uint64
+	// Sum is the sum of the handling times in seconds.
+	Sum float64
+	// Buckets are the cumulative counts of handling times up to their upper
+	// bound in seconds, in increasing order, excluding the +Inf bucket.
+	Buckets []Bucket
+}
+
+// Bucket is a bucket of a LatencyHistogram.
+type Bucket struct {
+	UpperBound      float64
+	CumulativeCount uint64
+}
+
+// Quantile estimates the q-quantile of the handling time, 0 <= q <= 1, by
+// interpolating linearly within its bucket, like histogram_quantile in
+// Prometheus. It returns zero without observations, and the highest upper
+// bound if the quantile falls in the +Inf bucket.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h == nil || h.Count == 0 || len(h.Buckets) == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	lower, below := 0.0, uint64(0)
+	for _, b := range h.Buckets {
+		if float64(b.CumulativeCount) >= rank {
+			seconds := b.UpperBound
+			if in := b.CumulativeCount - below; in > 0 {
+				seconds = lower + (b.UpperBound-lower)*(rank-float64(below))/float64(in)
+			}
+			return time.Duration(seconds * float64(time.Second))
+		}
+		lower, below = b.UpperBound, b.CumulativeCount
+	}
+	return time.Duration(h.Buckets[len(h.Buckets)-1].UpperBound * float64(time.Second))
+}
+
+// add returns the observations of h and o, or o if h is nil or has other
+// buckets.
+func (h *LatencyHistogram) add(o *LatencyHistogram) *LatencyHistogram {
+	if h == nil || len(h.Buckets) != len(o.Buckets) {
+		return o
+	}
+	for i, b := range o.Buckets {
+		if b.UpperBound != h.Buckets[i].UpperBound {
+			return o
+		}
+	}
+	for i, b := range o.Buckets {
+		h.Buckets[i].CumulativeCount += b.CumulativeCount
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	return h
+}
+
+// sub returns the observations of h since those of base, or h if base is
+// not an earlier state of the same histogram, e.g. after a reset.
+func (h *LatencyHistogram) sub(base *LatencyHistogram) *LatencyHistogram {
+	if h == nil || base == nil || base.Count > h.Count || len(base.Buckets) != len(h.Buckets) {
+		return h
+	}
+	d := &LatencyHistogram{Count: h.Count - base.Count, Sum: h.Sum - base.Sum, Buckets: make([]Bucket, len(h.Buckets))}
+	for i, b := range h.Buckets {
+		if b.UpperBound != base.Buckets[i].UpperBound || b.CumulativeCount < base.Buckets[i].CumulativeCount {
+			return h
+		}
+		d.Buckets[i] = Bucket{UpperBound: b.UpperBound, CumulativeCount: b.CumulativeCount - base.Buckets[i].CumulativeCount}
+	}
+	return d
+}
+
+// sub returns the statistics of s since those of base, or s if base is not
+// an earlier state of the same method, e.g. after a reset.
+func (s MethodStats) sub(base MethodStats) MethodStats {
+	if base.Started > s.Started || base.MsgReceived > s.MsgReceived || base.MsgSent > s.MsgSent {
+		return s
+	}
+	for code, count := range base.Handled {
+		if count > s.Handled[code] {
+			return s
+		}
+	}
+	d := MethodStats{
+		Started:     s.Started - base.Started,
+		Handled:     make(map[codes.Code]uint64, len(s.Handled)),
+		MsgReceived: s.MsgReceived - base.MsgReceived,
+		MsgSent:     s.MsgSent - base.MsgSent,
+		Latency:     s.Latency.sub(base.Latency),
+	}
+	for code, count := range s.Handled {
+		d.Handled[code] = count - base.Handled[code]
+	}
+	return d
+}
+
+// snapshotVecs are the metrics a snapshot is read from.
+type snapshotVecs struct {
+	started, handled, received, sent *prom.CounterVec
+	handling                         *histogramVec
+}
+
+// read returns the statistics of every method in the metrics.
+func (v snapshotVecs) read() map[RPC]*MethodStats {
+	stats := map[RPC]*MethodStats{}
+	method := func(m *dto.Metric) *MethodStats {
+		rpc := rpcOfLabels(m)
+		s, ok := stats[rpc]
+		if !ok {
+			s = &MethodStats{Handled: map[codes.Code]uint64{}}
+			stats[rpc] = s
+		}
+		return s
+	}
+	for _, m := range collectMetrics(v.started) {
+		method(m).Started = uint64(m.GetCounter().GetValue())
+	}
+	// Client-side RPCs are handled and timed per backend, which snapshots
+	// add up.
+	for _, m := range collectMetrics(v.handled) {
+		if code, ok := codeOfLabel(labelValueOf(m, "grpc_code")); ok {
+			method(m).Handled[code] += uint64(m.GetCounter().GetValue())
+		}
+	}
+	for _, m := range collectMetrics(v.received) {
+		method(m).MsgReceived = uint64(m.GetCounter().GetValue())
+	}
+	for _, m := range collectMetrics(v.sent) {
+		method(m).MsgSent = uint64(m.GetCounter().GetValue())
+	}
+	for _, m := range collectMetrics(v.handling) {
+		h := m.GetHistogram()
+		l := &LatencyHistogram{Count: h.GetSampleCount(), Sum: h.GetSampleSum()}
+		for _, b := range h.GetBucket() {
+			if !math.IsInf(b.GetUpperBound(), +1) {
+				l.Buckets = append(l.Buckets, Bucket{UpperBound: b.GetUpperBound(), CumulativeCount: b.GetCumulativeCount()})
+			}
+		}
+		s := method(m)
+		s.Latency = s.Latency.add(l)
+	}
+	return stats
+}
+
+// codeOfLabel returns the code of a grpc_code label value.
+func codeOfLabel(label string) (codes.Code, bool) {
+	for _, code := range allCodes {
+		if code.String() == label {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// collectMetrics returns the metrics collected from c.
+func collectMetrics(c prom.Collector) []*dto.Metric {
+	ch := make(chan prom.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var metrics []*dto.Metric
+	for m := range ch {
+		out := &dto.Metric{}
+		if err := m.Write(out); err == nil {
+			metrics = append(metrics, out)
+		}
+	}
+	return metrics
+}
+
+func rpcOfLabels(m *dto.Metric) RPC {
+	return RPC{
+		Type:    GRPCType(labelValueOf(m, "grpc_type")),
+		Service: labelValueOf(m, "grpc_service"),
+		Method:  labelValueOf(m, "grpc_method"),
+		Server:  labelValueOf(m, "grpc_server"),
+		Target:  labelValueOf(m, "grpc_target"),
+	}
+}
+
+func labelValueOf(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// snapshotHistory keeps the statistics read by recent snapshots, to compute
+// the statistics over the window of the next.
+type snapshotHistory struct {
+	mu      sync.Mutex
+	samples []snapshotSample
+}
+
+type snapshotSample struct {
+	time  time.Time
+	stats map[RPC]*MethodStats
+}
+
+// snapshot returns the snapshot of the statistics read at now, and records
+// them for later snapshots.
+func (h *snapshotHistory) snapshot(now time.Time, stats map[RPC]*MethodStats) Snapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// The base is the newest sample at least a window old, or the oldest
+	// sample if none is. Older samples are no longer needed.
+	base := 0
+	for i, s := range h.samples {
+		if now.Sub(s.time) >= snapshotWindow {
+			base = i
+		}
+	}
+	h.samples = h.samples[base:]
+	if n := len(h.samples); n == 0 || now.Sub(h.samples[n-1].time) >= snapshotWindow/10 {
+		h.samples = append(h.samples, snapshotSample{time: now, stats: stats})
+	}
+
+	snap := Snapshot{Time: now}
+	var baseStats map[RPC]*MethodStats
+	if len(h.samples) > 0 && h.samples[0].time.Before(now) {
+		snap.Window = now.Sub(h.samples[0].time)
+		baseStats = h.samples[0].stats
+	}
+	for rpc, s := range stats {
+		m := MethodSnapshot{RPC: rpc, Total: *s}
+		if handled := s.HandledCount(); s.Started > handled {
+			m.InFlight = int64(s.Started - handled)
+		}
+		if b, ok := baseStats[rpc]; ok {
+			m.Recent = s.sub(*b)
+		} else if baseStats != nil {
+			m.Recent = *s
+		}
+		snap.Methods = append(snap.Methods, m)
+	}
+	sort.Slice(snap.Methods, func(i, j int) bool {
+		a, b := snap.Methods[i].RPC, snap.Methods[j].RPC
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Server != b.Server {
+			return a.Server < b.Server
+		}
+		return a.Target < b.Target
+	})
+	return snap
+}
@@ -0,0 +1,68 @@
+package grpcprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestServerMetricsSnapshot(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableHandlingTimeHistogram(WithHistogramBuckets([]float64{0.1, 1}))
+	rpc := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+	for i := 0; i < 4; i++ {
+		m.reporter.StartedRPC(rpc)
+	}
+	m.reporter.Handled(rpc, codes.OK, 50*time.Millisecond)
+	m.reporter.Handled(rpc, codes.OK, 50*time.Millisecond)
+	m.reporter.Handled(rpc, codes.Internal, 500*time.Millisecond)
+
+	snap := m.Snapshot()
+	require.Zero(t, snap.Window, "the first snapshot has no recent statistics")
+	require.Len(t, snap.Methods, 1)
+	method := snap.Methods[0]
+	require.Equal(t, rpc, method.RPC)
+	require.EqualValues(t, 1, method.InFlight)
+	require.EqualValues(t, 4, method.Total.Started)
+	require.Equal(t, map[codes.Code]uint64{codes.OK: 2, codes.Internal: 1}, method.Total.Handled)
+	require.InDelta(t, 1.0/3, method.Total.ErrorRatio(), 1e-9)
+	require.Equal(t, 75*time.Millisecond, method.Total.Latency.Quantile(0.5))
+	require.Equal(t, time.Second, method.Total.Latency.Quantile(1))
+}
+
+func TestSnapshotRecentWindow(t *testing.T) {
+	rpc := RPC{Type: Unary, Service: "mwitkow.testproto.TestService", Method: "Ping"}
+	stats := func(started uint64, ok uint64) map[RPC]*MethodStats {
+		return map[RPC]*MethodStats{rpc: {
+			Started: started,
+			Handled: map[codes.Code]uint64{codes.OK: ok},
+			Latency: &LatencyHistogram{Count: ok, Buckets: []Bucket{{UpperBound: 1, CumulativeCount: ok}}},
+		}}
+	}
+	h := &snapshotHistory{}
+	start := time.Now()
+
+	h.snapshot(start, stats(10, 10))
+	snap := h.snapshot(start.Add(10*time.Second), stats(30, 30))
+	require.Equal(t, 10*time.Second, snap.Window)
+	require.EqualValues(t, 20, snap.Methods[0].Recent.Started)
+	require.EqualValues(t, 20, snap.Methods[0].Recent.Latency.Count)
+	require.Equal(t, 2.0, snap.Methods[0].Recent.Rate(snap.Window))
+
+	snap = h.snapshot(start.Add(80*time.Second), stats(100, 100))
+	require.Equal(t, 70*time.Second, snap.Window, "the window must start at the newest snapshot at least a minute old")
+	require.EqualValues(t, 70, snap.Methods[0].Recent.Started)
+
+	snap = h.snapshot(start.Add(90*time.Second), stats(5, 5))
+	require.EqualValues(t, 5, snap.Methods[0].Recent.Started, "counts must restart after a reset")
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+	h := &LatencyHistogram{Count: 10, Buckets: []Bucket{{0.1, 4}, {0.5, 8}}}
+	require.Equal(t, 50*time.Millisecond, h.Quantile(0.2))
+	require.Equal(t, 300*time.Millisecond, h.Quantile(0.6))
+	require.Equal(t, 500*time.Millisecond, h.Quantile(0.9), "quantiles in the +Inf bucket must be the highest bound")
+	require.Zero(t, (*LatencyHistogram)(nil).Quantile(0.5))
+}
@@ -0,0 +1,253 @@
+package grpcprom
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// streamAgeBuckets are the buckets of the active stream age histograms,
+// ranging from a second to a day as streams may be long-lived.
+var streamAgeBuckets = []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}
+
+// streamTracker keeps the active streams of each method once enabled, and
+// exports the age of the oldest one and a histogram of all of their ages when
+// collected. Stuck subscriptions and leaked streams show as growing ages.
+//
+// Once idle thresholds are set, it also tracks the time since the last
+// message of every stream, and exports how many streams are idle for longer
+// than each threshold and how many ended after having been.
+type streamTracker struct {
+	oldest      *prom.Desc
+	ages        *prom.Desc
+	idle        *prom.Desc
+	idleEnded   *prom.CounterVec
+	labelValues func(RPC) []string
+
+	// agesEnabled is set while the ages are exported, and idleEnabled while
+	// thresholds is not empty, for streams to check without locking. Streams
+	// are only tracked while either is.
+	agesEnabled atomic.Bool
+	idleEnabled atomic.Bool
+
+	mu         sync.Mutex
+	streams    map[RPC]map[*activeStream]struct{}
+	thresholds []time.Duration
+}
+
+// activeStream is a stream tracked by a streamTracker.
+type activeStream struct {
+	tracker *streamTracker
+	rpc     RPC
+	started time.Time
+
+	// last is the time of the last message in Unix nanoseconds, and maxIdle
+	// the longest time between two messages so far, while idle thresholds
+	// are set.
+	last    atomic.Int64
+	maxIdle atomic.Int64
+}
+
+// newStreamTracker returns a streamTracker of metrics named after opts, with
+// the given prefix such as "grpc_server", with labels filled by labelValues.
+func newStreamTracker(opts prom.CounterOpts, prefix string, labelNames []string, labelValues func(RPC) []string) *streamTracker {
+	name := func(name string) string {
+		return prom.BuildFQName(opts.Namespace, opts.Subsystem, prefix+name)
+	}
+	return &streamTracker{
+		oldest: prom.NewDesc(name("_oldest_active_stream_age_seconds"),
+			"Age (seconds) of the oldest active stream of the method.",
+			labelNames, opts.ConstLabels),
+		ages: prom.NewDesc(name("_active_stream_age_seconds"),
+			"Histogram of the age (seconds) of the active streams of the method.",
+			labelNames, opts.ConstLabels),
+		idle: prom.NewDesc(name("_idle_streams"),
+			"Number of active streams of the method without messages for longer than the idle threshold (seconds).",
+			append(labelNames[:len(labelNames):len(labelNames)], "idle_threshold"), opts.ConstLabels),
+		idleEnded: prom.NewCounterVec(prom.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        prefix + "_idle_streams_ended_total",
+			Help:        "Total number of streams of the method that ended after being without messages for longer than the idle threshold (seconds).",
+			ConstLabels: opts.ConstLabels,
+		}, append(labelNames[:len(labelNames):len(labelNames)], "idle_threshold")),
+		labelValues: labelValues,
+		streams:     make(map[RPC]map[*activeStream]struct{}),
+	}
+}
+
+// tracking reports whether new streams are to be tracked.
+func (t *streamTracker) tracking() bool {
+	return t.agesEnabled.Load() || t.idleEnabled.Load()
+}
+
+// setAgesEnabled enables or disables exporting the ages of active streams.
+func (t *streamTracker) setAgesEnabled(enabled bool) {
+	t.agesEnabled.Store(enabled)
+}
+
+// track adds a stream of the method of rpc, started now.
+func (t *streamTracker) track(rpc RPC) *activeStream {
+	s := &activeStream{tracker: t, rpc: rpc, started: time.Now()}
+	s.last.Store(s.started.UnixNano())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active, ok := t.streams[rpc]
+	if !ok {
+		active = make(map[*activeStream]struct{})
+		t.streams[rpc] = active
+	}
+	active[s] = struct{}{}
+	return s
+}
+
+// untrack removes a stream once it ended, counting it for every idle
+// threshold it exceeded. It may be called more than once.
+func (t *streamTracker) untrack(s *activeStream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := t.streams[s.rpc]
+	if _, ok := active[s]; !ok {
+		return
+	}
+	delete(active, s)
+	if len(active) == 0 {
+		delete(t.streams, s.rpc)
+	}
+	if len(t.thresholds) == 0 {
+		return
+	}
+	maxIdle := time.Duration(s.maxIdle.Load())
+	if idle := time.Since(time.Unix(0, s.last.Load())); idle > maxIdle {
+		maxIdle = idle
+	}
+	lvs := t.labelValues(s.rpc)
+	for _, threshold := range t.thresholds {
+		if maxIdle > threshold {
+			t.idleEnded.WithLabelValues(append(lvs, thresholdLabel(threshold))...).Inc()
+		}
+	}
+}
+
+// touch records a message of the stream. It does nothing for streams that
+// are not tracked.
+func (s *activeStream) touch() {
+	if s == nil || !s.tracker.idleEnabled.Load() {
+		return
+	}
+	now := time.Now().UnixNano()
+	idle := now - s.last.Swap(now)
+	for {
+		maxIdle := s.maxIdle.Load()
+		if idle <= maxIdle || s.maxIdle.CompareAndSwap(maxIdle, idle) {
+			return
+		}
+	}
+}
+
+// setIdleThresholds sets the idle thresholds, or disables idle tracking if
+// there are none. As messages were not timed before, all active streams
+// count as active now.
+func (t *streamTracker) setIdleThresholds(thresholds []time.Duration) {
+	thresholds = append([]time.Duration(nil), thresholds...)
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+	for i := 1; i < len(thresholds); i++ {
+		if thresholds[i] == thresholds[i-1] {
+			thresholds = append(thresholds[:i], thresholds[i+1:]...)
+			i--
+		}
+	}
+	now := time.Now().UnixNano()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.idleEnabled.Load() {
+		for _, active := range t.streams {
+			for s := range active {
+				s.last.Store(now)
+				s.maxIdle.Store(0)
+			}
+		}
+	}
+	t.thresholds = thresholds
+	t.idleEnabled.Store(len(thresholds) > 0)
+}
+
+func thresholdLabel(threshold time.Duration) string {
+	return strconv.FormatFloat(threshold.Seconds(), 'f', -1, 64)
+}
+
+// Reset deletes the counts of streams ended idle.
+func (t *streamTracker) Reset() {
+	t.idleEnded.Reset()
+}
+
+// Describe implements prom.Collector.
+func (t *streamTracker) Describe(ch chan<- *prom.Desc) {
+	ch <- t.oldest
+	ch <- t.ages
+	ch <- t.idle
+	t.idleEnded.Describe(ch)
+}
+
+// streamStats are the ages and idle streams of the active streams of a
+// method, computed under the mutex of a streamTracker to be sent after.
+type streamStats struct {
+	rpc         RPC
+	count       uint64
+	oldest, sum float64
+	buckets     map[float64]uint64
+	idle        []int
+}
+
+// Collect implements prom.Collector.
+func (t *streamTracker) Collect(ch chan<- prom.Metric) {
+	now := time.Now()
+	ages := t.agesEnabled.Load()
+	t.mu.Lock()
+	thresholds := t.thresholds
+	stats := make([]streamStats, 0, len(t.streams))
+	for rpc, active := range t.streams {
+		st := streamStats{
+			rpc:     rpc,
+			count:   uint64(len(active)),
+			buckets: make(map[float64]uint64, len(streamAgeBuckets)),
+			idle:    make([]int, len(thresholds)),
+		}
+		for s := range active {
+			age := now.Sub(s.started).Seconds()
+			if age > st.oldest {
+				st.oldest = age
+			}
+			st.sum += age
+			for _, b := range streamAgeBuckets {
+				if age <= b {
+					st.buckets[b]++
+				}
+			}
+			idleFor := now.Sub(time.Unix(0, s.last.Load()))
+			for i, threshold := range thresholds {
+				if idleFor > threshold {
+					st.idle[i]++
+				}
+			}
+		}
+		stats = append(stats, st)
+	}
+	t.mu.Unlock()
+
+	for _, st := range stats {
+		lvs := t.labelValues(st.rpc)
+		if ages {
+			ch <- prom.MustNewConstMetric(t.oldest, prom.GaugeValue, st.oldest, lvs...)
+			ch <- prom.MustNewConstHistogram(t.ages, st.count, st.sum, st.buckets, lvs...)
+		}
+		for i, threshold := range thresholds {
+			ch <- prom.MustNewConstMetric(t.idle, prom.GaugeValue, float64(st.idle[i]), append(lvs, thresholdLabel(threshold))...)
+		}
+	}
+	t.idleEnded.Collect(ch)
+}
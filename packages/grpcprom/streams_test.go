@@ -0,0 +1,160 @@
+package grpcprom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestServerMetricsActiveStreams(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableStreamAgeMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	info := &grpc.StreamServerInfo{FullMethod: "/mwitkow.testproto.TestService/PingStream", IsClientStream: true, IsServerStream: true}
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	handler := func(interface{}, grpc.ServerStream) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		go func() {
+			m.StreamServerInterceptor()(nil, &benchServerStream{ctx: context.Background()}, info, handler)
+			done <- struct{}{}
+		}()
+		<-started
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	oldest := gatherMetric(t, reg, "grpc_server_oldest_active_stream_age_seconds")
+	require.NotNil(t, oldest, "active streams must be exported")
+	require.Equal(t, "bidi_stream", labelValueOf(oldest, "grpc_type"))
+	require.GreaterOrEqual(t, oldest.GetGauge().GetValue(), 0.01, "the first stream is at least as old as the sleep after it")
+	ages := gatherMetric(t, reg, "grpc_server_active_stream_age_seconds").GetHistogram()
+	require.EqualValues(t, 2, ages.GetSampleCount())
+	require.EqualValues(t, 2, ages.GetBucket()[0].GetCumulativeCount())
+
+	close(release)
+	<-done
+	<-done
+	require.Nil(t, gatherMetric(t, reg, "grpc_server_oldest_active_stream_age_seconds"),
+		"finished streams must no longer be exported")
+}
+
+func TestClientMetricsActiveStreams(t *testing.T) {
+	m := NewClientMetrics()
+	m.EnableClientStreamAgeMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	streamer := func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+		return nil, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	_, err := m.StreamClientInterceptor()(ctx, desc, nil, "/mwitkow.testproto.TestService/PingList", streamer)
+	require.NoError(t, err)
+
+	oldest := gatherMetric(t, reg, "grpc_client_oldest_active_stream_age_seconds")
+	require.NotNil(t, oldest, "active streams must be exported")
+	require.Equal(t, "server_stream", labelValueOf(oldest, "grpc_type"))
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return gatherMetric(t, reg, "grpc_client_oldest_active_stream_age_seconds") == nil
+	}, time.Second, time.Millisecond, "streams whose context is done must no longer be exported")
+}
+
+func TestServerMetricsStreamAgesOptIn(t *testing.T) {
+	m := NewServerMetrics()
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	info := &grpc.StreamServerInfo{FullMethod: "/mwitkow.testproto.TestService/PingStream", IsClientStream: true, IsServerStream: true}
+	var active bool
+	handler := func(interface{}, grpc.ServerStream) error {
+		active = gatherMetric(t, reg, "grpc_server_oldest_active_stream_age_seconds") != nil
+		return nil
+	}
+	m.StreamServerInterceptor()(nil, &benchServerStream{ctx: context.Background()}, info, handler)
+	require.False(t, active, "streams must not be tracked unless enabled")
+	require.Empty(t, m.serverStreams.streams)
+
+	m.EnableStreamAgeMetrics()
+	m.StreamServerInterceptor()(nil, &benchServerStream{ctx: context.Background()}, info, handler)
+	require.True(t, active)
+	m.DisableStreamAgeMetrics()
+	m.StreamServerInterceptor()(nil, &benchServerStream{ctx: context.Background()}, info, handler)
+	require.False(t, active)
+}
+
+func TestServerMetricsIdleStreams(t *testing.T) {
+	m := NewServerMetrics()
+	m.EnableIdleStreamMetrics(time.Hour, 10*time.Millisecond, time.Hour)
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, m.RegisterTo(reg))
+
+	info := &grpc.StreamServerInfo{FullMethod: "/mwitkow.testproto.TestService/PingStream", IsClientStream: true, IsServerStream: true}
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	handler := func(_ interface{}, stream grpc.ServerStream) error {
+		stream.SendMsg(&pb_testproto.PingResponse{})
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	go func() {
+		m.StreamServerInterceptor()(nil, &benchServerStream{ctx: context.Background()}, info, handler)
+		done <- struct{}{}
+	}()
+	<-started
+	time.Sleep(20 * time.Millisecond)
+
+	idle := map[string]float64{}
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == "grpc_server_idle_streams" {
+			for _, metric := range mf.GetMetric() {
+				idle[labelValueOf(metric, "idle_threshold")] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	require.Equal(t, map[string]float64{"0.01": 1, "3600": 0}, idle)
+
+	close(release)
+	<-done
+	ended := gatherMetric(t, reg, "grpc_server_idle_streams_ended_total")
+	require.Equal(t, "0.01", labelValueOf(ended, "idle_threshold"), "streams must only count for the thresholds exceeded")
+	require.EqualValues(t, 1, ended.GetCounter().GetValue())
+}
+
+// gatherMetric returns the only series of the named metric family, or nil if
+// it is not exported.
+func gatherMetric(t *testing.T, reg prometheus.Gatherer, name string) *dto.Metric {
+	metrics := gatherMetrics(t, reg, name)
+	if metrics == nil {
+		return nil
+	}
+	require.Len(t, metrics, 1)
+	return metrics[0]
+}
+
+// gatherMetrics returns the series of the named metric family.
+func gatherMetrics(t *testing.T, reg prometheus.Gatherer, name string) []*dto.Metric {
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package grpcprom
+
+import (
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// targetLabels assigns the grpc_target label of client-side RPCs if
+// enabled, and leads the labels of client metrics with it.
+type targetLabels struct {
+	// mapper is nil if disabled.
+	mapper *targetMapper
+}
+
+// targetMapper maps the targets of ClientConns to their label, caching the
+// label of every target mapped so far.
+type targetMapper struct {
+	fn     func(target string) string
+	labels sync.Map
+}
+
+func newTargetLabels(fn func(target string) string) *targetLabels {
+	if fn == nil {
+		return &targetLabels{}
+	}
+	return &targetLabels{mapper: &targetMapper{fn: fn}}
+}
+
+// names prefixes the label names of a client metric with grpc_target if
+// enabled.
+func (t *targetLabels) names(names ...string) []string {
+	if t.mapper == nil {
+		return names
+	}
+	return append([]string{"grpc_target"}, names...)
+}
+
+// values prefixes the label values of a client metric with the grpc_target
+// label of rpc if enabled.
+func (t *targetLabels) values(rpc RPC, values ...string) []string {
+	if t.mapper == nil {
+		return values
+	}
+	return append([]string{rpc.Target}, values...)
+}
+
+// label returns the grpc_target label of the RPCs of cc, empty if disabled.
+func (t *targetLabels) label(cc *grpc.ClientConn) string {
+	m := t.mapper
+	if m == nil || cc == nil {
+		return ""
+	}
+	target := cc.Target()
+	if label, ok := m.labels.Load(target); ok {
+		return label.(string)
+	}
+	label := m.fn(target)
+	m.labels.Store(target, label)
+	return label
+}
+
+// NormalizeTarget returns the endpoint of a dial target resolved to a host
+// and port, without its scheme and authority, so that e.g.
+// "dns:///orders:443" and "orders:443" are labeled alike. Targets of other
+// schemes keep it, so that they are not labeled like a host of the same
+// name, and unix socket targets keep their path, "unix:///tmp/sock" being
+// labeled "unix:/tmp/sock" like its equivalent. It is the default mapping of
+// WithClientTargetLabel.
+func NormalizeTarget(target string) string {
+	i := strings.Index(target, "://")
+	if i < 0 {
+		return target
+	}
+	scheme, rest := target[:i], target[i+len("://"):]
+	switch scheme {
+	case "dns", "passthrough":
+		if j := strings.Index(rest, "/"); j >= 0 {
+			return rest[j+1:]
+		}
+		return rest
+	case "unix":
+		if strings.HasPrefix(rest, "/") {
+			return "unix:" + rest
+		}
+	}
+	return target
+}
@@ -0,0 +1,86 @@
+package grpcprom
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestClientMetricsTargetLabel(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	pb_testproto.RegisterTestServiceServer(server, &testService{t: t})
+	go server.Serve(lis)
+	defer server.Stop()
+
+	addr := lis.Addr().String()
+	// started returns the RPCs started by target label, with metrics created
+	// with opts, after calling the server once with each kind of target.
+	started := func(opts ...Option) (map[string]float64, *prometheus.Registry) {
+		m := NewClientMetricsWithOptions(opts...)
+		m.EnableClientHandlingTimeHistogram()
+		reg := prometheus.NewPedanticRegistry()
+		require.NoError(t, m.RegisterTo(reg))
+		for _, target := range []string{addr, "passthrough:///" + addr} {
+			conn, err := grpc.Dial(target, grpc.WithInsecure(), grpc.WithUnaryInterceptor(m.UnaryClientInterceptor()))
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = pb_testproto.NewTestServiceClient(conn).PingEmpty(context.Background(), &pb_testproto.Empty{})
+			require.NoError(t, err)
+		}
+		counts := map[string]float64{}
+		for _, metric := range gatherMetrics(t, reg, "grpc_client_started_total") {
+			counts[labelValueOf(metric, "grpc_target")] += metric.GetCounter().GetValue()
+		}
+		return counts, reg
+	}
+
+	counts, reg := started()
+	for _, metric := range gatherMetrics(t, reg, "grpc_client_started_total") {
+		for _, l := range metric.GetLabel() {
+			require.NotEqual(t, "grpc_target", l.GetName(), "targets must not be labeled unless enabled")
+		}
+	}
+	require.Equal(t, map[string]float64{"": 2}, counts)
+
+	counts, _ = started(WithClientTargetLabel(nil))
+	require.Equal(t, map[string]float64{addr: 2}, counts, "targets must be normalized by default")
+
+	counts, reg = started(WithClientTargetLabel(func(target string) string {
+		if strings.HasPrefix(target, "passthrough:") {
+			return "passthrough"
+		}
+		return "direct"
+	}))
+	require.Equal(t, map[string]float64{"direct": 1, "passthrough": 1}, counts)
+	for _, metric := range gatherMetrics(t, reg, "grpc_client_handling_seconds") {
+		if labelValueOf(metric, "grpc_target") == "passthrough" {
+			require.EqualValues(t, 1, metric.GetHistogram().GetSampleCount(), "histograms must be labeled by target too")
+		}
+	}
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	for target, want := range map[string]string{
+		"orders:443":                "orders:443",
+		"dns:///orders:443":         "orders:443",
+		"dns://8.8.8.8/orders:443":  "orders:443",
+		"passthrough:///10.0.0.1:5": "10.0.0.1:5",
+		"bufnet":                    "bufnet",
+		"unix:///tmp/sock":          "unix:/tmp/sock",
+		"unix:/tmp/sock":            "unix:/tmp/sock",
+		"unix:relative/sock":        "unix:relative/sock",
+		"unix-abstract:sock":        "unix-abstract:sock",
+		"unix-abstract:///sock":     "unix-abstract:///sock",
+		"xds:///orders":             "xds:///orders",
+	} {
+		require.Equal(t, want, NormalizeTarget(target), target)
+	}
+}
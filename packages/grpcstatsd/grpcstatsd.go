@@ -0,0 +1,401 @@
+// Package grpcstatsd exports the metrics of the gRPC interceptors to a StatsD
+// or DogStatsD agent over UDP.
+//
+// An Exporter implements grpcprom.Reporter and is plugged into the
+// interceptors with grpcprom.NewServerMetricsWithReporter or
+// grpcprom.NewClientMetricsWithReporter. Counters are aggregated in memory
+// and sent in batched packets every flush interval. Handling times are only
+// sent while the handling time histogram of the ServerMetrics or
+// ClientMetrics is enabled, as a bounded sample of each series per flush.
+package grpcstatsd
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// Format selects how labels are encoded in the emitted lines.
+type Format int
+
+const (
+	// DogStatsD appends labels as tags, e.g. `name:1|c|#grpc_code:OK`.
+	DogStatsD Format = iota
+	// StatsD appends label values to the metric name as dot-separated
+	// segments, e.g. `name.none.unary.Service.Method.OK:1|c`, for agents that
+	// do not support tags. The first segment is the grpc_server label of
+	// server metrics or the grpc_target label of client metrics, or "none"
+	// while empty, so that every segment keeps its position.
+	StatsD
+)
+
+// noneSegment stands for an empty grpc_server or grpc_target label in the
+// StatsD format.
+const noneSegment = "none"
+
+const (
+	defaultFlushInterval = time.Second
+	// defaultMaxPacketSize keeps packets under the typical Ethernet MTU.
+	defaultMaxPacketSize = 1432
+	// defaultMaxTimerSamples bounds the handling times buffered per series
+	// between flushes.
+	defaultMaxTimerSamples = 100
+)
+
+type options struct {
+	flushInterval   time.Duration
+	maxPacketSize   int
+	maxTimerSamples int
+	format          Format
+	tags            []string
+}
+
+// An Option lets you configure an Exporter using With* funcs.
+type Option func(*options)
+
+// WithFlushInterval sets how often aggregated metrics are sent. Defaults to
+// one second.
+func WithFlushInterval(d time.Duration) Option {
+	return func(o *options) { o.flushInterval = d }
+}
+
+// WithMaxPacketSize sets the maximum size in bytes of a single UDP packet.
+// Defaults to 1432 bytes.
+func WithMaxPacketSize(n int) Option {
+	return func(o *options) { o.maxPacketSize = n }
+}
+
+// WithMaxTimerSamples sets how many handling times of a series are buffered
+// between flushes. Beyond it, a uniform sample of them is sent with its
+// sample rate, so that agents scale the counts they derive from it.
+// Defaults to 100.
+func WithMaxTimerSamples(n int) Option {
+	return func(o *options) { o.maxTimerSamples = n }
+}
+
+// WithFormat sets the line format. Defaults to DogStatsD.
+func WithFormat(f Format) Option {
+	return func(o *options) { o.format = f }
+}
+
+// WithTags adds constant `key:value` tags to every metric. They are ignored
+// in the StatsD format.
+func WithTags(tags ...string) Option {
+	return func(o *options) { o.tags = append(o.tags, tags...) }
+}
+
+// Exporter is a grpcprom.Reporter sending metrics to a StatsD agent. It is a
+// grpcprom.HistogramReporter, so that handling times are only timed while the
+// handling time histogram is enabled; stream message times are not sent.
+type Exporter struct {
+	conn   net.Conn
+	prefix string
+	opts   options
+
+	mu       sync.Mutex
+	counters map[metricKey]int64
+	timers   map[metricKey]*timerSamples
+	timed    bool // whether the handling time histogram is enabled
+
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// metricKey identifies a series by its name and label values.
+type metricKey struct {
+	name    string
+	server  string
+	target  string
+	rpcType grpcprom.GRPCType
+	service string
+	method  string
+	code    string
+}
+
+// NewServerExporter returns an Exporter emitting the grpc_server_* metrics to
+// the agent listening on the UDP address addr.
+func NewServerExporter(addr string, opts ...Option) (*Exporter, error) {
+	return newExporter("grpc_server", addr, opts)
+}
+
+// NewClientExporter returns an Exporter emitting the grpc_client_* metrics to
+// the agent listening on the UDP address addr.
+func NewClientExporter(addr string, opts ...Option) (*Exporter, error) {
+	return newExporter("grpc_client", addr, opts)
+}
+
+func newExporter(prefix string, addr string, opts []Option) (*Exporter, error) {
+	o := options{
+		flushInterval:   defaultFlushInterval,
+		maxPacketSize:   defaultMaxPacketSize,
+		maxTimerSamples: defaultMaxTimerSamples,
+		format:          DogStatsD,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		conn:     conn,
+		prefix:   prefix,
+		opts:     o,
+		counters: make(map[metricKey]int64),
+		timers:   make(map[metricKey]*timerSamples),
+		done:     make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.loop()
+	return e, nil
+}
+
+func (e *Exporter) loop() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.opts.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Flush()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Close stops the periodic flushing, sends the remaining metrics and closes
+// the connection.
+func (e *Exporter) Close() error {
+	var err error
+	e.closed.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+		if ferr := e.Flush(); ferr != nil {
+			err = ferr
+		}
+		if cerr := e.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// StartedRPC implements grpcprom.Reporter.
+func (e *Exporter) StartedRPC(rpc grpcprom.RPC) {
+	e.count(e.key("_started_total", rpc, ""))
+}
+
+// ReceivedMessage implements grpcprom.Reporter.
+func (e *Exporter) ReceivedMessage(rpc grpcprom.RPC) {
+	e.count(e.key("_msg_received_total", rpc, ""))
+}
+
+// SentMessage implements grpcprom.Reporter.
+func (e *Exporter) SentMessage(rpc grpcprom.RPC) {
+	e.count(e.key("_msg_sent_total", rpc, ""))
+}
+
+// Handled implements grpcprom.Reporter. Handling time is emitted as a
+// timer in milliseconds while the handling time histogram is enabled.
+func (e *Exporter) Handled(rpc grpcprom.RPC, code codes.Code, duration time.Duration) {
+	e.count(e.key("_handled_total", rpc, code.String()))
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.timed {
+		return
+	}
+	k := e.key("_handling_time", rpc, "")
+	t := e.timers[k]
+	if t == nil {
+		t = &timerSamples{}
+		e.timers[k] = t
+	}
+	t.add(float64(duration)/float64(time.Millisecond), e.opts.maxTimerSamples)
+}
+
+// SetHistogram implements grpcprom.HistogramReporter. Handling times are
+// timed while the handling time histogram is enabled, regardless of its
+// buckets.
+func (e *Exporter) SetHistogram(h grpcprom.Histogram, opts *prom.HistogramOpts) {
+	if h != grpcprom.HandlingTimeHistogram {
+		return
+	}
+	e.mu.Lock()
+	e.timed = opts != nil
+	e.mu.Unlock()
+}
+
+// MessageObserver implements grpcprom.HistogramReporter. Stream message
+// times are not sent.
+func (e *Exporter) MessageObserver(grpcprom.Histogram, grpcprom.RPC) prom.Observer {
+	return nil
+}
+
+// timerSamples are the values of a timer buffered between flushes: all of
+// them up to the maximum, then a uniform sample of them.
+type timerSamples struct {
+	values []float64
+	count  int
+}
+
+// add adds v, replacing a random buffered value once max are, so that each
+// value is kept with the same probability.
+func (t *timerSamples) add(v float64, max int) {
+	t.count++
+	if len(t.values) < max {
+		t.values = append(t.values, v)
+		return
+	}
+	if i := rand.Intn(t.count); i < len(t.values) {
+		t.values[i] = v
+	}
+}
+
+func (e *Exporter) key(suffix string, rpc grpcprom.RPC, code string) metricKey {
+	return metricKey{name: e.prefix + suffix, server: rpc.Server, target: rpc.Target, rpcType: rpc.Type, service: rpc.Service, method: rpc.Method, code: code}
+}
+
+func (e *Exporter) count(k metricKey) {
+	e.mu.Lock()
+	e.counters[k]++
+	e.mu.Unlock()
+}
+
+// Flush sends all metrics aggregated since the previous flush. It is called
+// periodically, but may be called directly, e.g. before shutdown.
+func (e *Exporter) Flush() error {
+	e.mu.Lock()
+	counters, timers := e.counters, e.timers
+	e.counters = make(map[metricKey]int64, len(counters))
+	e.timers = make(map[metricKey]*timerSamples, len(timers))
+	e.mu.Unlock()
+
+	var lines []string
+	for k, v := range counters {
+		lines = append(lines, e.line(k, strconv.FormatInt(v, 10), "c"))
+	}
+	for k, t := range timers {
+		lines = append(lines, e.timerLines(k, t)...)
+	}
+	sort.Strings(lines)
+	return e.send(lines)
+}
+
+// timerLines returns the lines of the values of a timer, with their sample
+// rate if they are a sample. In the DogStatsD format, values are packed into
+// as few lines as the maximum packet size allows.
+func (e *Exporter) timerLines(k metricKey, t *timerSamples) []string {
+	kind := "ms"
+	if len(t.values) < t.count {
+		kind += "|@" + strconv.FormatFloat(float64(len(t.values))/float64(t.count), 'g', 6, 64)
+	}
+	var lines []string
+	if e.opts.format != DogStatsD {
+		for _, v := range t.values {
+			lines = append(lines, e.line(k, strconv.FormatFloat(v, 'f', -1, 64), kind))
+		}
+		return lines
+	}
+	overhead := len(e.line(k, "", kind))
+	var packed []byte
+	for _, v := range t.values {
+		value := strconv.FormatFloat(v, 'f', -1, 64)
+		if len(packed) > 0 && overhead+len(packed)+1+len(value) > e.opts.maxPacketSize {
+			lines = append(lines, e.line(k, string(packed), kind))
+			packed = packed[:0]
+		}
+		if len(packed) > 0 {
+			packed = append(packed, ':')
+		}
+		packed = append(packed, value...)
+	}
+	if len(packed) > 0 {
+		lines = append(lines, e.line(k, string(packed), kind))
+	}
+	return lines
+}
+
+// send writes the lines in as few packets as the maximum packet size allows.
+func (e *Exporter) send(lines []string) error {
+	var (
+		buf      bytes.Buffer
+		firstErr error
+	)
+	write := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		if _, err := e.conn.Write(buf.Bytes()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		buf.Reset()
+	}
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(l) > e.opts.maxPacketSize {
+			write()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	write()
+	return firstErr
+}
+
+func (e *Exporter) line(k metricKey, value, kind string) string {
+	if e.opts.format == StatsD {
+		label := k.target
+		if e.prefix == "grpc_server" {
+			label = k.server
+		}
+		if label == "" {
+			label = noneSegment
+		}
+		segments := []string{k.name, label, string(k.rpcType), k.service, k.method}
+		if k.code != "" {
+			segments = append(segments, k.code)
+		}
+		for i := range segments[1:] {
+			segments[i+1] = segmentReplacer.Replace(segments[i+1])
+		}
+		return strings.Join(segments, ".") + ":" + value + "|" + kind
+	}
+	tags := append([]string(nil), e.opts.tags...)
+	if k.server != "" {
+		tags = append(tags, "grpc_server:"+tagReplacer.Replace(k.server))
+	}
+	if k.target != "" {
+		tags = append(tags, "grpc_target:"+tagReplacer.Replace(k.target))
+	}
+	tags = append(tags,
+		"grpc_type:"+string(k.rpcType),
+		"grpc_service:"+tagReplacer.Replace(k.service),
+		"grpc_method:"+tagReplacer.Replace(k.method),
+	)
+	if k.code != "" {
+		tags = append(tags, "grpc_code:"+k.code)
+	}
+	return k.name + ":" + value + "|" + kind + "|#" + strings.Join(tags, ",")
+}
+
+var (
+	// segmentReplacer replaces the characters that are meaningful in StatsD
+	// metric names.
+	segmentReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "\n", "_")
+	// tagReplacer replaces the characters that are meaningful in DogStatsD
+	// tag lists.
+	tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
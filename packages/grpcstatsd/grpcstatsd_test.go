@@ -0,0 +1,166 @@
+package grpcstatsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpcprom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	// exporters must satisfy the HistogramReporter interface
+	_ grpcprom.HistogramReporter = &Exporter{}
+)
+
+var pingEmpty = grpcprom.RPC{Type: grpcprom.Unary, Service: "mwitkow.testproto.TestService", Method: "PingEmpty"}
+
+// listen starts a UDP listener standing in for a StatsD agent.
+func listen(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err, "must be able to allocate a UDP port")
+	return conn
+}
+
+// readPackets reads n packets from the listener.
+func readPackets(t *testing.T, conn net.PacketConn, n int) []string {
+	var packets []string
+	buf := make([]byte, 65535)
+	for i := 0; i < n; i++ {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		l, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err, "must receive packet %d", i)
+		packets = append(packets, string(buf[:l]))
+	}
+	return packets
+}
+
+func TestExporterAggregatesCounters(t *testing.T) {
+	agent := listen(t)
+	defer agent.Close()
+	e, err := NewServerExporter(agent.LocalAddr().String(), WithFlushInterval(time.Hour), WithTags("env:test"))
+	require.NoError(t, err)
+	defer e.Close()
+	e.SetHistogram(grpcprom.HandlingTimeHistogram, &prometheus.HistogramOpts{})
+
+	for i := 0; i < 3; i++ {
+		e.StartedRPC(pingEmpty)
+		e.ReceivedMessage(pingEmpty)
+		e.Handled(pingEmpty, codes.OK, 1500*time.Microsecond)
+	}
+	e.Handled(pingEmpty, codes.Internal, 2*time.Millisecond)
+	require.NoError(t, e.Flush())
+
+	lines := strings.Split(readPackets(t, agent, 1)[0], "\n")
+	tags := "env:test,grpc_type:unary,grpc_service:mwitkow.testproto.TestService,grpc_method:PingEmpty"
+	require.Contains(t, lines, "grpc_server_started_total:3|c|#"+tags)
+	require.Contains(t, lines, "grpc_server_msg_received_total:3|c|#"+tags)
+	require.Contains(t, lines, "grpc_server_handled_total:3|c|#"+tags+",grpc_code:OK")
+	require.Contains(t, lines, "grpc_server_handled_total:1|c|#"+tags+",grpc_code:Internal")
+	require.Contains(t, lines, "grpc_server_handling_time:1.5:1.5:1.5:2|ms|#"+tags, "timer values must be packed")
+	require.Len(t, lines, 5)
+}
+
+func TestExporterTimesOnlyWhileHistogramEnabled(t *testing.T) {
+	agent := listen(t)
+	defer agent.Close()
+	e, err := NewServerExporter(agent.LocalAddr().String(), WithFlushInterval(time.Hour))
+	require.NoError(t, err)
+	defer e.Close()
+
+	e.Handled(pingEmpty, codes.OK, time.Millisecond)
+	require.NoError(t, e.Flush())
+	require.Equal(t, []string{"grpc_server_handled_total:1|c|#grpc_type:unary,grpc_service:mwitkow.testproto.TestService,grpc_method:PingEmpty,grpc_code:OK"},
+		strings.Split(readPackets(t, agent, 1)[0], "\n"))
+
+	e.SetHistogram(grpcprom.HandlingTimeHistogram, &prometheus.HistogramOpts{})
+	e.Handled(pingEmpty, codes.OK, time.Millisecond)
+	e.SetHistogram(grpcprom.HandlingTimeHistogram, nil)
+	e.Handled(pingEmpty, codes.OK, 2*time.Millisecond)
+	require.NoError(t, e.Flush())
+	require.Contains(t, strings.Split(readPackets(t, agent, 1)[0], "\n"),
+		"grpc_server_handling_time:1|ms|#grpc_type:unary,grpc_service:mwitkow.testproto.TestService,grpc_method:PingEmpty")
+}
+
+func TestExporterSamplesTimers(t *testing.T) {
+	agent := listen(t)
+	defer agent.Close()
+	e, err := NewServerExporter(agent.LocalAddr().String(), WithFlushInterval(time.Hour),
+		WithFormat(StatsD), WithMaxTimerSamples(10))
+	require.NoError(t, err)
+	defer e.Close()
+	e.SetHistogram(grpcprom.HandlingTimeHistogram, &prometheus.HistogramOpts{})
+
+	for i := 0; i < 40; i++ {
+		e.Handled(pingEmpty, codes.OK, time.Millisecond)
+	}
+	require.Len(t, e.timers, 1)
+	for _, timer := range e.timers {
+		require.Len(t, timer.values, 10, "buffered timer values must be capped")
+	}
+	require.NoError(t, e.Flush())
+
+	var timers []string
+	for _, l := range strings.Split(readPackets(t, agent, 1)[0], "\n") {
+		if strings.HasPrefix(l, "grpc_server_handling_time.") {
+			timers = append(timers, l)
+		}
+	}
+	require.Len(t, timers, 10)
+	require.Equal(t, "grpc_server_handling_time.none.unary.mwitkow_testproto_TestService.PingEmpty:1|ms|@0.25", timers[0],
+		"sampled timers must carry their sample rate")
+}
+
+func TestExporterServerTag(t *testing.T) {
+	agent := listen(t)
+	defer agent.Close()
+	e, err := NewServerExporter(agent.LocalAddr().String(), WithFlushInterval(time.Hour))
+	require.NoError(t, err)
+	defer e.Close()
+
+	admin := pingEmpty
+	admin.Server = "admin"
+	e.StartedRPC(admin)
+	e.StartedRPC(pingEmpty)
+	require.NoError(t, e.Flush())
+
+	lines := strings.Split(readPackets(t, agent, 1)[0], "\n")
+	require.ElementsMatch(t, []string{
+		"grpc_server_started_total:1|c|#grpc_server:admin,grpc_type:unary,grpc_service:mwitkow.testproto.TestService,grpc_method:PingEmpty",
+		"grpc_server_started_total:1|c|#grpc_type:unary,grpc_service:mwitkow.testproto.TestService,grpc_method:PingEmpty",
+	}, lines, "servers must be tagged only when named")
+}
+
+func TestExporterStatsDFormatAndPacketSize(t *testing.T) {
+	agent := listen(t)
+	defer agent.Close()
+	e, err := NewClientExporter(agent.LocalAddr().String(),
+		WithFlushInterval(time.Hour), WithFormat(StatsD), WithMaxPacketSize(100))
+	require.NoError(t, err)
+
+	e.StartedRPC(pingEmpty)
+	e.SentMessage(pingEmpty)
+	require.NoError(t, e.Close(), "Close must flush remaining metrics")
+
+	packets := readPackets(t, agent, 2)
+	require.ElementsMatch(t, []string{
+		"grpc_client_msg_sent_total.none.unary.mwitkow_testproto_TestService.PingEmpty:1|c",
+		"grpc_client_started_total.none.unary.mwitkow_testproto_TestService.PingEmpty:1|c",
+	}, packets, "lines exceeding the maximum packet size must be split, and empty targets keep their segment")
+}
+
+func TestExporterFlushesPeriodically(t *testing.T) {
+	agent := listen(t)
+	defer agent.Close()
+	e, err := NewServerExporter(agent.LocalAddr().String(), WithFlushInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer e.Close()
+
+	e.StartedRPC(pingEmpty)
+	packets := readPackets(t, agent, 1)
+	require.True(t, strings.HasPrefix(packets[0], "grpc_server_started_total:1|c|#"), packets[0])
+}
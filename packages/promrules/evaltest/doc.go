@@ -0,0 +1,5 @@
+// Package evaltest evaluates the rules generated by promrules with the
+// Prometheus query engine against synthetic series. It is a separate module
+// so that the Prometheus server does not become a dependency of
+// go-grpc-prometheus.
+package evaltest
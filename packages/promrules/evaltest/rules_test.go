@@ -0,0 +1,114 @@
+package evaltest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/promrules"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/rulefmt"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/promqltest"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// The synthetic series cover 75 hours, longer than the longest burn-rate
+// window of 3 days, at 5 minute resolution. Each service handles 500 RPCs
+// per 5 minutes:
+//   - healthy.Service fails 0.1% of them with NotFound, which is not an error.
+//   - burning.Service fails 5% with Internal, burning the budget fast.
+//   - leaking.Service fails 0.5% with Unavailable, burning it slowly.
+//   - slow.Service handles all of them successfully, but in 0.5s to 1s.
+const series = `
+load 5m
+	grpc_server_handled_total{grpc_service="healthy.Service",grpc_method="Ping",grpc_type="unary",grpc_code="OK"} 0+499x900
+	grpc_server_handled_total{grpc_service="healthy.Service",grpc_method="Ping",grpc_type="unary",grpc_code="NotFound"} 0+1x900
+	grpc_server_handled_total{grpc_service="burning.Service",grpc_method="Ping",grpc_type="unary",grpc_code="OK"} 0+475x900
+	grpc_server_handled_total{grpc_service="burning.Service",grpc_method="Ping",grpc_type="unary",grpc_code="Internal"} 0+25x900
+	grpc_server_handled_total{grpc_service="leaking.Service",grpc_method="Ping",grpc_type="unary",grpc_code="OK"} 0+497.5x900
+	grpc_server_handled_total{grpc_service="leaking.Service",grpc_method="Ping",grpc_type="unary",grpc_code="Unavailable"} 0+2.5x900
+	grpc_server_handled_total{grpc_service="slow.Service",grpc_method="Ping",grpc_type="unary",grpc_code="OK"} 0+500x900
+	grpc_server_handling_seconds_bucket{grpc_service="slow.Service",grpc_method="Ping",grpc_type="unary",le="0.1"} 0+0x900
+	grpc_server_handling_seconds_bucket{grpc_service="slow.Service",grpc_method="Ping",grpc_type="unary",le="0.5"} 0+0x900
+	grpc_server_handling_seconds_bucket{grpc_service="slow.Service",grpc_method="Ping",grpc_type="unary",le="1"} 0+500x900
+	grpc_server_handling_seconds_bucket{grpc_service="slow.Service",grpc_method="Ping",grpc_type="unary",le="+Inf"} 0+500x900
+	grpc_server_handling_seconds_bucket{grpc_service="healthy.Service",grpc_method="Ping",grpc_type="unary",le="0.1"} 0+500x900
+	grpc_server_handling_seconds_bucket{grpc_service="healthy.Service",grpc_method="Ping",grpc_type="unary",le="+Inf"} 0+500x900
+`
+
+const evalTime = 900 * 5 * time.Minute
+
+func TestGeneratedRules(t *testing.T) {
+	f, err := promrules.Generate(promrules.Config{
+		Services: []promrules.Service{
+			{Name: "healthy.Service", LatencyThreshold: 0.25},
+			{Name: "burning.Service"},
+			{Name: "leaking.Service"},
+			{Name: "slow.Service", LatencyThreshold: 0.25},
+		},
+		Availability: 0.999,
+	})
+	require.NoError(t, err)
+	b, err := f.Marshal()
+	require.NoError(t, err)
+	groups, errs := rulefmt.Parse(b)
+	require.Empty(t, errs, "generated rules must be valid")
+
+	st := promqltest.LoadedStorage(t, series)
+	defer st.Close()
+	engine := promql.NewEngine(promql.EngineOpts{MaxSamples: 1e7, Timeout: time.Minute})
+
+	firing := map[string][]string{}
+	for _, g := range groups.Groups {
+		for _, r := range g.Rules {
+			vec := query(t, engine, st, r.Expr.Value)
+			if r.Record.Value != "" {
+				record(t, st, r.Record.Value, vec)
+				continue
+			}
+			for _, s := range vec {
+				firing[s.Metric.Get("grpc_service")] = append(firing[s.Metric.Get("grpc_service")],
+					r.Alert.Value+"/"+r.Labels["severity"])
+			}
+		}
+	}
+	for _, alerts := range firing {
+		sort.Strings(alerts)
+	}
+
+	require.Equal(t, map[string][]string{
+		"burning.Service": {"GRPCErrorBudgetBurn/page", "GRPCErrorBudgetBurn/ticket"},
+		"leaking.Service": {"GRPCErrorBudgetBurn/ticket"},
+		"slow.Service":    {"GRPCHighLatency/ticket"},
+	}, firing)
+
+	ratio := query(t, engine, st, promrules.ErrorRatioRecord("1h")+`{grpc_service="burning.Service"}`)
+	require.Len(t, ratio, 1)
+	require.InDelta(t, 0.05, ratio[0].F, 1e-9)
+}
+
+func query(t *testing.T, engine *promql.Engine, st storage.Queryable, expr string) promql.Vector {
+	q, err := engine.NewInstantQuery(context.Background(), st, nil, expr, time.Unix(0, 0).Add(evalTime))
+	require.NoError(t, err, "expression %q must parse", expr)
+	defer q.Close()
+	res := q.Exec(context.Background())
+	require.NoError(t, res.Err, "expression %q must evaluate", expr)
+	vec, err := res.Vector()
+	require.NoError(t, err)
+	return vec
+}
+
+// record stores the result of a recording rule, as the rule manager of a
+// Prometheus server would.
+func record(t *testing.T, st storage.Appendable, name string, vec promql.Vector) {
+	app := st.Appender(context.Background())
+	for _, s := range vec {
+		lset := labels.NewBuilder(s.Metric).Set(labels.MetricName, name).Labels()
+		_, err := app.Append(0, lset, evalTime.Milliseconds(), s.F)
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+}
@@ -0,0 +1,357 @@
+// Package promrules generates Prometheus recording and alerting rules for
+// gRPC services instrumented with the server-side interceptors.
+//
+// For every service it records the ratio of failed RPCs over the windows
+// used by multi-window, multi-burn-rate alerts (as described in the Google
+// SRE workbook), the quantile of handling time per method, and alerts on
+// error budget burn and, optionally, on high latency. The latency rules
+// require the handling time histogram to be enabled.
+package promrules
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultErrorCodes are the codes counted as failures unless configured
+// otherwise. They are the codes signalling a server-side problem, as opposed
+// to e.g. NotFound or InvalidArgument, which are caused by the caller.
+var DefaultErrorCodes = []codes.Code{
+	codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss,
+}
+
+const (
+	defaultAvailability    = 0.999
+	defaultLatencyQuantile = 0.99
+)
+
+// burnRate is a pair of windows of a multi-window burn-rate alert. The alert
+// fires when the error ratio over both windows exceeds factor times the
+// error budget.
+type burnRate struct {
+	long, short string
+	factor      float64
+}
+
+var (
+	// pageBurnRates consume 2% and 5% of a 30 day error budget in 1 and 6
+	// hours respectively.
+	pageBurnRates = []burnRate{{"1h", "5m", 14.4}, {"6h", "30m", 6}}
+	// ticketBurnRates consume 10% of a 30 day error budget in 1 and 3 days.
+	ticketBurnRates = []burnRate{{"1d", "2h", 3}, {"3d", "6h", 1}}
+	// errorRatioWindows are all windows used by the burn-rate alerts.
+	errorRatioWindows = []string{"5m", "30m", "1h", "2h", "6h", "1d", "3d"}
+)
+
+// Service describes the objectives of a single gRPC service.
+type Service struct {
+	// Name is the fully-qualified service name, as in the grpc_service
+	// label, e.g. "mwitkow.testproto.TestService".
+	Name string
+	// Availability is the objective ratio of RPCs not failing with one of
+	// the error codes, e.g. 0.999. Defaults to Config.Availability.
+	Availability float64
+	// LatencyThreshold, in seconds, enables an alert when the latency
+	// quantile of any method of the service exceeds it.
+	LatencyThreshold float64
+}
+
+// Config configures the generated rules.
+type Config struct {
+	Services []Service
+	// Availability is the default availability objective. Defaults to 0.999.
+	Availability float64
+	// LatencyQuantile is the recorded handling time quantile. Defaults to
+	// 0.99.
+	LatencyQuantile float64
+	// ErrorCodes are the codes counted as failures. Defaults to
+	// DefaultErrorCodes.
+	ErrorCodes []codes.Code
+	// Labels are added to every alert, next to the severity.
+	Labels map[string]string
+}
+
+// RuleFile is a Prometheus rule file.
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a group of rules evaluated together.
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is either a recording rule or an alerting rule.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Generate returns the rules for all configured services, one group per
+// service. A service configured several times, e.g. both by name and from a
+// descriptor set, is generated once if its objectives are the same, and
+// rejected otherwise, since Prometheus rejects rule files with duplicate
+// groups.
+func Generate(cfg Config) (*RuleFile, error) {
+	if len(cfg.Services) == 0 {
+		return nil, fmt.Errorf("promrules: no services configured")
+	}
+	if cfg.Availability == 0 {
+		cfg.Availability = defaultAvailability
+	}
+	if cfg.LatencyQuantile == 0 {
+		cfg.LatencyQuantile = defaultLatencyQuantile
+	}
+	if cfg.LatencyQuantile <= 0 || cfg.LatencyQuantile >= 1 {
+		return nil, fmt.Errorf("promrules: latency quantile %v not in (0, 1)", cfg.LatencyQuantile)
+	}
+	if len(cfg.ErrorCodes) == 0 {
+		cfg.ErrorCodes = DefaultErrorCodes
+	}
+	f := &RuleFile{}
+	seen := make(map[string]Service, len(cfg.Services))
+	for _, s := range cfg.Services {
+		if s.Name == "" {
+			return nil, fmt.Errorf("promrules: service without name")
+		}
+		if s.Availability == 0 {
+			s.Availability = cfg.Availability
+		}
+		if s.Availability <= 0 || s.Availability >= 1 {
+			return nil, fmt.Errorf("promrules: availability %v of %s not in (0, 1)", s.Availability, s.Name)
+		}
+		if prev, ok := seen[s.Name]; ok {
+			if prev != s {
+				return nil, fmt.Errorf("promrules: service %s configured twice with different objectives", s.Name)
+			}
+			continue
+		}
+		seen[s.Name] = s
+		f.Groups = append(f.Groups, serviceGroup(cfg, s))
+	}
+	return f, nil
+}
+
+// ErrorRatioRecord returns the name of the series recording the error ratio
+// over window.
+func ErrorRatioRecord(window string) string {
+	return "grpc_service:grpc_server_error_ratio:rate" + window
+}
+
+// LatencyRecord returns the name of the series recording the given handling
+// time quantile per method over 5 minutes.
+func LatencyRecord(quantile float64) string {
+	return "grpc_service_method:grpc_server_handling_seconds:" + formatQuantile(quantile) + "_rate5m"
+}
+
+func serviceGroup(cfg Config, s Service) RuleGroup {
+	service := fmt.Sprintf("grpc_service=%q", s.Name)
+	failed := fmt.Sprintf("%s,grpc_code=~%q", service, codeRegexp(cfg.ErrorCodes))
+	budget := 1 - s.Availability
+
+	g := RuleGroup{Name: "grpc-" + s.Name}
+	for _, w := range errorRatioWindows {
+		g.Rules = append(g.Rules, Rule{
+			Record: ErrorRatioRecord(w),
+			Expr: fmt.Sprintf("sum by (grpc_service) (rate(grpc_server_handled_total{%s}[%s]))\n/\nsum by (grpc_service) (rate(grpc_server_handled_total{%s}[%s]))",
+				failed, w, service, w),
+		})
+	}
+	g.Rules = append(g.Rules,
+		Rule{
+			Record: "grpc_service_method:grpc_server_handled:rate5m",
+			Expr:   fmt.Sprintf("sum by (grpc_service, grpc_method, grpc_code) (rate(grpc_server_handled_total{%s}[5m]))", service),
+		},
+		Rule{
+			Record: LatencyRecord(cfg.LatencyQuantile),
+			Expr: fmt.Sprintf("histogram_quantile(%s, sum by (grpc_service, grpc_method, le) (rate(grpc_server_handling_seconds_bucket{%s}[5m])))",
+				formatFloat(cfg.LatencyQuantile), service),
+		},
+		Rule{
+			Alert:  "GRPCErrorBudgetBurn",
+			Expr:   burnRateExpr(service, budget, pageBurnRates),
+			For:    "2m",
+			Labels: alertLabels(cfg, "page"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is burning its error budget fast.", s.Name),
+				"description": fmt.Sprintf("%s fails more than %s of RPCs, exhausting a %s availability objective within days.", s.Name, formatRatio(budget*pageBurnRates[1].factor), formatRatio(s.Availability)),
+			},
+		},
+		Rule{
+			Alert:  "GRPCErrorBudgetBurn",
+			Expr:   burnRateExpr(service, budget, ticketBurnRates),
+			For:    "15m",
+			Labels: alertLabels(cfg, "ticket"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is burning its error budget.", s.Name),
+				"description": fmt.Sprintf("%s fails more than %s of RPCs, exhausting a %s availability objective within a month.", s.Name, formatRatio(budget), formatRatio(s.Availability)),
+			},
+		},
+	)
+	if s.LatencyThreshold > 0 {
+		g.Rules = append(g.Rules, Rule{
+			Alert:  "GRPCHighLatency",
+			Expr:   fmt.Sprintf("%s{%s} > %s", LatencyRecord(cfg.LatencyQuantile), service, formatFloat(s.LatencyThreshold)),
+			For:    "10m",
+			Labels: alertLabels(cfg, "ticket"),
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("{{ $labels.grpc_method }} of %s is slow.", s.Name),
+				"description": fmt.Sprintf("The %s handling time of {{ $labels.grpc_method }} is {{ $value | humanizeDuration }}, above %ss.", formatQuantile(cfg.LatencyQuantile), formatFloat(s.LatencyThreshold)),
+			},
+		})
+	}
+	return g
+}
+
+func burnRateExpr(service string, budget float64, rates []burnRate) string {
+	var clauses []string
+	for _, r := range rates {
+		threshold := formatFloat(r.factor * budget)
+		clauses = append(clauses, fmt.Sprintf("(%s{%s} > %s\nand\n%s{%s} > %s)",
+			ErrorRatioRecord(r.long), service, threshold, ErrorRatioRecord(r.short), service, threshold))
+	}
+	return strings.Join(clauses, "\nor\n")
+}
+
+func alertLabels(cfg Config, severity string) map[string]string {
+	labels := map[string]string{"severity": severity}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func codeRegexp(cs []codes.Code) string {
+	names := make([]string, len(cs))
+	for i, c := range cs {
+		names[i] = c.String()
+	}
+	return strings.Join(names, "|")
+}
+
+// formatFloat formats v without the representation noise of floating point
+// arithmetic, e.g. 0.0144 rather than 0.014400000000000012.
+func formatFloat(v float64) string {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 12, 64), 64)
+	return strconv.FormatFloat(rounded, 'g', -1, 64)
+}
+
+func formatRatio(v float64) string {
+	return formatFloat(math.Round(v*1e8)/1e6) + "%"
+}
+
+// formatQuantile names a quantile the way it is commonly spelled, e.g. p99
+// for 0.99 and p999 for 0.999.
+func formatQuantile(q float64) string {
+	return "p" + strings.Replace(formatFloat(q*100), ".", "", 1)
+}
+
+// Marshal returns the rule file as YAML, as loaded by Prometheus.
+func (f *RuleFile) Marshal() ([]byte, error) {
+	return marshalYAML(f)
+}
+
+// prometheusRule is the PrometheusRule custom resource of the Prometheus
+// Operator.
+type prometheusRule struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace,omitempty"`
+	} `yaml:"metadata"`
+	Spec RuleFile `yaml:"spec"`
+}
+
+// MarshalPrometheusRule returns the rule file wrapped in a PrometheusRule
+// resource of the Prometheus Operator, with the given name and namespace.
+func (f *RuleFile) MarshalPrometheusRule(name, namespace string) ([]byte, error) {
+	r := prometheusRule{APIVersion: "monitoring.coreos.com/v1", Kind: "PrometheusRule", Spec: *f}
+	r.Metadata.Name = name
+	r.Metadata.Namespace = namespace
+	return marshalYAML(r)
+}
+
+func marshalYAML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ServicesFromDescriptorSet returns the fully-qualified names of the services
+// defined in a serialized FileDescriptorSet, as produced by
+// `protoc --descriptor_set_out`, once each.
+//
+// Only the services of the given files are returned, named as given to
+// protoc, e.g. "service.proto". Without files, those of the files not
+// imported by another file of the set are, so that the imports included by
+// `protoc --include_imports` are skipped.
+func ServicesFromDescriptorSet(b []byte, files ...string) ([]string, error) {
+	var set descpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("promrules: invalid descriptor set: %v", err)
+	}
+	// named tells the files whose services are returned, and whether they
+	// were found in the set.
+	named := make(map[string]bool, len(files))
+	for _, f := range files {
+		named[f] = false
+	}
+	if len(files) == 0 {
+		imported := make(map[string]bool)
+		for _, f := range set.GetFile() {
+			for _, dep := range f.GetDependency() {
+				imported[dep] = true
+			}
+		}
+		for _, f := range set.GetFile() {
+			if !imported[f.GetName()] {
+				named[f.GetName()] = false
+			}
+		}
+	}
+	var services []string
+	seen := make(map[string]bool)
+	for _, f := range set.GetFile() {
+		if _, ok := named[f.GetName()]; !ok {
+			continue
+		}
+		named[f.GetName()] = true
+		for _, s := range f.GetService() {
+			name := s.GetName()
+			if pkg := f.GetPackage(); pkg != "" {
+				name = pkg + "." + name
+			}
+			if !seen[name] {
+				seen[name] = true
+				services = append(services, name)
+			}
+		}
+	}
+	for _, f := range files {
+		if !named[f] {
+			return nil, fmt.Errorf("promrules: file %s not in descriptor set", f)
+		}
+	}
+	return services, nil
+}
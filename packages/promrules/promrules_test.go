@@ -0,0 +1,155 @@
+package promrules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	descpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerate(t *testing.T) {
+	f, err := Generate(Config{
+		Services: []Service{
+			{Name: "mwitkow.testproto.TestService", LatencyThreshold: 0.25},
+			{Name: "other.Service", Availability: 0.99},
+		},
+		ErrorCodes: []codes.Code{codes.Internal, codes.Unavailable},
+		Labels:     map[string]string{"team": "infra"},
+	})
+	require.NoError(t, err)
+	require.Len(t, f.Groups, 2)
+
+	alerts := map[string][]Rule{}
+	records := map[string]Rule{}
+	for _, r := range f.Groups[0].Rules {
+		if r.Alert != "" {
+			alerts[r.Alert] = append(alerts[r.Alert], r)
+		} else {
+			records[r.Record] = r
+		}
+	}
+	for _, w := range errorRatioWindows {
+		require.Contains(t, records, ErrorRatioRecord(w))
+	}
+	require.Contains(t, records[ErrorRatioRecord("5m")].Expr, `grpc_code=~"Internal|Unavailable"`)
+	require.Contains(t, records, "grpc_service_method:grpc_server_handling_seconds:p99_rate5m")
+	require.Len(t, alerts["GRPCErrorBudgetBurn"], 2)
+	require.Equal(t, map[string]string{"severity": "page", "team": "infra"}, alerts["GRPCErrorBudgetBurn"][0].Labels)
+	require.Contains(t, alerts["GRPCErrorBudgetBurn"][0].Expr, "> 0.0144")
+	require.Len(t, alerts["GRPCHighLatency"], 1)
+	require.Contains(t, alerts["GRPCHighLatency"][0].Expr, "> 0.25")
+
+	for _, r := range f.Groups[1].Rules {
+		require.NotEqual(t, "GRPCHighLatency", r.Alert, "latency alert must only be generated with a threshold")
+	}
+	require.Contains(t, f.Groups[1].Rules[len(f.Groups[1].Rules)-1].Expr, "> 0.01\n", "per-service availability must override the default")
+}
+
+func TestGenerateMergesDuplicateServices(t *testing.T) {
+	f, err := Generate(Config{
+		Services:     []Service{{Name: "s"}, {Name: "other"}, {Name: "s", Availability: 0.995}},
+		Availability: 0.995,
+	})
+	require.NoError(t, err)
+	require.Len(t, f.Groups, 2, "Prometheus rejects duplicate group names")
+	require.Equal(t, "grpc-s", f.Groups[0].Name)
+	require.Equal(t, "grpc-other", f.Groups[1].Name)
+}
+
+func TestGenerateRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{Services: []Service{{}}},
+		{Services: []Service{{Name: "s", Availability: 1}}},
+		{Services: []Service{{Name: "s"}}, LatencyQuantile: 2},
+		{Services: []Service{{Name: "s"}, {Name: "s", Availability: 0.99}}},
+	} {
+		_, err := Generate(cfg)
+		require.Error(t, err, "config %+v must be rejected", cfg)
+	}
+}
+
+func TestLatencyRecord(t *testing.T) {
+	require.Equal(t, "grpc_service_method:grpc_server_handling_seconds:p99_rate5m", LatencyRecord(0.99))
+	require.Equal(t, "grpc_service_method:grpc_server_handling_seconds:p999_rate5m", LatencyRecord(0.999))
+	require.Equal(t, "grpc_service_method:grpc_server_handling_seconds:p50_rate5m", LatencyRecord(0.5))
+}
+
+func TestMarshal(t *testing.T) {
+	f, err := Generate(Config{Services: []Service{{Name: "mwitkow.testproto.TestService"}}})
+	require.NoError(t, err)
+
+	b, err := f.Marshal()
+	require.NoError(t, err)
+	var decoded RuleFile
+	require.NoError(t, yaml.Unmarshal(b, &decoded))
+	require.Equal(t, *f, decoded)
+
+	b, err = f.MarshalPrometheusRule("grpc", "monitoring")
+	require.NoError(t, err)
+	var resource prometheusRule
+	require.NoError(t, yaml.Unmarshal(b, &resource))
+	require.Equal(t, "PrometheusRule", resource.Kind)
+	require.Equal(t, "monitoring", resource.Metadata.Namespace)
+	require.Equal(t, *f, resource.Spec)
+}
+
+func TestServicesFromDescriptorSet(t *testing.T) {
+	b, err := proto.Marshal(&descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String("test.proto"),
+				Package: proto.String("mwitkow.testproto"),
+				Service: []*descpb.ServiceDescriptorProto{{Name: proto.String("TestService")}},
+			},
+			{
+				Name:    proto.String("nopackage.proto"),
+				Service: []*descpb.ServiceDescriptorProto{{Name: proto.String("Bare")}, {Name: proto.String("Other")}},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	services, err := ServicesFromDescriptorSet(b)
+	require.NoError(t, err)
+	require.Equal(t, []string{"mwitkow.testproto.TestService", "Bare", "Other"}, services)
+
+	// As produced by protoc --include_imports for service.proto.
+	b, err = proto.Marshal(&descpb.FileDescriptorSet{
+		File: []*descpb.FileDescriptorProto{
+			{
+				Name:    proto.String("grpc/health/v1/health.proto"),
+				Package: proto.String("grpc.health.v1"),
+				Service: []*descpb.ServiceDescriptorProto{{Name: proto.String("Health")}},
+			},
+			{
+				Name:       proto.String("common.proto"),
+				Package:    proto.String("shop"),
+				Dependency: []string{"grpc/health/v1/health.proto"},
+				Service:    []*descpb.ServiceDescriptorProto{{Name: proto.String("Admin")}},
+			},
+			{
+				Name:       proto.String("service.proto"),
+				Package:    proto.String("shop"),
+				Dependency: []string{"common.proto"},
+				Service:    []*descpb.ServiceDescriptorProto{{Name: proto.String("Orders")}, {Name: proto.String("Orders")}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	services, err = ServicesFromDescriptorSet(b)
+	require.NoError(t, err)
+	require.Equal(t, []string{"shop.Orders"}, services, "imports must be skipped and services listed once")
+	services, err = ServicesFromDescriptorSet(b, "common.proto", "service.proto")
+	require.NoError(t, err)
+	require.Equal(t, []string{"shop.Admin", "shop.Orders"}, services)
+	_, err = ServicesFromDescriptorSet(b, "missing.proto")
+	require.EqualError(t, err, "promrules: file missing.proto not in descriptor set")
+
+	_, err = ServicesFromDescriptorSet([]byte("not a descriptor set"))
+	require.True(t, err != nil && strings.Contains(err.Error(), "invalid descriptor set"), "got %v", err)
+}
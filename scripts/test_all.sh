@@ -12,3 +12,10 @@ for d in $(go list ./... | grep -v vendor); do
     fi
     echo ""
 done
+
+# Modules nested in this repository, kept separate because of their dependencies.
+for m in packages/grpcotel packages/promrules/evaltest; do
+    echo -e "TESTS FOR: for \033[0;35m${m}\033[0m"
+    (cd $m && go test -race -v ./...)
+    echo ""
+done
@@ -6,8 +6,14 @@
 package grpc_prometheus
 
 import (
+	"net/http"
+	"time"
+
 	prom "github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/tap"
 )
 
 var (
@@ -24,10 +30,9 @@ var (
 )
 
 func init() {
-	prom.MustRegister(DefaultServerMetrics.serverStartedCounter)
-	prom.MustRegister(DefaultServerMetrics.serverHandledCounter)
-	prom.MustRegister(DefaultServerMetrics.serverStreamMsgReceived)
-	prom.MustRegister(DefaultServerMetrics.serverStreamMsgSent)
+	if err := DefaultServerMetrics.RegisterTo(prom.DefaultRegisterer); err != nil {
+		panic(err)
+	}
 }
 
 // Register takes a gRPC server and pre-initializes all counters to 0. This
@@ -44,5 +49,99 @@ func Register(server *grpc.Server) {
 // variable and the default Prometheus metrics registry.
 func EnableHandlingTimeHistogram(opts ...HistogramOption) {
 	DefaultServerMetrics.EnableHandlingTimeHistogram(opts...)
-	prom.Register(DefaultServerMetrics.serverHandledHistogram)
+}
+
+// OverrideHandlingTimeHistogram makes the handling time of the methods
+// matching pattern, e.g. "/package.Service/*", be recorded with different
+// histogram options. This function acts on the DefaultServerMetrics variable.
+func OverrideHandlingTimeHistogram(pattern string, opts ...HistogramOption) error {
+	return DefaultServerMetrics.OverrideHandlingTimeHistogram(pattern, opts...)
+}
+
+// SampleHandlingTimeHistogram makes the methods matching pattern only observe
+// the handling time of one in every `every` RPCs, exported scaled
+// accordingly. This function acts on the DefaultServerMetrics variable.
+func SampleHandlingTimeHistogram(pattern string, every int) error {
+	return DefaultServerMetrics.SampleHandlingTimeHistogram(pattern, every)
+}
+
+// EnableStreamAgeMetrics enables exporting the ages of active streams. This
+// function acts on the DefaultServerMetrics variable.
+func EnableStreamAgeMetrics() {
+	DefaultServerMetrics.EnableStreamAgeMetrics()
+}
+
+// DisableStreamAgeMetrics disables exporting the ages of active streams. This
+// function acts on the DefaultServerMetrics variable.
+func DisableStreamAgeMetrics() {
+	DefaultServerMetrics.DisableStreamAgeMetrics()
+}
+
+// EnableIdleStreamMetrics enables exporting how many streams are without
+// messages for longer than each threshold. This function acts on the
+// DefaultServerMetrics variable.
+func EnableIdleStreamMetrics(thresholds ...time.Duration) {
+	DefaultServerMetrics.EnableIdleStreamMetrics(thresholds...)
+}
+
+// InstrumentHealthServer returns a HealthServer wrapping h, to be registered
+// and updated instead of h, whose serving statuses are exported. This
+// function acts on the DefaultServerMetrics variable.
+func InstrumentHealthServer(h *health.Server) *HealthServer {
+	return DefaultServerMetrics.InstrumentHealthServer(h)
+}
+
+// EnableHealthDegradation turns on setting services to NOT_SERVING on h while
+// their error ratio is too high, and back to their previous status once it
+// dropped. This function acts on the DefaultServerMetrics variable.
+func EnableHealthDegradation(h ServingStatusSetter, d HealthDegradation) error {
+	return DefaultServerMetrics.EnableHealthDegradation(h, d)
+}
+
+// DisableHealthDegradation turns off degrading the health of services, and
+// restores those degraded. This function acts on the DefaultServerMetrics
+// variable.
+func DisableHealthDegradation() {
+	DefaultServerMetrics.DisableHealthDegradation()
+}
+
+// AddRPCHooks adds hooks called with every RPC completed on the server. This
+// function acts on the DefaultServerMetrics variable.
+func AddRPCHooks(hooks ...RPCHook) {
+	DefaultServerMetrics.AddRPCHooks(hooks...)
+}
+
+// DisableHandlingTimeHistogram turns off recording of handling time of RPCs.
+// This function acts on the DefaultServerMetrics variable.
+func DisableHandlingTimeHistogram() {
+	DefaultServerMetrics.DisableHandlingTimeHistogram()
+}
+
+// EnableSLIEvents turns on counting completed RPCs as good or bad events of a
+// service level indicator. This function acts on the DefaultServerMetrics
+// variable and the default Prometheus metrics registry.
+func EnableSLIEvents(slos ...SLO) {
+	DefaultServerMetrics.EnableSLIEvents(slos...)
+}
+
+// HTTPGatewayMiddleware returns an http.Handler recording the requests served
+// by next, a grpc-gateway ServeMux, under grpc_type="http_gateway". This
+// function acts on the DefaultServerMetrics variable.
+func HTTPGatewayMiddleware(next http.Handler) http.Handler {
+	return DefaultServerMetrics.HTTPGatewayMiddleware(next)
+}
+
+// TapHandle returns a tap.ServerInHandle calling h and counting the RPCs it
+// refuses in grpc_server_rejected_total. This function acts on the
+// DefaultServerMetrics variable.
+func TapHandle(h tap.ServerInHandle) tap.ServerInHandle {
+	return DefaultServerMetrics.TapHandle(h)
+}
+
+// RejectionStatsHandler returns a stats.Handler counting the RPCs that fail
+// before reaching the interceptors in grpc_server_rejected_total, forwarding
+// all events to next if not nil. This function acts on the
+// DefaultServerMetrics variable.
+func RejectionStatsHandler(next stats.Handler) stats.Handler {
+	return DefaultServerMetrics.RejectionStatsHandler(next)
 }
@@ -1,27 +1,21 @@
-// Copyright 2016 Michal Witkowski. All Rights Reserved.
-// See LICENSE for licensing terms.
-
 package grpc_prometheus
 
 import (
 	"bufio"
 	"context"
-	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
-	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/client_golang/prometheus/testutil"
-
 	pb_testproto "github.com/grpc-ecosystem/go-grpc-prometheus/examples/testproto"
+	"github.com/grpc-ecosystem/go-grpc-prometheus/packages/grpc_prometheustest"
 	"github.com/prometheus/client_golang/prometheus"
-	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -33,6 +27,10 @@ import (
 var (
 	// server metrics must satisfy the Collector interface
 	_ prometheus.Collector = NewServerMetrics()
+
+	// constructors must keep taking slices of CounterOptions
+	_ = NewServerMetrics([]CounterOption{WithConstLabels(prometheus.Labels{"app": "test"})}...)
+	_ = NewClientMetrics([]CounterOption{WithConstLabels(prometheus.Labels{"app": "test"})}...)
 )
 
 const (
@@ -44,6 +42,9 @@ func TestServerInterceptorSuite(t *testing.T) {
 	suite.Run(t, &ServerInterceptorTestSuite{})
 }
 
+// ServerInterceptorTestSuite drives the package-level functions acting on
+// DefaultServerMetrics, and reads the metrics as scraped from the default
+// Prometheus registry.
 type ServerInterceptorTestSuite struct {
 	suite.Suite
 
@@ -68,7 +69,7 @@ func (s *ServerInterceptorTestSuite) SetupSuite() {
 		grpc.StreamInterceptor(StreamServerInterceptor),
 		grpc.UnaryInterceptor(UnaryServerInterceptor),
 	)
-	pb_testproto.RegisterTestServiceServer(s.server, &testService{t: s.T()})
+	pb_testproto.RegisterTestServiceServer(s.server, &testService{})
 
 	go func() {
 		s.server.Serve(s.serverListener)
@@ -84,20 +85,16 @@ func (s *ServerInterceptorTestSuite) SetupTest() {
 	s.ctx, s.cancel = context.WithTimeout(context.TODO(), 2*time.Second)
 
 	// Make sure every test starts with same fresh, intialized metric state.
-	DefaultServerMetrics.serverStartedCounter.Reset()
-	DefaultServerMetrics.serverHandledCounter.Reset()
-	DefaultServerMetrics.serverHandledHistogram.Reset()
-	DefaultServerMetrics.serverStreamMsgReceived.Reset()
-	DefaultServerMetrics.serverStreamMsgSent.Reset()
+	DefaultServerMetrics.Reset()
 	Register(s.server)
 }
 
 func (s *ServerInterceptorTestSuite) TearDownSuite() {
+	DisableHandlingTimeHistogram()
 	if s.serverListener != nil {
 		s.server.Stop()
 		s.T().Logf("stopped grpc.Server at: %v", s.serverListener.Addr().String())
 		s.serverListener.Close()
-
 	}
 	if s.clientConn != nil {
 		s.clientConn.Close()
@@ -133,27 +130,25 @@ func (s *ServerInterceptorTestSuite) TestRegisterPresetsStuff() {
 func (s *ServerInterceptorTestSuite) TestUnaryIncrementsMetrics() {
 	_, err := s.testClient.PingEmpty(s.ctx, &pb_testproto.Empty{}) // should return with code=OK
 	require.NoError(s.T(), err)
-	requireValue(s.T(), 1, DefaultServerMetrics.serverStartedCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty"))
-	requireValue(s.T(), 1, DefaultServerMetrics.serverHandledCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty", "OK"))
-	requireValueHistCount(s.T(), 1, DefaultServerMetrics.serverHandledHistogram.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingEmpty"))
+	requireValue(s.T(), 1, "grpc_server_started_total", "unary", "mwitkow.testproto.TestService", "PingEmpty")
+	requireValue(s.T(), 1, "grpc_server_handled_total", "unary", "mwitkow.testproto.TestService", "PingEmpty", "OK")
+	requireValue(s.T(), 1, "grpc_server_handling_seconds_count", "unary", "mwitkow.testproto.TestService", "PingEmpty")
 
 	_, err = s.testClient.PingError(s.ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)}) // should return with code=FailedPrecondition
 	require.Error(s.T(), err)
-	requireValue(s.T(), 1, DefaultServerMetrics.serverStartedCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError"))
-	requireValue(s.T(), 1, DefaultServerMetrics.serverHandledCounter.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError", "FailedPrecondition"))
-	requireValueHistCount(s.T(), 1, DefaultServerMetrics.serverHandledHistogram.WithLabelValues("unary", "mwitkow.testproto.TestService", "PingError"))
+	requireValue(s.T(), 1, "grpc_server_started_total", "unary", "mwitkow.testproto.TestService", "PingError")
+	requireValue(s.T(), 1, "grpc_server_handled_total", "unary", "mwitkow.testproto.TestService", "PingError", "FailedPrecondition")
+	requireValue(s.T(), 1, "grpc_server_handling_seconds_count", "unary", "mwitkow.testproto.TestService", "PingError")
 }
 
 func (s *ServerInterceptorTestSuite) TestStartedStreamingIncrementsStarted() {
 	_, err := s.testClient.PingList(s.ctx, &pb_testproto.PingRequest{})
 	require.NoError(s.T(), err)
-	requireValueWithRetry(s.ctx, s.T(), 1,
-		DefaultServerMetrics.serverStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValueWithRetry(s.ctx, s.T(), 1, "grpc_server_started_total", "server_stream", "mwitkow.testproto.TestService", "PingList")
 
 	_, err = s.testClient.PingList(s.ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)}) // should return with code=FailedPrecondition
 	require.NoError(s.T(), err, "PingList must not fail immediately")
-	requireValueWithRetry(s.ctx, s.T(), 2,
-		DefaultServerMetrics.serverStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValueWithRetry(s.ctx, s.T(), 2, "grpc_server_started_total", "server_stream", "mwitkow.testproto.TestService", "PingList")
 }
 
 func (s *ServerInterceptorTestSuite) TestStreamingIncrementsMetrics() {
@@ -170,26 +165,51 @@ func (s *ServerInterceptorTestSuite) TestStreamingIncrementsMetrics() {
 	}
 	require.EqualValues(s.T(), countListResponses, count, "Number of received msg on the wire must match")
 
-	requireValueWithRetry(s.ctx, s.T(), 1,
-		DefaultServerMetrics.serverStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValueWithRetry(s.ctx, s.T(), 1,
-		DefaultServerMetrics.serverHandledCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList", "OK"))
-	requireValueWithRetry(s.ctx, s.T(), countListResponses,
-		DefaultServerMetrics.serverStreamMsgSent.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValueWithRetry(s.ctx, s.T(), 1,
-		DefaultServerMetrics.serverStreamMsgReceived.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValueWithRetryHistCount(s.ctx, s.T(), 1,
-		DefaultServerMetrics.serverHandledHistogram.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValueWithRetry(s.ctx, s.T(), 1, "grpc_server_started_total", "server_stream", "mwitkow.testproto.TestService", "PingList")
+	requireValueWithRetry(s.ctx, s.T(), 1, "grpc_server_handled_total", "server_stream", "mwitkow.testproto.TestService", "PingList", "OK")
+	requireValueWithRetry(s.ctx, s.T(), countListResponses, "grpc_server_msg_sent_total", "server_stream", "mwitkow.testproto.TestService", "PingList")
+	requireValueWithRetry(s.ctx, s.T(), 1, "grpc_server_msg_received_total", "server_stream", "mwitkow.testproto.TestService", "PingList")
+	requireValueWithRetry(s.ctx, s.T(), 1, "grpc_server_handling_seconds_count", "server_stream", "mwitkow.testproto.TestService", "PingList")
 
 	_, err := s.testClient.PingList(s.ctx, &pb_testproto.PingRequest{ErrorCodeReturned: uint32(codes.FailedPrecondition)}) // should return with code=FailedPrecondition
 	require.NoError(s.T(), err, "PingList must not fail immediately")
 
-	requireValueWithRetry(s.ctx, s.T(), 2,
-		DefaultServerMetrics.serverStartedCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
-	requireValueWithRetry(s.ctx, s.T(), 1,
-		DefaultServerMetrics.serverHandledCounter.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList", "FailedPrecondition"))
-	requireValueWithRetryHistCount(s.ctx, s.T(), 2,
-		DefaultServerMetrics.serverHandledHistogram.WithLabelValues("server_stream", "mwitkow.testproto.TestService", "PingList"))
+	requireValueWithRetry(s.ctx, s.T(), 2, "grpc_server_started_total", "server_stream", "mwitkow.testproto.TestService", "PingList")
+	requireValueWithRetry(s.ctx, s.T(), 1, "grpc_server_handled_total", "server_stream", "mwitkow.testproto.TestService", "PingList", "FailedPrecondition")
+	requireValueWithRetry(s.ctx, s.T(), 2, "grpc_server_handling_seconds_count", "server_stream", "mwitkow.testproto.TestService", "PingList")
+}
+
+func TestDefaultServerMetrics(t *testing.T) {
+	DefaultServerMetrics.Reset()
+	DefaultClientMetrics.Reset()
+	EnableHandlingTimeHistogram()
+	defer DisableHandlingTimeHistogram()
+	s := grpc_prometheustest.NewServer(t, DefaultServerMetrics, func(s *grpc.Server) {
+		pb_testproto.RegisterTestServiceServer(s, &testService{})
+	}, grpc.WithUnaryInterceptor(UnaryClientInterceptor))
+	_, err := pb_testproto.NewTestServiceClient(s.Conn).PingEmpty(context.Background(), &pb_testproto.Empty{})
+	require.NoError(t, err)
+
+	grpc_prometheustest.ExpectHandled(t, DefaultServerMetrics, "PingEmpty", codes.OK, 1)
+	grpc_prometheustest.ExpectHistogramCount(t, DefaultServerMetrics, "PingEmpty", 1)
+	grpc_prometheustest.ExpectHandled(t, DefaultClientMetrics, "PingEmpty", codes.OK, 1)
+	requireRegistered(t, prometheus.DefaultGatherer,
+		"grpc_server_started_total", "grpc_server_handled_total", "grpc_server_handling_seconds",
+		"grpc_client_started_total", "grpc_client_handled_total")
+}
+
+// requireRegistered requires metric families of the given names to be
+// exported by g.
+func requireRegistered(t *testing.T, g prometheus.Gatherer, names ...string) {
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	exported := map[string]bool{}
+	for _, mf := range mfs {
+		exported[mf.GetName()] = true
+	}
+	for _, name := range names {
+		require.True(t, exported[name], "%s must be registered on the default registry", name)
+	}
 }
 
 // fetchPrometheusLines does mocked HTTP GET request against real prometheus handler to get the same view that Prometheus
@@ -228,8 +248,44 @@ func fetchPrometheusLines(t *testing.T, metricName string, matchingLabelValues .
 	return ret
 }
 
+// fetchValue returns the value of the series of metricName with the given
+// label values, as scraped from the default registry, or -1 if there is
+// none.
+func fetchValue(t *testing.T, metricName string, matchingLabelValues ...string) int {
+	lines := fetchPrometheusLines(t, metricName+"{", matchingLabelValues...)
+	if len(lines) != 1 {
+		return -1
+	}
+	fields := strings.Fields(lines[0])
+	v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	require.NoError(t, err, "malformed line %q", lines[0])
+	return int(v)
+}
+
+func requireValue(t *testing.T, expect int, metricName string, matchingLabelValues ...string) {
+	if v := fetchValue(t, metricName, matchingLabelValues...); v != expect {
+		t.Errorf("expected %d %s%q value; got %d; ", expect, metricName, matchingLabelValues, v)
+	}
+}
+
+func requireValueWithRetry(ctx context.Context, t *testing.T, expect int, metricName string, matchingLabelValues ...string) {
+	for {
+		v := fetchValue(t, metricName, matchingLabelValues...)
+		if v == expect {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Errorf("timeout while expecting %d %s%q value; got %d; ", expect, metricName, matchingLabelValues, v)
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 type testService struct {
-	t *testing.T
+	pb_testproto.TestServiceServer
 }
 
 func (s *testService) PingEmpty(ctx context.Context, _ *pb_testproto.Empty) (*pb_testproto.PingResponse, error) {
@@ -237,7 +293,6 @@ func (s *testService) PingEmpty(ctx context.Context, _ *pb_testproto.Empty) (*pb
 }
 
 func (s *testService) Ping(ctx context.Context, ping *pb_testproto.PingRequest) (*pb_testproto.PingResponse, error) {
-	// Send user trailers and headers.
 	return &pb_testproto.PingResponse{Value: ping.Value, Counter: 42}, nil
 }
 
@@ -250,105 +305,8 @@ func (s *testService) PingList(ping *pb_testproto.PingRequest, stream pb_testpro
 	if ping.ErrorCodeReturned != 0 {
 		return status.Errorf(codes.Code(ping.ErrorCodeReturned), "foobar")
 	}
-	// Send user trailers and headers.
 	for i := 0; i < countListResponses; i++ {
 		stream.Send(&pb_testproto.PingResponse{Value: ping.Value, Counter: int32(i)})
 	}
 	return nil
 }
-
-// toFloat64HistCount does the same thing as prometheus go client testutil.ToFloat64, but for histograms.
-// TODO(bwplotka): Upstream this function to prometheus client.
-func toFloat64HistCount(h prometheus.Observer) uint64 {
-	var (
-		m      prometheus.Metric
-		mCount int
-		mChan  = make(chan prometheus.Metric)
-		done   = make(chan struct{})
-	)
-
-	go func() {
-		for m = range mChan {
-			mCount++
-		}
-		close(done)
-	}()
-
-	c, ok := h.(prometheus.Collector)
-	if !ok {
-		panic(fmt.Errorf("observer is not a collector; got: %T", h))
-	}
-
-	c.Collect(mChan)
-	close(mChan)
-	<-done
-
-	if mCount != 1 {
-		panic(fmt.Errorf("collected %d metrics instead of exactly 1", mCount))
-	}
-
-	pb := &dto.Metric{}
-	m.Write(pb)
-	if pb.Histogram != nil {
-		return pb.Histogram.GetSampleCount()
-	}
-	panic(fmt.Errorf("collected a non-histogram metric: %s", pb))
-}
-
-func requireValue(t *testing.T, expect int, c prometheus.Collector) {
-	v := int(testutil.ToFloat64(c))
-	if v == expect {
-		return
-	}
-
-	metricFullName := reflect.ValueOf(*c.(prometheus.Metric).Desc()).FieldByName("fqName").String()
-	t.Errorf("expected %d %s value; got %d; ", expect, metricFullName, v)
-	t.Fail()
-}
-
-func requireValueHistCount(t *testing.T, expect int, o prometheus.Observer) {
-	v := int(toFloat64HistCount(o))
-	if v == expect {
-		return
-	}
-
-	metricFullName := reflect.ValueOf(*o.(prometheus.Metric).Desc()).FieldByName("fqName").String()
-	t.Errorf("expected %d %s value; got %d; ", expect, metricFullName, v)
-	t.Fail()
-}
-
-func requireValueWithRetry(ctx context.Context, t *testing.T, expect int, c prometheus.Collector) {
-	for {
-		v := int(testutil.ToFloat64(c))
-		if v == expect {
-			return
-		}
-
-		select {
-		case <-ctx.Done():
-			metricFullName := reflect.ValueOf(*c.(prometheus.Metric).Desc()).FieldByName("fqName").String()
-			t.Errorf("timeout while expecting %d %s value; got %d; ", expect, metricFullName, v)
-			t.Fail()
-			return
-		case <-time.After(100 * time.Millisecond):
-		}
-	}
-}
-
-func requireValueWithRetryHistCount(ctx context.Context, t *testing.T, expect int, o prometheus.Observer) {
-	for {
-		v := int(toFloat64HistCount(o))
-		if v == expect {
-			return
-		}
-
-		select {
-		case <-ctx.Done():
-			metricFullName := reflect.ValueOf(*o.(prometheus.Metric).Desc()).FieldByName("fqName").String()
-			t.Errorf("timeout while expecting %d %s histogram count value; got %d; ", expect, metricFullName, v)
-			t.Fail()
-			return
-		case <-time.After(100 * time.Millisecond):
-		}
-	}
-}